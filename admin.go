@@ -0,0 +1,442 @@
+package goup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithAdminToken set AdminToken.
+func WithAdminToken(v string) ServerOptFn { return func(o *ServerOpt) { o.AdminToken = v } }
+
+// AdminSession is a PAKE session listed by the admin API.
+type AdminSession struct {
+	ID         string    `json:"id"`
+	Identity   string    `json:"identity,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Created    time.Time `json:"created"` // zero for the sessions restored after a restart
+	// Active is the number of the chunk requests in flight.
+	Active int `json:"active"`
+}
+
+// AdminTransfer is an upload or a download in progress listed by the admin API.
+type AdminTransfer struct {
+	Name      string `json:"name"`
+	Session   string `json:"session,omitempty"`
+	Identity  string `json:"identity,omitempty"`
+	TotalSize uint64 `json:"totalSize"`
+	// Transferred is the bytes received of the upload, or sent of the download.
+	Transferred uint64    `json:"transferred"`
+	Started     time.Time `json:"started"`
+	Updated     time.Time `json:"updated"`
+	// Active is the number of the chunk requests in flight.
+	Active int `json:"active"`
+}
+
+// sessionInfo is the client info of a PAKE session.
+type sessionInfo struct {
+	Identity   string
+	RemoteAddr string
+	Created    time.Time
+}
+
+var sessionInfos = sync.Map{}
+
+// transfer is an upload or download request in flight, which is closed by the admin.
+type transfer struct {
+	kind, session, name string
+	identity            string
+	started             time.Time
+	cancel              context.CancelFunc
+	done                chan struct{}
+}
+
+// transferRegistry tracks the transfer requests in flight, and the transfers and the sessions closed by the admin.
+type transferRegistry struct {
+	sync.Mutex
+	active    map[*transfer]bool
+	cancelled map[string]time.Time // by kind:session:name
+	killed    map[string]time.Time // by session
+}
+
+var transfers = &transferRegistry{active: map[*transfer]bool{}, cancelled: map[string]time.Time{}, killed: map[string]time.Time{}}
+
+// closedTTL is how long the transfers and the sessions closed by the admin are refused.
+const closedTTL = 24 * time.Hour
+
+// errTransferClosed is returned by the body and the response of a transfer closed by the admin.
+var errTransferClosed = errors.New("transfer closed by admin")
+
+// begin registers the transfer request, whose body and response fail after the transfer is closed by the admin.
+// The request of a closed transfer is refused by 410.
+func (t *transferRegistry) begin(w http.ResponseWriter, r *http.Request, kind, session, name string) (http.ResponseWriter, *http.Request, func(), error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.cancelled[kind+":"+session+":"+name]; ok {
+		return w, r, func() {}, &statusError{Code: http.StatusGone, Err: fmt.Errorf("%s %s of session %s is closed by admin", kind, name, session)}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	tr := &transfer{kind: kind, session: session, name: name, identity: Identity(r), started: time.Now(), cancel: cancel, done: make(chan struct{})}
+	t.active[tr] = true
+
+	r = r.WithContext(ctx)
+	r.Body = &transferBody{ReadCloser: r.Body, ctx: ctx}
+	end := func() {
+		cancel()
+		t.Lock()
+		delete(t.active, tr)
+		t.Unlock()
+		close(tr.done)
+	}
+	return &transferWriter{ResponseWriter: w, ctx: ctx}, r, end, nil
+}
+
+// close closes the transfers in flight matching the kind, the session and the name, "" for any,
+// and refuses the later requests of the name in the sessions. It returns the transfers closed.
+func (t *transferRegistry) close(kind, session, name string, sessions ...string) []*transfer {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	var closed []*transfer
+	for tr := range t.active {
+		if (kind == "" || tr.kind == kind) && (session == "" || tr.session == session) && (name == "" || tr.name == name) {
+			tr.cancel()
+			sessions = append(sessions, tr.session)
+			closed = append(closed, tr)
+		}
+	}
+	if name != "" {
+		for _, s := range sessions {
+			t.cancelled[kind+":"+s+":"+name] = now
+		}
+	}
+	return closed
+}
+
+// kill refuses the later requests of the session, including the PAKE to renegotiate its key.
+func (t *transferRegistry) kill(session string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.prune(time.Now())
+	t.killed[session] = time.Now()
+}
+
+// isKilled tells whether the session is killed by the admin.
+func (t *transferRegistry) isKilled(session string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	at, ok := t.killed[session]
+	return ok && time.Since(at) <= closedTTL
+}
+
+// killedSessions returns the sessions killed, to be saved on shutdown.
+func (t *transferRegistry) killedSessions() map[string]time.Time {
+	t.Lock()
+	defer t.Unlock()
+
+	t.prune(time.Now())
+	killed := make(map[string]time.Time, len(t.killed))
+	for k, at := range t.killed {
+		killed[k] = at
+	}
+	return killed
+}
+
+func (t *transferRegistry) restoreKilled(killed map[string]time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	for k, at := range killed {
+		t.killed[k] = at
+	}
+}
+
+func (t *transferRegistry) prune(now time.Time) {
+	for k, at := range t.cancelled {
+		if now.Sub(at) > closedTTL {
+			delete(t.cancelled, k)
+		}
+	}
+	for k, at := range t.killed {
+		if now.Sub(at) > closedTTL {
+			delete(t.killed, k)
+		}
+	}
+}
+
+// waitClosed waits the closed transfers to end, like the chunk writings, up to the timeout.
+func waitClosed(closed []*transfer, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, tr := range closed {
+		select {
+		case <-tr.done:
+		case <-timer.C:
+			log.Printf("W! %s %s of session %s not ended in %s", tr.kind, tr.name, tr.session, timeout)
+			return
+		}
+	}
+}
+
+// count returns the number of the transfers in flight matching the kind, the session and the name, "" for any.
+func (t *transferRegistry) count(kind, session, name string) int {
+	t.Lock()
+	defer t.Unlock()
+
+	n := 0
+	for tr := range t.active {
+		if (kind == "" || tr.kind == kind) && (session == "" || tr.session == session) && (name == "" || tr.name == name) {
+			n++
+		}
+	}
+	return n
+}
+
+type transferBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func (b *transferBody) Read(p []byte) (int, error) {
+	if b.ctx.Err() != nil {
+		return 0, errTransferClosed
+	}
+	return b.ReadCloser.Read(p)
+}
+
+type transferWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	if w.ctx.Err() != nil {
+		return 0, errTransferClosed
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// isAdminRequest tells whether the request is of the admin API and authenticated by one of the admin tokens.
+func isAdminRequest(r *http.Request, adminTokens ...string) bool {
+	if ParseHeader(r.Header.Get("Content-Gulp")).Admin == "" {
+		return false
+	}
+	for _, token := range adminTokens {
+		if token != "" && SecureCompare(r.Header.Get(Authorization), bearerPrefix+token) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAdmin serves the admin API, like listing the sessions and the transfers in progress,
+// killing a session, canceling an upload, or closing a download.
+func serveAdmin(w http.ResponseWriter, r *http.Request, h Header, opt *ServerOpt) error {
+	if opt.AdminToken == "" {
+		return &statusError{Code: http.StatusForbidden, Err: errors.New("admin API is disabled")}
+	}
+	if !SecureCompare(r.Header.Get(Authorization), bearerPrefix+opt.AdminToken) {
+		DefaultMetrics.IncAuthFailure()
+		return &statusError{Code: http.StatusUnauthorized, Err: errors.New("admin token required")}
+	}
+
+	name := storageName(r.URL.Path)
+	switch {
+	case r.Method == http.MethodGet && h.Admin == "sessions":
+		return writeJSON(w, adminSessions())
+	case r.Method == http.MethodGet && h.Admin == "uploads":
+		return writeJSON(w, adminTransfers("upload", uploads))
+	case r.Method == http.MethodGet && h.Admin == "downloads":
+		return writeJSON(w, adminTransfers("download", downloads))
+	case r.Method == http.MethodDelete && h.Admin == "session" && h.Session != "":
+		return killSession(h.Session)
+	case r.Method == http.MethodDelete && h.Admin == "upload" && name != "":
+		return opt.cancelUpload(name, h.Session)
+	case r.Method == http.MethodDelete && h.Admin == "download" && name != "":
+		return closeDownload(name, h.Session)
+	}
+	return &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("bad admin request %s %s", r.Method, h.Admin)}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set(ContentType, "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func adminSessions() []AdminSession {
+	sessions := []AdminSession{}
+	pakeCache.Range(func(k, _ interface{}) bool {
+		s := AdminSession{ID: k.(string), Active: transfers.count("", k.(string), "")}
+		if v, ok := sessionInfos.Load(k); ok {
+			info := v.(*sessionInfo)
+			s.Identity, s.RemoteAddr, s.Created = info.Identity, info.RemoteAddr, info.Created
+		}
+		sessions = append(sessions, s)
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Created.Before(sessions[j].Created) })
+	return sessions
+}
+
+// adminTransfers lists the transfers of the tracker, and the ones in flight but not tracked, like the plain downloads.
+func adminTransfers(kind string, tracker *uploadTracker) []AdminTransfer {
+	list := []AdminTransfer{}
+	tracked := map[string]bool{}
+	for _, s := range tracker.inProgress() {
+		name := strings.TrimPrefix(s.Name, s.Session+":") // the downloads are keyed by session:name
+		tracked[s.Session+":"+name] = true
+		list = append(list, AdminTransfer{
+			Name: name, Session: s.Session, Identity: s.Identity, TotalSize: s.TotalSize, Transferred: s.Received,
+			Started: s.Started, Updated: s.Updated, Active: transfers.count(kind, s.Session, name),
+		})
+	}
+
+	transfers.Lock()
+	for tr := range transfers.active {
+		if tr.kind == kind && !tracked[tr.session+":"+tr.name] {
+			tracked[tr.session+":"+tr.name] = true
+			list = append(list, AdminTransfer{
+				Name: tr.name, Session: tr.session, Identity: tr.identity, Started: tr.started, Updated: tr.started, Active: 1,
+			})
+		}
+	}
+	transfers.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// killSession forgets the session key and closes its transfers, the later requests of the session are refused by 410,
+// which the client does not retry, unlike the 403 of an unknown session.
+func killSession(sessionID string) error {
+	if _, ok := pakeCache.LoadAndDelete(sessionID); !ok {
+		return &statusError{Code: http.StatusNotFound, Err: fmt.Errorf("session %s not found", sessionID)}
+	}
+	sessionInfos.Delete(sessionID)
+	transfers.kill(sessionID)
+	closed := transfers.close("", sessionID, "")
+	log.Printf("admin killed session %s, %d requests closed", sessionID, len(closed))
+	return nil
+}
+
+// cancelUpload closes the upload in progress, and deletes its partial file.
+func (o *ServerOpt) cancelUpload(name, sessionID string) error {
+	var sessions []string
+	if s, ok := uploads.inProgress()[name]; ok && (sessionID == "" || s.Session == sessionID) {
+		sessions = append(sessions, s.Session)
+	}
+	closed := transfers.close("upload", sessionID, name, sessions...)
+	if len(sessions) == 0 && len(closed) == 0 {
+		return &statusError{Code: http.StatusNotFound, Err: fmt.Errorf("no upload of %s in progress", name)}
+	}
+
+	waitClosed(closed, 5*time.Second) // the chunks in flight may write the file again
+	uploads.expire(name, time.Now())
+	if err := o.Storage.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	unmarkPartial(o.Storage, name)
+	o.used.update(name)
+	log.Printf("admin canceled upload %s, %d requests closed", name, len(closed))
+	return nil
+}
+
+// closeDownload closes the download in progress, the later requests of its sessions are refused.
+func closeDownload(name, sessionID string) error {
+	var sessions []string
+	for _, s := range downloads.inProgress() {
+		if strings.TrimPrefix(s.Name, s.Session+":") == name && (sessionID == "" || s.Session == sessionID) {
+			sessions = append(sessions, s.Session)
+			downloads.expire(s.Name, time.Now())
+		}
+	}
+	closed := transfers.close("download", sessionID, name, sessions...)
+	if len(sessions) == 0 && len(closed) == 0 {
+		return &statusError{Code: http.StatusNotFound, Err: fmt.Errorf("no download of %s in progress", name)}
+	}
+	log.Printf("admin closed download %s, %d requests closed", name, len(closed))
+	return nil
+}
+
+// newSessionInfo records the client info of the PAKE session.
+func newSessionInfo(r *http.Request, sessionID string) {
+	info := &sessionInfo{RemoteAddr: r.RemoteAddr, Created: time.Now()}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.RemoteAddr = host
+	}
+	if v, ok := r.Context().Value(identityKey{}).(string); ok {
+		info.Identity = v
+	}
+	sessionInfos.Store(sessionID, info)
+}
+
+// adminDo sends the admin request.
+func (c *Client) adminDo(ctx context.Context, method, name, gulp string, v interface{}) error {
+	u, err := c.remoteURL(name)
+	if err != nil {
+		return err
+	}
+	body, _, err := c.remoteDo(ctx, "admin", method, u, gulp)
+	if err != nil || v == nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decode %s: %w", gulp, err)
+	}
+	return nil
+}
+
+// AdminSessions lists the PAKE sessions of the server, the bearer of the client is the admin token.
+func (c *Client) AdminSessions(ctx context.Context) ([]AdminSession, error) {
+	var sessions []AdminSession
+	err := c.adminDo(ctx, http.MethodGet, "", "Admin=sessions", &sessions)
+	return sessions, err
+}
+
+// AdminUploads lists the uploads in progress of the server.
+func (c *Client) AdminUploads(ctx context.Context) ([]AdminTransfer, error) {
+	var list []AdminTransfer
+	err := c.adminDo(ctx, http.MethodGet, "", "Admin=uploads", &list)
+	return list, err
+}
+
+// AdminDownloads lists the downloads in progress of the server.
+func (c *Client) AdminDownloads(ctx context.Context) ([]AdminTransfer, error) {
+	var list []AdminTransfer
+	err := c.adminDo(ctx, http.MethodGet, "", "Admin=downloads", &list)
+	return list, err
+}
+
+// AdminKillSession kills the session, its transfers are closed and refused later.
+func (c *Client) AdminKillSession(ctx context.Context, sessionID string) error {
+	return c.adminDo(ctx, http.MethodDelete, "", "Admin=session; Session="+url.QueryEscape(sessionID), nil)
+}
+
+// AdminCancelUpload cancels the upload in progress of the session, "" for any, and discards its partial data.
+func (c *Client) AdminCancelUpload(ctx context.Context, name, sessionID string) error {
+	return c.adminDo(ctx, http.MethodDelete, name, "Admin=upload; Session="+url.QueryEscape(sessionID), nil)
+}
+
+// AdminCloseDownload force-closes the download in progress of the session, "" for any.
+func (c *Client) AdminCloseDownload(ctx context.Context, name, sessionID string) error {
+	return c.adminDo(ctx, http.MethodDelete, name, "Admin=download; Session="+url.QueryEscape(sessionID), nil)
+}
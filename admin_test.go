@@ -0,0 +1,83 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdminCancelUpload(t *testing.T) {
+	root := setupTestRoot(t)
+	ts := httptest.NewServer(Bearer("t1", ServerHandle("code", "", 64*1024, 0, nil, WithAdminToken("a1")), "a1"))
+	defer ts.Close()
+
+	ctx := context.Background()
+	admin, _ := New(ts.URL, WithBearer("a1"))
+	var se *StatusCodeError
+	if _, err := admin.AdminSessions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the Admin header alone does not pass the bearer auth
+	for _, token := range []string{"", "Bearer bad"} {
+		r, _ := http.NewRequest(http.MethodGet, ts.URL+"/a.txt", nil)
+		r.Header.Set(Authorization, token)
+		r.Header.Set("Content-Gulp", "Admin=sessions")
+		if rsp, err := http.DefaultClient.Do(r); err != nil || rsp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 of the forged admin request, got %v", err)
+		}
+	}
+	if user, _ := New(ts.URL, WithBearer("t1")); true {
+		if _, err := user.AdminSessions(ctx); !errors.As(err, &se) || se.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %v", err)
+		}
+	}
+
+	src := writeTestFile(t, 256*1024)
+	c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithBearer("t1"),
+		WithCoroutines(1), WithLimitRate(64*1024))
+	done := make(chan error)
+	go func() { done <- c.Start() }()
+
+	var list []AdminTransfer
+	for i := 0; i < 100 && len(list) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		list, _ = admin.AdminUploads(ctx)
+	}
+	if len(list) != 1 || list[0].Name != filepath.Base(src) || list[0].Session != c.ID {
+		t.Fatalf("unexpected uploads %+v", list)
+	}
+	if err := admin.AdminCancelUpload(ctx, list[0].Name, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("upload not canceled")
+	}
+	if _, err := os.Stat(filepath.Join(root, list[0].Name)); !os.IsNotExist(err) {
+		t.Fatalf("partial upload not discarded: %v", err)
+	}
+	if list, _ := admin.AdminUploads(ctx); len(list) != 0 {
+		t.Fatalf("unexpected uploads after canceled %+v", list)
+	}
+
+	if err := admin.AdminKillSession(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.AdminKillSession(ctx, c.ID); !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %v", err)
+	}
+
+	// the killed client can't renegotiate the session key to continue
+	c2, _ := New(ts.URL, WithFullPath(src), WithRename("b.bin"), WithChunkSize(64*1024), WithCode("code"), WithBearer("t1"))
+	c2.ID = c.ID
+	if err := c2.Start(); !errors.As(err, &se) || se.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410 of the killed session, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b.bin")); !os.IsNotExist(err) {
+		t.Fatalf("killed session uploaded: %v", err)
+	}
+}
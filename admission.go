@@ -0,0 +1,178 @@
+package goup
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Admission caps the concurrent chunk requests, the excess requests wait in the queue up to QueueTimeout,
+// and are refused by 429 with Retry-After then.
+type Admission struct {
+	// Global caps the chunk requests of all the clients, 0 for no limit.
+	Global int
+	// Client caps the chunk requests of each client, by its bearer identity or its IP, 0 for no limit.
+	Client int
+	// Queue caps the waiting requests, 0 for no limit.
+	Queue int
+	// QueueTimeout limits the waiting for a slot, 0 to refuse the excess requests at once.
+	QueueTimeout time.Duration
+	// RetryAfter is the Retry-After of the refused requests, default 1s.
+	RetryAfter time.Duration
+}
+
+// WithAdmission set Admission.
+func WithAdmission(v Admission) ServerOptFn { return func(o *ServerOpt) { o.Admission = v } }
+
+// SetAdmission replaces the admission without restart, the requests in progress release their old slots.
+func (s *Server) SetAdmission(a Admission) {
+	m := newAdmission(a)
+	s.opt.mu.Lock()
+	s.opt.Admission, s.opt.admission = a, m
+	s.opt.mu.Unlock()
+}
+
+// clientSlots is the slots of a client, forgotten when no request holds or waits them.
+type clientSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+// admission is the semaphores of the Admission.
+type admission struct {
+	Admission
+	global  chan struct{}
+	mu      sync.Mutex
+	waiting int
+	clients map[string]*clientSlots
+}
+
+func newAdmission(a Admission) *admission {
+	if a.Global <= 0 && a.Client <= 0 {
+		return nil
+	}
+	if a.RetryAfter <= 0 {
+		a.RetryAfter = time.Second
+	}
+	m := &admission{Admission: a, clients: map[string]*clientSlots{}}
+	if a.Global > 0 {
+		m.global = make(chan struct{}, a.Global)
+	}
+	return m
+}
+
+// admit waits the slots of the request, it returns the func to release them,
+// or the 429 error with Retry-After set when the queue is full or the waiting timed out.
+func (a *admission) admit(w http.ResponseWriter, r *http.Request) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	client := Identity(r)
+	var c *clientSlots
+	if a.Client > 0 {
+		c = a.ref(client)
+	}
+	unref := func() {
+		if c != nil {
+			a.unref(client)
+		}
+	}
+
+	var held []chan struct{}
+	release := func() {
+		for _, s := range held {
+			<-s
+		}
+		unref()
+	}
+
+	var timeout <-chan time.Time
+	queued := false
+	for _, s := range []chan struct{}{c.slotsOrNil(), a.global} {
+		if s == nil {
+			continue
+		}
+		select {
+		case s <- struct{}{}:
+			held = append(held, s)
+			continue
+		default:
+		}
+
+		if !queued {
+			if queued = a.enqueue(); !queued {
+				release()
+				return nil, a.refuse(w, fmt.Errorf("too many queued chunk requests, %s refused", client))
+			}
+			defer a.dequeue()
+			t := time.NewTimer(a.QueueTimeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case s <- struct{}{}:
+			held = append(held, s)
+		case <-timeout:
+			release()
+			return nil, a.refuse(w, fmt.Errorf("too many concurrent chunk requests, %s timed out in queue", client))
+		case <-r.Context().Done():
+			release()
+			return nil, r.Context().Err()
+		}
+	}
+	return release, nil
+}
+
+func (c *clientSlots) slotsOrNil() chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.slots
+}
+
+func (a *admission) ref(client string) *clientSlots {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.clients[client]
+	if !ok {
+		c = &clientSlots{slots: make(chan struct{}, a.Client)}
+		a.clients[client] = c
+	}
+	c.refs++
+	return c
+}
+
+func (a *admission) unref(client string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c := a.clients[client]; c != nil {
+		if c.refs--; c.refs <= 0 {
+			delete(a.clients, client)
+		}
+	}
+}
+
+// enqueue takes a place in the queue, false if the queue is full.
+func (a *admission) enqueue() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Queue > 0 && a.waiting >= a.Queue {
+		return false
+	}
+	a.waiting++
+	return true
+}
+
+func (a *admission) dequeue() {
+	a.mu.Lock()
+	a.waiting--
+	a.mu.Unlock()
+}
+
+func (a *admission) refuse(w http.ResponseWriter, err error) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int((a.RetryAfter+time.Second-1)/time.Second)))
+	return &statusError{Code: http.StatusTooManyRequests, Err: err}
+}
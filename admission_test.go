@@ -0,0 +1,76 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(Admission{Global: 2, Client: 1, QueueTimeout: 50 * time.Millisecond, RetryAfter: 2 * time.Second})
+	req := func(ip string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		return r
+	}
+
+	release1, err := a.admit(httptest.NewRecorder(), req("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := a.admit(httptest.NewRecorder(), req("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	var se *statusError
+	if _, err := a.admit(w, req("10.0.0.1")); !errors.As(err, &se) || se.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the client cap, got %v", err)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("unexpected Retry-After %q", got)
+	}
+	if _, err := a.admit(httptest.NewRecorder(), req("10.0.0.3")); !errors.As(err, &se) {
+		t.Fatalf("expected 429 over the global cap, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release1()
+	}()
+	release3, err := a.admit(httptest.NewRecorder(), req("10.0.0.3"))
+	if err != nil {
+		t.Fatalf("queued request not admitted: %v", err)
+	}
+	release2()
+	release3()
+	if len(a.clients) != 0 || len(a.global) != 0 {
+		t.Fatalf("slots leaked, clients %d, global %d", len(a.clients), len(a.global))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	attempts := 0
+	start := time.Now()
+	err := retryJob(context.Background(), RetryPolicy{MinWait: time.Millisecond}, func() error {
+		if attempts++; attempts == 1 {
+			return &StatusCodeError{StatusCode: http.StatusTooManyRequests, RetryAfter: 200 * time.Millisecond}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("unexpected %d attempts: %v", attempts, err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("Retry-After not honoured, retried after %s", d)
+	}
+
+	h := http.Header{"Retry-After": []string{"3"}}
+	if d := parseRetryAfter(h); d != 3*time.Second {
+		t.Fatalf("unexpected Retry-After %s", d)
+	}
+}
@@ -0,0 +1,297 @@
+package goup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/goup/shapeio"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimit is the rate limits in bytes per second of a direction, 0 for no limit.
+// Each limit is split fairly among the active connections sharing it.
+type BandwidthLimit struct {
+	// Global limits all the connections.
+	Global uint64
+	// Identity limits the connections of each authenticated bearer identity.
+	Identity uint64
+	// IP limits the connections of each client IP.
+	IP uint64
+}
+
+// Bandwidth limits the uploads (the request bodies) and the downloads (the responses) separately.
+type Bandwidth struct {
+	Upload   BandwidthLimit
+	Download BandwidthLimit
+}
+
+// WithBandwidth set Bandwidth.
+func WithBandwidth(v Bandwidth) ServerOptFn { return func(o *ServerOpt) { o.Bandwidth = v } }
+
+// ParseBandwidth parses the bandwidth specs like [up:|down:]global=100MiB,user=10MiB,ip=5MiB,
+// the spec without the direction limits both the uploads and the downloads.
+func ParseBandwidth(specs ...string) (b Bandwidth, err error) {
+	for _, spec := range specs {
+		limits := []*BandwidthLimit{&b.Upload, &b.Download}
+		s := spec
+		if dir, rest, ok := strings.Cut(spec, ":"); ok {
+			switch dir {
+			case "up", "upload":
+				limits = limits[:1]
+			case "down", "download":
+				limits = limits[1:]
+			default:
+				return b, fmt.Errorf("unknown bandwidth direction %q in %s", dir, spec)
+			}
+			s = rest
+		}
+
+		for _, kv := range strings.Split(s, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			n, err := humanize.ParseBytes(v)
+			if err != nil {
+				return b, fmt.Errorf("parse bandwidth %s: %w", spec, err)
+			}
+			for _, l := range limits {
+				switch k {
+				case "global":
+					l.Global = n
+				case "user", "identity":
+					l.Identity = n
+				case "ip":
+					l.IP = n
+				default:
+					return b, fmt.Errorf("unknown bandwidth key %q in %s", k, spec)
+				}
+			}
+		}
+	}
+	return b, nil
+}
+
+// bandwidthPool is a rate limit shared by the connections.
+type bandwidthPool struct {
+	rate  float64
+	conns map[*bandwidthConn]bool
+	// key is the identity or the IP in the pools of the owner, which forgets the pool without connections.
+	key   string
+	owner map[string]*bandwidthPool
+}
+
+// bandwidthConn is the limiter of a connection, whose rate is its smallest share of its pools.
+// bandwidthBurst is the bytes a connection may move at once, about a read buffer,
+// so that an idle connection can't save up a large burst over its share.
+const bandwidthBurst = 64 << 10
+
+type bandwidthConn struct {
+	*rate.Limiter
+	pools []*bandwidthPool
+}
+
+// bandwidthLimiter is the hierarchical limiters of a direction.
+type bandwidthLimiter struct {
+	sync.Mutex
+	BandwidthLimit
+	global     *bandwidthPool
+	identities map[string]*bandwidthPool
+	ips        map[string]*bandwidthPool
+}
+
+func newBandwidthLimiter(l BandwidthLimit) *bandwidthLimiter {
+	if l == (BandwidthLimit{}) {
+		return nil
+	}
+	b := &bandwidthLimiter{BandwidthLimit: l, identities: map[string]*bandwidthPool{}, ips: map[string]*bandwidthPool{}}
+	if l.Global > 0 {
+		b.global = &bandwidthPool{rate: float64(l.Global), conns: map[*bandwidthConn]bool{}}
+	}
+	return b
+}
+
+// pool returns the pool of the key, created if absent.
+func pool(pools map[string]*bandwidthPool, key string, limit uint64) *bandwidthPool {
+	p, ok := pools[key]
+	if !ok {
+		p = &bandwidthPool{rate: float64(limit), conns: map[*bandwidthConn]bool{}, key: key, owner: pools}
+		pools[key] = p
+	}
+	return p
+}
+
+// join adds the connection of the identity ("" if not authenticated) and the IP to their pools,
+// it returns nil if the connection is not limited.
+func (b *bandwidthLimiter) join(identity, ip string) *bandwidthConn {
+	if b == nil {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	c := &bandwidthConn{Limiter: rate.NewLimiter(1, bandwidthBurst)}
+	if b.global != nil {
+		c.pools = append(c.pools, b.global)
+	}
+	if b.Identity > 0 && identity != "" {
+		c.pools = append(c.pools, pool(b.identities, identity, b.Identity))
+	}
+	if b.IP > 0 {
+		c.pools = append(c.pools, pool(b.ips, ip, b.IP))
+	}
+	if len(c.pools) == 0 {
+		return nil
+	}
+	for _, p := range c.pools {
+		p.conns[c] = true
+	}
+	c.AllowN(time.Now(), bandwidthBurst) // spends the initial burst
+	b.rebalance(c.pools)
+	return c
+}
+
+// leave removes the connection from its pools, the shares of the others grow.
+func (b *bandwidthLimiter) leave(c *bandwidthConn) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, p := range c.pools {
+		if delete(p.conns, c); len(p.conns) == 0 {
+			delete(p.owner, p.key)
+		}
+	}
+	b.rebalance(c.pools)
+}
+
+// rebalance sets the rates of the connections of the pools to their smallest shares.
+func (b *bandwidthLimiter) rebalance(pools []*bandwidthPool) {
+	for _, p := range pools {
+		for c := range p.conns {
+			share := math.Inf(1)
+			for _, cp := range c.pools {
+				share = math.Min(share, cp.rate/float64(len(cp.conns)))
+			}
+			c.SetLimit(rate.Limit(share))
+		}
+	}
+}
+
+// SetBandwidth replaces the bandwidth limits without restart, the connections in progress keep their pools.
+func (s *Server) SetBandwidth(b Bandwidth) {
+	l := newBandwidthLimiters(b)
+	s.opt.mu.Lock()
+	s.opt.Bandwidth, s.opt.bandwidth = b, l
+	s.opt.mu.Unlock()
+}
+
+// limiters returns the bandwidth limiters and the admission of the requests.
+func (o *ServerOpt) limiters() (*bandwidthLimiters, *admission) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.bandwidth, o.admission
+}
+
+// bandwidthLimiters is the limiters of the uploads and the downloads.
+type bandwidthLimiters struct {
+	upload, download *bandwidthLimiter
+}
+
+func newBandwidthLimiters(b Bandwidth) *bandwidthLimiters {
+	if b == (Bandwidth{}) {
+		return nil
+	}
+	return &bandwidthLimiters{upload: newBandwidthLimiter(b.Upload), download: newBandwidthLimiter(b.Download)}
+}
+
+// limit limits the request body and the response of the connection, the returned func leaves the pools.
+func (l *bandwidthLimiters) limit(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if l == nil {
+		return w, func() {}
+	}
+
+	identity, _ := r.Context().Value(identityKey{}).(string)
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	var leaves []func()
+	if l.upload != nil {
+		up := &lazyBandwidth{limiter: l.upload, identity: identity, ip: ip, ctx: r.Context()}
+		leaves = append(leaves, up.leave)
+		r.Body = &limitBody{ReadCloser: r.Body, limiter: up}
+	}
+	if l.download != nil {
+		down := &lazyBandwidth{limiter: l.download, identity: identity, ip: ip, ctx: r.Context()}
+		leaves = append(leaves, down.leave)
+		w = &limitResponseWriter{ResponseWriter: w, limiter: down}
+	}
+	return w, func() {
+		for _, leave := range leaves {
+			leave()
+		}
+	}
+}
+
+// lazyBandwidth joins the pools of a direction on the first bytes moved, so that the requests moving nothing
+// in the direction, like the PAKE, the stat, or the downloads for the upload pools, don't shrink the shares of the others.
+type lazyBandwidth struct {
+	limiter      *bandwidthLimiter
+	identity, ip string
+	ctx          context.Context
+
+	mu     sync.Mutex
+	joined bool
+	left   bool
+	conn   *bandwidthConn
+}
+
+// WaitBytes waits the share of the connection for n bytes.
+func (b *lazyBandwidth) WaitBytes(n int) error {
+	b.mu.Lock()
+	if !b.joined && !b.left {
+		b.joined, b.conn = true, b.limiter.join(b.identity, b.ip)
+	}
+	c := b.conn
+	b.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+
+	w := &shapeio.RateLimiter{Limiter: c.Limiter, Context: b.ctx, OnWait: DefaultMetrics.ObserveRateLimitWait}
+	return w.WaitBytes(n)
+}
+
+func (b *lazyBandwidth) leave() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.left = true
+	if b.conn != nil {
+		b.limiter.leave(b.conn)
+		b.conn = nil
+	}
+}
+
+// limitBody waits the bandwidth of the bytes read from the request body.
+type limitBody struct {
+	io.ReadCloser
+	limiter *lazyBandwidth
+}
+
+func (b *limitBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if we := b.limiter.WaitBytes(n); we != nil && err == nil {
+			err = we
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,96 @@
+package goup
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bingoohuang/goup/shapeio"
+)
+
+func TestBandwidth(t *testing.T) {
+	b, err := ParseBandwidth("down:global=120,user=90", "ip=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Bandwidth{Upload: BandwidthLimit{IP: 100}, Download: BandwidthLimit{Global: 120, Identity: 90, IP: 100}}
+	if b != want {
+		t.Fatalf("unexpected bandwidth %+v", b)
+	}
+	if _, err := ParseBandwidth("side:ip=1"); err == nil {
+		t.Fatal("bad direction accepted")
+	}
+
+	l := newBandwidthLimiter(b.Download)
+	a1 := l.join("alice", "10.0.0.1")
+	a2 := l.join("alice", "10.0.0.2")
+	c := l.join("", "10.0.0.1")
+	for _, v := range []struct {
+		conn *bandwidthConn
+		want float64
+	}{
+		{a1, 40}, // the global 120 shared by 3
+		{a2, 40},
+		{c, 40},
+	} {
+		if got := float64(v.conn.Limit()); got != v.want {
+			t.Fatalf("unexpected rate %v, want %v", got, v.want)
+		}
+	}
+
+	l.leave(c)
+	if a1.Limit() != 45 || a2.Limit() != 45 { // alice 90 shared by 2
+		t.Fatalf("unexpected rates %v %v after leaving", a1.Limit(), a2.Limit())
+	}
+	l.leave(a2)
+	if a1.Limit() != 90 || len(l.ips) != 1 {
+		t.Fatalf("unexpected rate %v after leaving, ip pools %d", a1.Limit(), len(l.ips))
+	}
+
+	// the writes larger than the burst are waited by pieces
+	a1.SetLimit(1 << 30)
+	w := &shapeio.RateLimiter{Limiter: a1.Limiter, Context: context.Background()}
+	if err := w.WaitBytes(4*bandwidthBurst + 1); err != nil || a1.Burst() != bandwidthBurst {
+		t.Fatalf("wait beyond the burst %d: %v", a1.Burst(), err)
+	}
+}
+
+func TestBandwidthDirections(t *testing.T) {
+	l := newBandwidthLimiters(Bandwidth{Upload: BandwidthLimit{IP: 100 << 20}, Download: BandwidthLimit{IP: 100 << 20}})
+	var leaves []func()
+	defer func() {
+		for _, leave := range leaves {
+			leave()
+		}
+	}()
+
+	// 4 uploads and 4 downloads of the same IP, each direction shares its own rate
+	var downs []*lazyBandwidth
+	for i := 0; i < 4; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))
+		_, leave := l.limit(httptest.NewRecorder(), r)
+		leaves = append(leaves, leave)
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Fatal(err)
+		}
+
+		w, leave := l.limit(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a.bin", nil))
+		leaves = append(leaves, leave)
+		if _, err := w.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		downs = append(downs, w.(*limitResponseWriter).limiter.(*lazyBandwidth))
+	}
+
+	for _, d := range downs {
+		if got := d.conn.Limit(); got != 25<<20 {
+			t.Fatalf("unexpected download rate %v, want a quarter of the IP rate", got)
+		}
+	}
+	if n := len(l.upload.ips["192.0.2.1"].conns); n != 4 {
+		t.Fatalf("%d connections in the upload pool, want 4", n)
+	}
+}
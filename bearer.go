@@ -2,10 +2,13 @@
 package goup
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha512"
 	"crypto/subtle"
+	"net"
 	"net/http"
+	"sync"
 
 	"github.com/bingoohuang/gg/pkg/codec/b64"
 )
@@ -13,21 +16,87 @@ import (
 const bearerPrefix = "Bearer "
 
 // Bearer returns a Handler that authenticates via Bearer Auth. Writes a http.StatusUnauthorized
-// if authentication fails.
-func Bearer(token string, handle http.HandlerFunc) http.HandlerFunc {
+// if authentication fails. The admin requests may be authenticated by the admin token instead.
+func Bearer(token string, handle http.HandlerFunc, adminToken ...string) http.HandlerFunc {
 	if token == "" {
 		return handle
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if a := r.Header.Get(Authorization); SecureCompare(a, bearerPrefix+token) {
+		if a := r.Header.Get(Authorization); SecureCompare(a, bearerPrefix+token) || isAdminRequest(r, adminToken...) {
 			handle(w, r)
 		} else {
+			DefaultMetrics.IncAuthFailure()
 			http.Error(w, "Not Authorized", http.StatusUnauthorized)
 		}
 	}
 }
 
+// Users maps the bearer tokens to the user identities, which can be replaced by Set without restart.
+type Users struct {
+	sync.RWMutex
+	tokens map[string]string
+}
+
+// NewUsers creates the Users of the user to token map, the token of the user "" is shared without identity.
+func NewUsers(users map[string]string) *Users {
+	u := &Users{}
+	u.Set(users)
+	return u
+}
+
+// Set replaces the users.
+func (u *Users) Set(users map[string]string) {
+	tokens := make(map[string]string, len(users))
+	for user, token := range users {
+		if token != "" {
+			tokens[token] = user
+		}
+	}
+
+	u.Lock()
+	u.tokens = tokens
+	u.Unlock()
+}
+
+// lookup returns the user of the Authorization header, ok is false if not authorized.
+func (u *Users) lookup(authorization string) (user string, ok bool) {
+	u.RLock()
+	defer u.RUnlock()
+
+	if len(u.tokens) == 0 {
+		return "", true
+	}
+	for token, name := range u.tokens {
+		if SecureCompare(authorization, bearerPrefix+token) {
+			user, ok = name, true
+		}
+	}
+	return user, ok
+}
+
+// BearerUsers returns a Handler that authenticates via Bearer Auth by the tokens of the users,
+// and attaches the user as the identity. Writes a http.StatusUnauthorized if authentication fails.
+// The admin requests may be authenticated by the admin token instead.
+func BearerUsers(users *Users, handle http.HandlerFunc, adminToken ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := users.lookup(r.Header.Get(Authorization))
+		if !ok && isAdminRequest(r, adminToken...) {
+			handle(w, r)
+			return
+		}
+		if !ok {
+			DefaultMetrics.IncAuthFailure()
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		if user != "" {
+			r = WithIdentity(r, user)
+		}
+		handle(w, r)
+	}
+}
+
 // SecureCompare performs a constant time compare of two strings to limit timing attacks.
 func SecureCompare(given string, actual string) bool {
 	givenSha := sha512.Sum512([]byte(given))
@@ -42,3 +111,22 @@ func BearerTokenGenerate() string {
 	_, _ = rand.Read(b)
 	return b64.EncodeBytes2String(b, b64.URL, b64.Raw)
 }
+
+type identityKey struct{}
+
+// WithIdentity returns a shallow copy of r with the authenticated identity attached.
+func WithIdentity(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// Identity returns the authenticated identity of the request, or the client IP if not authenticated.
+func Identity(r *http.Request) string {
+	if v, ok := r.Context().Value(identityKey{}).(string); ok && v != "" {
+		return v
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -1,7 +1,11 @@
 package goup
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math"
@@ -9,10 +13,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bingoohuang/gg/pkg/codec/b64"
+	"github.com/bingoohuang/gg/pkg/iox"
 	"github.com/bingoohuang/gg/pkg/rest"
 	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/bingoohuang/goup/codec"
@@ -30,7 +37,21 @@ type Client struct {
 	wg                 sync.WaitGroup
 	contentDisposition string
 	sessionKey         []byte
+	sessionMu          sync.Mutex
 	LimitRate          uint64
+
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	gate    *pauseGate
+	sink    downloadSink
+	stats   *transferStats
+	hasher  hash.Hash
+	result  *Result
+	mirrors *mirrorSet
+
+	metaOnce sync.Once
+	meta     string
 }
 
 // GetParts get the number of chunk parts.
@@ -50,6 +71,44 @@ type Opt struct {
 	Code       string
 	Coroutines int
 	Cipher     string
+	RetryPolicy
+
+	// Includes and Excludes are the glob patterns to filter the files of directory uploading.
+	Includes []string
+	Excludes []string
+
+	// Reader is the stream of unknown length to upload with the name of Rename.
+	Reader io.Reader
+
+	// Output is the local file path, or the directory (default RootDir) to save the downloaded file.
+	Output string
+	// WriterAt or Writer is the destination of the downloaded file instead of a local file,
+	// the chunks are reordered for the sequential Writer.
+	WriterAt io.WriterAt
+	Writer   io.Writer
+
+	// StallTimeout is the idle period to abort and retry a chunk attempt when no bytes move,
+	// default DefaultStallTimeout, negative to disable.
+	StallTimeout time.Duration
+	// ResponseTimeout is the time limit of waiting the response after a chunk is uploaded, the downloads wait by StallTimeout,
+	// default DefaultResponseTimeout, negative for no limit.
+	ResponseTimeout time.Duration
+	// TransferTimeout is the time limit of the whole transfer, 0 for no limit.
+	TransferTimeout time.Duration
+
+	// Mirrors are the urls of the mirrored servers holding the same file,
+	// the chunks are downloaded from them and the main url in parallel.
+	Mirrors []string
+
+	// Tags are the custom key=value tags of the uploading file metadata.
+	Tags map[string]string
+	// RestoreMode restores the mode of the downloaded local file from its metadata, besides the modification time.
+	RestoreMode bool
+
+	// Metrics records the bytes, the chunks, the request latencies, the auth failures and the rate limit waits.
+	Metrics MetricsRecorder
+
+	EventListener
 }
 
 // OptFn is the option pattern func prototype.
@@ -82,6 +141,30 @@ func WithCipher(v string) OptFn { return func(c *Opt) { c.Cipher = v } }
 // WithCode set Code.
 func WithCode(v string) OptFn { return func(c *Opt) { c.Code = v } }
 
+// WithRetryPolicy set RetryPolicy, the zero fields are set to the ones of DefaultRetryPolicy.
+func WithRetryPolicy(v RetryPolicy) OptFn { return func(c *Opt) { c.RetryPolicy = v } }
+
+// WithIncludes appends the glob patterns of the files to upload in a directory.
+func WithIncludes(v ...string) OptFn { return func(c *Opt) { c.Includes = append(c.Includes, v...) } }
+
+// WithExcludes appends the glob patterns of the files or directories to skip in a directory.
+func WithExcludes(v ...string) OptFn { return func(c *Opt) { c.Excludes = append(c.Excludes, v...) } }
+
+// WithReader set Reader to upload a stream of unknown length, like stdin, Rename is required for its name.
+func WithReader(v io.Reader) OptFn { return func(c *Opt) { c.Reader = v } }
+
+// WithOutput set Output, a file path or a directory to save the downloaded file.
+func WithOutput(v string) OptFn { return func(c *Opt) { c.Output = v } }
+
+// WithWriterAt set WriterAt to download into.
+func WithWriterAt(v io.WriterAt) OptFn { return func(c *Opt) { c.WriterAt = v } }
+
+// WithWriter set Writer to download into sequentially.
+func WithWriter(v io.Writer) OptFn { return func(c *Opt) { c.Writer = v } }
+
+// WithMirrors appends the urls of the mirrored servers to download from in parallel.
+func WithMirrors(v ...string) OptFn { return func(c *Opt) { c.Mirrors = append(c.Mirrors, v...) } }
+
 // WithCoroutines set Coroutines.
 func WithCoroutines(v int) OptFn { return func(c *Opt) { c.Coroutines = v } }
 
@@ -100,9 +183,16 @@ func New(url string, fns ...OptFn) (*Client, error) {
 	if opt.Client == nil {
 		opt.Client = &http.Client{}
 	}
+	if opt.Metrics == nil {
+		opt.Metrics = nopMetrics{}
+	} else {
+		opt.Client = instrument(opt.Client, opt.Metrics)
+	}
 	if opt.Progress == nil {
 		opt.Progress = &noopProgressing{}
 	}
+	stats := &transferStats{Progress: opt.Progress}
+	opt.Progress = stats
 	if !strings.HasPrefix(opt.Bearer, bearerPrefix) {
 		opt.Bearer = bearerPrefix + opt.Bearer
 	}
@@ -116,6 +206,9 @@ func New(url string, fns ...OptFn) (*Client, error) {
 		url:                fixedURL.Data.String(),
 		contentDisposition: mime.FormatMediaType("attachment", map[string]string{"filename": fileName}),
 		ID:                 generateSessionID(),
+		LimitRate:          opt.LimitRate,
+		gate:               &pauseGate{},
+		stats:              stats,
 	}
 
 	return g, nil
@@ -123,18 +216,52 @@ func New(url string, fns ...OptFn) (*Client, error) {
 
 // Start method initializes upload
 func (c *Client) Start() (err error) {
+	return c.StartContext(context.Background())
+}
+
+// StartContext starts the transfer with the context,
+// the transfer is aborted when the context is done or Cancel is called.
+func (c *Client) StartContext(ctx context.Context) (err error) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	if c.TransferTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.TransferTimeout)
+		defer cancel()
+	}
+	c.mu.Lock()
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.mu.Unlock()
+	defer c.cancel()
+	c.gate.start(c.ctx)
+	c.stats.reset()
+	c.hasher = nil
+
+	operation := "download"
+	if c.Reader != nil || c.FullPath != "" {
+		operation = "upload"
+	}
+	defer func() { c.finish(operation, err) }()
+
 	if c.ChunkSize > 0 {
 		if err := c.setupSessionKey(); err != nil {
 			return err
 		}
 	}
 
-	if c.FullPath != "" { // for upload
-		return c.initUpload()
+	if c.Reader != nil { // for streaming upload
+		if c.Rename == "" {
+			return fmt.Errorf("rename is required for streaming upload")
+		}
+		return c.initUploadStream()
 	}
 
-	if err := ensureDir(RootDir); err != nil {
-		return err
+	if c.FullPath != "" { // for upload
+		if stat, err := os.Stat(c.FullPath); err == nil && stat.IsDir() {
+			return c.initUploadDir()
+		}
+		return c.initUpload()
 	}
 
 	if c.ChunkSize > 0 {
@@ -145,30 +272,39 @@ func (c *Client) Start() (err error) {
 }
 
 func (c *Client) multipartDownload() error {
-	r, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if len(c.Mirrors) > 0 {
+		log.Printf("W! mirrors are ignored when the chunks are disabled")
+	}
+	r, err := http.NewRequestWithContext(c.ctx, http.MethodGet, c.url, nil)
 	if err != nil {
 		return fmt.Errorf("http.NewRequest %s: %w", c.url, err)
 	}
+	r = withEndpoint(r, "download")
 	r.Header.Set(Authorization, c.Bearer)
 	q, err := c.Client.Do(r)
 	if err != nil {
 		return err
 	}
+	defer Close(q.Body)
 	if q.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", q.StatusCode)
+		return &StatusCodeError{StatusCode: q.StatusCode, RetryAfter: parseRetryAfter(q.Header)}
 	}
 
-	_, params, err := mime.ParseMediaType(q.Header.Get(ContentDisposition))
+	filename, err := attachmentFilename(q.Header)
 	if err != nil {
-		return fmt.Errorf("parse Content-Disposition error: %w", err)
+		return err
+	}
+	if c.sink, err = c.newDownloadSink(filename); err != nil {
+		return err
 	}
-	c.FullPath = filepath.Join(RootDir, params["filename"])
+	var cr *chunkRange
 	if length := ss.ParseUint64(q.Header.Get("Content-Length")); length > 0 {
 		c.TotalSize = length
+		cr = newChunkRange(0, length, length, length)
 	}
 
 	if c.LimitRate > 0 {
-		q.Body = shapeio.NewReader(q.Body, shapeio.WithRateLimit(float64(c.LimitRate)))
+		q.Body = shapeio.NewReader(q.Body, shapeio.WithRateLimit(float64(c.LimitRate)), c.onWait())
 	}
 
 	log.Printf("Download %s started: %v", c.ID, c.FullPath)
@@ -176,40 +312,28 @@ func (c *Client) multipartDownload() error {
 
 	c.Progress.Start(c.TotalSize)
 	defer c.Progress.Finish()
-	if _, err := writeChunk(c.FullPath, c.Progress, q.Body, nil); err != nil {
-		log.Printf("E! write chunk failed: %v", err)
+	if err := c.sink.write(0, q.Body, cr); err != nil {
+		return fmt.Errorf("download %s: %w", c.FullPath, err)
 	}
 
+	c.restoreMeta(q.Header)
 	return nil
 }
 
 func (c *Client) initDownload() error {
-	r, err := http.NewRequest(http.MethodGet, c.url, nil)
-	if err != nil {
-		return fmt.Errorf("http.NewRequest %s: %w", c.url, err)
-	}
-	r.Header.Set("Content-Gulp", "Session="+c.ID)
-	r.Header.Set(Authorization, c.Bearer)
-	q, err := c.Client.Do(r)
+	cr, header, err := c.probeDownload(c.url)
 	if err != nil {
 		return err
 	}
-	h := ParseHeader(q.Header.Get("Content-Gulp"))
-	if q.StatusCode != http.StatusOK || h.Range == "" {
-		return fmt.Errorf("no file to donwload or upload")
-	}
-
-	cr, err := parseContentRange(h.Range)
+	filename, err := attachmentFilename(header)
 	if err != nil {
-		return fmt.Errorf("parse contentRange %s error: %w", h.Range, err)
+		return err
 	}
-
-	_, params, err := mime.ParseMediaType(q.Header.Get(ContentDisposition))
-	if err != nil {
-		return fmt.Errorf("parse Content-Disposition error: %w", err)
+	if c.sink, err = c.newDownloadSink(filename); err != nil {
+		return err
 	}
-	c.FullPath = filepath.Join(RootDir, params["filename"])
 	c.TotalSize = cr.TotalSize
+	c.setupMirrors()
 
 	log.Printf("Download %s started: %v", c.ID, c.FullPath)
 	defer log.Printf("Download %s complete: %v", c.ID, c.FullPath)
@@ -218,11 +342,55 @@ func (c *Client) initDownload() error {
 	defer c.Progress.Finish()
 	if err := c.do("download", c.downloadChunk); err != nil {
 		log.Printf("E! download failed: %v", err)
+		return err
 	}
 
+	if err := c.verifyMirrors(); err != nil {
+		return err
+	}
+	c.restoreMeta(header)
 	return nil
 }
 
+// probeDownload requests the size of the file to download from the server of the url,
+// and returns the response header with the filename and the metadata.
+func (c *Client) probeDownload(url string) (*chunkRange, http.Header, error) {
+	r, err := http.NewRequestWithContext(c.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("http.NewRequest %s: %w", url, err)
+	}
+	r = withEndpoint(r, "download")
+	r.Header.Set("Content-Gulp", "Session="+c.ID)
+	r.Header.Set(Authorization, c.Bearer)
+	q, err := c.Client.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	iox.DiscardClose(q.Body)
+	h := ParseHeader(q.Header.Get("Content-Gulp"))
+	if q.StatusCode != http.StatusOK {
+		return nil, nil, &StatusCodeError{StatusCode: q.StatusCode, RetryAfter: parseRetryAfter(q.Header)}
+	}
+	if h.Range == "" {
+		return nil, nil, fmt.Errorf("no file to donwload or upload")
+	}
+
+	cr, err := parseContentRange(h.Range)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse contentRange %s error: %w", h.Range, err)
+	}
+	return cr, q.Header, nil
+}
+
+// attachmentFilename returns the filename in the Content-Disposition header.
+func attachmentFilename(h http.Header) (string, error) {
+	_, params, err := mime.ParseMediaType(h.Get(ContentDisposition))
+	if err != nil {
+		return "", fmt.Errorf("parse Content-Disposition error: %w", err)
+	}
+	return params["filename"], nil
+}
+
 func (c *Client) initUpload() error {
 	fileStat, err := os.Stat(c.FullPath)
 	if err != nil {
@@ -250,39 +418,56 @@ func (c *Client) initUpload() error {
 	return nil
 }
 
-func (c *Client) do(operation string, job func(i uint64) error) error {
+func (c *Client) do(operation string, job func(ctx context.Context, i uint64) error) error {
 	if c.Coroutines <= 0 {
 		for i := uint64(0); i < c.GetParts(); i++ {
-			if err := job(i); err != nil {
-				return err
+			c.emit(EventChunkQueued, i, c.chunkRange(i), 0, nil)
+			if err := c.transferChunk(i, c.chunkRange(i), job); err != nil {
+				if c.ctx.Err() != nil {
+					return c.ctx.Err()
+				}
+				return &TransferError{Operation: operation, FullPath: c.FullPath, Chunks: []ChunkError{c.newChunkError(i, err)}}
 			}
 		}
 
 		return nil
 	}
 
-	c.goJobs(operation, job)
-	return nil
+	return c.goJobs(operation, job)
 }
 
-func (c *Client) downloadChunk(i uint64) error {
+func (c *Client) downloadChunk(ctx context.Context, i uint64) error {
 	partSize := GetPartSize(c.TotalSize, c.ChunkSize, i)
 	if partSize <= 0 {
 		return nil
 	}
 
 	cr := newChunkRange(i, c.ChunkSize, partSize, c.TotalSize)
-	chunkChecksum, err := readChunkChecksum(c.FullPath, cr.From, cr.To)
+	chunkChecksum, err := c.sink.checksum(cr)
 	if err != nil {
 		return fmt.Errorf("read %s: %w", c.FullPath, err)
 	}
 
-	r, err := http.NewRequest(http.MethodGet, c.url, nil)
+	m := c.mirrors.pick()
+	start := time.Now()
+	err = c.downloadChunkFrom(ctx, m, i, cr, chunkChecksum)
+	c.mirrors.done(m, partSize, time.Since(start), err)
+	return err
+}
+
+func (c *Client) downloadChunkFrom(ctx context.Context, m *mirror, i uint64, cr *chunkRange, chunkChecksum string) error {
+	sessionKey := c.loadSessionKey(&m.sessionKey)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return err
+	}
+	r = withEndpoint(r, "download")
 	r.Header.Set(Authorization, c.Bearer)
 	r.Header.Set("Content-Gulp", "Session="+c.ID+
 		"; Range="+cr.createContentRange()+
 		"; Checksum="+chunkChecksum)
 	r.Header.Set(ContentDisposition, c.contentDisposition)
+	c.setMeta(r)
 	q, err := c.Client.Do(r)
 	if err != nil {
 		return err
@@ -290,11 +475,16 @@ func (c *Client) downloadChunk(i uint64) error {
 	defer Close(q.Body)
 
 	if q.StatusCode == http.StatusNotModified {
-		c.Progress.Add(partSize)
-		return nil
+		return c.skipChunk(cr.PartSize)
 	}
 	if q.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", q.StatusCode)
+		se := newStatusCodeError(q)
+		if errors.Is(se, ErrUnknownSession) {
+			if err := c.renewSessionKey(m.url, &m.sessionKey, sessionKey); err != nil {
+				return err
+			}
+		}
+		return se
 	}
 
 	h := ParseHeader(q.Header.Get("Content-Gulp"))
@@ -307,11 +497,13 @@ func (c *Client) downloadChunk(i uint64) error {
 		return fmt.Errorf("response body is nil")
 	}
 
+	var body io.Reader = q.Body
 	if c.LimitRate > 0 {
-		q.Body = shapeio.NewReader(q.Body, shapeio.WithRateLimit(float64(c.LimitRate)))
+		body = shapeio.NewReader(q.Body, shapeio.WithRateLimit(float64(c.LimitRate)), c.onWait())
 	}
+	body = watchReader(ctx, body)
 
-	key, _, err := codec.Scrypt(c.sessionKey, []byte(salt))
+	key, _, err := codec.Scrypt(sessionKey, []byte(salt))
 	if err != nil {
 		return err
 	}
@@ -322,47 +514,69 @@ func (c *Client) downloadChunk(i uint64) error {
 
 		_, cipherSuites := parseCipherSuites(c.Cipher)
 		cfg := sio.Config{Key: key, CipherSuites: cipherSuites}
-		if n, err := sio.Decrypt(pw, q.Body, cfg); err != nil {
-			log.Printf("E! decrypt bytes: %d failed: %v", n, err)
+		if n, err := sio.Decrypt(pw, body, cfg); err != nil {
+			if isDecryptError(err) {
+				c.Metrics.IncChunk(ChunkDecryptFailed)
+			}
+			pw.CloseWithError(fmt.Errorf("decrypt bytes: %d failed: %w", n, err))
 		}
 	}()
 
-	if _, err := writeChunk(c.FullPath, c.Progress, pr, cr); err != nil {
+	if err := c.sink.write(i, pr, cr); err != nil {
 		return fmt.Errorf("write chunk error: %w", err)
 	}
 	return nil
 }
 
-func (c *Client) goJobs(operation string, job func(i uint64) error) {
+func (c *Client) goJobs(operation string, job func(ctx context.Context, i uint64) error) error {
 	fnCh := make(chan uint64)
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []ChunkError
 	for i := 0; i < c.Coroutines; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
 			for idx := range fnCh {
-				retryJob(func() error {
-					err := job(idx)
-					if err != nil {
-						log.Printf("E! %s chunk %d failed: %v", operation, idx, err)
+				if err := c.transferChunk(idx, c.chunkRange(idx), func(ctx context.Context, i uint64) error {
+					err := job(ctx, i)
+					if err != nil && !errors.Is(err, errChunkSkipped) {
+						log.Printf("E! %s chunk %d failed: %v", operation, i, err)
 					}
 					return err
-				})
+				}); err != nil {
+					mu.Lock()
+					failed = append(failed, c.newChunkError(idx, err))
+					mu.Unlock()
+					if c.sink != nil {
+						c.sink.abort(idx, err)
+					}
+				}
 			}
 		}()
 	}
 
-	for i := uint64(0); i < c.GetParts(); i++ {
+	for i := uint64(0); i < c.GetParts() && c.ctx.Err() == nil; i++ {
+		c.emit(EventChunkQueued, i, c.chunkRange(i), 0, nil)
 		fnCh <- i
 	}
 	close(fnCh)
 
 	wg.Wait()
+
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+		return &TransferError{Operation: operation, FullPath: c.FullPath, Chunks: failed}
+	}
+	return nil
 }
 
 func (c *Client) uploadMultipartForm() error {
-	fileReader, err := CreateChunkReader(c.FullPath, 0, 0, c.LimitRate)
+	fileReader, err := CreateChunkReader(c.FullPath, 0, 0, c.LimitRate, c.onWait())
 	if err != nil {
 		return err
 	}
@@ -371,15 +585,17 @@ func (c *Client) uploadMultipartForm() error {
 	up := PrepareMultipartPayload(map[string]interface{}{
 		"file": &PbReader{Reader: fileReader, Adder: c.Progress},
 	})
-	r, err := http.NewRequest(http.MethodPost, c.url, up.Body)
+	r, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, up.Body)
 	if err != nil {
 		return err
 	}
+	r = withEndpoint(r, "multipart")
 	for k, v := range up.Headers {
 		r.Header.Set(k, v)
 	}
 	r.ContentLength = up.Size
 	r.Header.Set("Content-Gulp", "Session:"+c.ID)
+	c.setMeta(r)
 	r.Header.Set(Authorization, c.Bearer)
 	q, err := c.Client.Do(r)
 	if err != nil {
@@ -387,15 +603,15 @@ func (c *Client) uploadMultipartForm() error {
 	}
 	defer Close(q.Body)
 
-	_, _ = io.Copy(io.Discard, q.Body)
 	if q.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", q.StatusCode)
+		return newStatusCodeError(q)
 	}
+	_, _ = io.Copy(io.Discard, q.Body)
 
 	return nil
 }
 
-func (c *Client) uploadChunk(i uint64) error {
+func (c *Client) uploadChunk(ctx context.Context, i uint64) error {
 	partSize := GetPartSize(c.TotalSize, c.ChunkSize, i)
 	if partSize <= 0 {
 		return nil
@@ -407,13 +623,13 @@ func (c *Client) uploadChunk(i uint64) error {
 	if err != nil {
 		return fmt.Errorf("readChunkChecksum %s: %w", c.FullPath, err)
 	}
-	r, err := CreateChunkReader(c.FullPath, cr.From, cr.To, c.LimitRate)
+	r, err := CreateChunkReader(c.FullPath, cr.From, cr.To, c.LimitRate, c.onWait())
 	if err != nil {
 		return fmt.Errorf("CreateChunkReader %s: %w", c.FullPath, err)
 	}
 	defer Close(r)
 
-	responseBody, err := c.chunkUpload(r, cr, chunkChecksum)
+	responseBody, err := c.chunkUpload(ctx, r, cr, chunkChecksum)
 	if err != nil {
 		return fmt.Errorf("chunk %d upload: %w", i+1, err)
 	}
@@ -433,63 +649,91 @@ func min(a, b uint64) uint64 {
 	return b
 }
 
-// Wait waits the upload complete
+// Wait waits the running transfer complete, it is useful when StartContext is called in another goroutine.
 func (c *Client) Wait() {
 	c.wg.Wait()
 }
 
-func (c *Client) setupSessionKey() error {
+func (c *Client) setupSessionKey() (err error) {
+	c.sessionKey, err = c.pakeSessionKey(c.url)
+	return err
+}
+
+// loadSessionKey returns the session key, which may be renewed by the other chunks.
+func (c *Client) loadSessionKey(key *[]byte) []byte {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return *key
+}
+
+// renewSessionKey negotiates the session key of the url again when the server forgot it, like restarted,
+// unless another chunk has renewed the used key already.
+func (c *Client) renewSessionKey(url string, key *[]byte, used []byte) error {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if !bytes.Equal(*key, used) {
+		return nil
+	}
+	log.Printf("W! session %s is unknown to %s, negotiating again", c.ID, url)
+	renewed, err := c.pakeSessionKey(url)
+	if err != nil {
+		return err
+	}
+	*key = renewed
+	return nil
+}
+
+// pakeSessionKey negotiates the session key with the server of the url by PAKE.
+func (c *Client) pakeSessionKey(url string) ([]byte, error) {
 	a, err := pake.InitCurve([]byte(c.Code), 0, "siec")
 	if err != nil {
-		return fmt.Errorf("init curve failed: %w", err)
+		return nil, fmt.Errorf("init curve failed: %w", err)
 	}
-	r, err := http.NewRequest(http.MethodPost, c.url, nil)
+	r, err := http.NewRequestWithContext(c.ctx, http.MethodPost, url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	r = withEndpoint(r, "pake")
 	r.Header.Set(Authorization, c.Bearer)
 	r.Header.Set("Content-Gulp", "Session="+c.ID+"; Curve="+b64.EncodeBytes2String(a.Bytes(), b64.Raw, b64.URL))
 	q, err := c.Client.Do(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	iox.DiscardClose(q.Body)
 	if q.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code: %d", q.StatusCode)
+		return nil, &StatusCodeError{StatusCode: q.StatusCode, RetryAfter: parseRetryAfter(q.Header)}
 	}
 
 	h := ParseHeader(q.Header.Get("Content-Gulp"))
 	b, err := b64.DecodeString(h.Curve)
 	if err != nil {
-		return fmt.Errorf("base64 decode error: %w", err)
+		return nil, fmt.Errorf("base64 decode error: %w", err)
 	} else if err := a.Update([]byte(b)); err != nil {
-		return fmt.Errorf("update b error: %w", err)
+		return nil, fmt.Errorf("update b error: %w", err)
 	}
 
-	ak, err := a.SessionKey()
-	if err != nil {
-		return err
-	}
-	c.sessionKey = ak
-	return nil
+	return a.SessionKey()
 }
 
-func (c *Client) chunkUpload(part io.ReadCloser, cr *chunkRange, chunkChecksum string) (string, error) {
+func (c *Client) chunkUpload(ctx context.Context, part io.ReadCloser, cr *chunkRange, chunkChecksum string) (string, error) {
 	contentRange := cr.createContentRange()
-	notModified, err := c.chunkUploadChecksum(chunkChecksum, contentRange)
+	notModified, err := c.chunkUploadChecksum(ctx, chunkChecksum, contentRange)
 	if err != nil {
 		return "", err
 	}
 	if notModified {
-		c.Progress.Add(cr.PartSize)
-		return contentRange, nil
+		return contentRange, c.skipChunk(cr.PartSize)
 	}
 
-	return c.chunkTransfer(part, contentRange, err)
+	return c.chunkTransfer(ctx, part, contentRange)
 }
 
-func (c *Client) chunkTransfer(chunkBody io.Reader, contentRange string, err error) (string, error) {
+func (c *Client) chunkTransfer(ctx context.Context, chunkBody io.Reader, contentRange string) (string, error) {
 	salt := codec.GenSalt(8)
-	key, _, err := codec.Scrypt(c.sessionKey, salt)
+	sessionKey := c.loadSessionKey(&c.sessionKey)
+	key, _, err := codec.Scrypt(sessionKey, salt)
 	if err != nil {
 		return "", err
 	}
@@ -500,19 +744,21 @@ func (c *Client) chunkTransfer(chunkBody io.Reader, contentRange string, err err
 
 		_, cipherSuites := parseCipherSuites(c.Cipher)
 		if n, err := sio.Encrypt(pw, chunkBody, sio.Config{Key: key, CipherSuites: cipherSuites}); err != nil {
-			log.Printf("E! encrypt data bytes: %d, failed: %v", n, err)
+			pw.CloseWithError(fmt.Errorf("encrypt data bytes: %d, failed: %w", n, err))
 		}
 	}()
 	defer Close(pr)
 
-	r, err := http.NewRequest(http.MethodPost, c.url, &PbReader{Reader: pr, Adder: c.Progress})
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, &PbReader{Reader: watchReader(ctx, pr), Adder: c.Progress})
 	if err != nil {
 		return "", err
 	}
+	r = withEndpoint(r, "upload")
 
 	r.Header.Set(Authorization, c.Bearer)
 	r.Header.Set(ContentType, "application/octet-stream")
 	r.Header.Set(ContentDisposition, c.contentDisposition)
+	c.setMeta(r)
 	r.Header.Set("Content-Gulp", "Session="+c.ID+
 		"; Range="+contentRange+
 		"; Salt="+b64.EncodeBytes2String(salt, b64.Raw, b64.URL))
@@ -528,28 +774,40 @@ func (c *Client) chunkTransfer(chunkBody io.Reader, contentRange string, err err
 	}
 
 	if q.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status code: %d, body: %s", q.StatusCode, body)
+		se := &StatusCodeError{StatusCode: q.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(q.Header)}
+		if errors.Is(se, ErrUnknownSession) {
+			if err := c.renewSessionKey(c.url, &c.sessionKey, sessionKey); err != nil {
+				return "", err
+			}
+		}
+		return "", se
 	}
 
 	return string(body), nil
 }
 
-func (c *Client) chunkUploadChecksum(chunkChecksum, contentRange string) (bool, error) {
-	r, err := http.NewRequest(http.MethodGet, c.url, nil)
+func (c *Client) chunkUploadChecksum(ctx context.Context, chunkChecksum, contentRange string) (bool, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return false, err
+	}
+	r = withEndpoint(r, "upload")
 
 	r.Header.Set(Authorization, c.Bearer)
 	r.Header.Set(ContentDisposition, c.contentDisposition)
+	c.setMeta(r)
 	r.Header.Set("Content-Gulp", "Session="+c.ID+"; Range="+contentRange+"; Checksum="+chunkChecksum)
 	q, err := c.Client.Do(r)
 	if err != nil {
 		return false, err
 	}
+	iox.DiscardClose(q.Body)
 	if q.StatusCode == http.StatusNotModified {
 		return true, nil
 	}
 
 	if q.StatusCode != 200 {
-		return false, fmt.Errorf("bad status code: %d", q.StatusCode)
+		return false, &StatusCodeError{StatusCode: q.StatusCode, RetryAfter: parseRetryAfter(q.Header)}
 	}
 
 	return false, nil
@@ -0,0 +1,657 @@
+package goup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientPauseResumeCancel(t *testing.T) {
+	root := setupTestRoot(t)
+	src := writeTestFile(t, 8*64*1024)
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	// canceled before any chunk is transferred
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	if err := c.StartContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	c, _ = New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	c.Pause()
+	done := make(chan error, 1)
+	go func() { done <- c.Start() }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("paused transfer finished: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	c.Resume()
+	c.Wait()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := os.ReadFile(src)
+	got, _ := os.ReadFile(filepath.Join(root, "src.bin"))
+	if !bytes.Equal(want, got) {
+		t.Fatal("uploaded file differs")
+	}
+}
+
+func TestClientChunkFailure(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 3*64*1024)
+
+	h := ServerHandle("code", "", 64*1024, 0, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && ParseHeader(r.Header.Get("Content-Gulp")).Salt != "" {
+			http.Error(w, "disk full", http.StatusInternalServerError)
+			return
+		}
+		h(w, r)
+	}))
+	defer ts.Close()
+
+	c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, MinWait: time.Millisecond}))
+	err := c.Start()
+	var te *TransferError
+	if !errors.As(err, &te) {
+		t.Fatalf("expected TransferError, got %v", err)
+	}
+	if len(te.Chunks) != 1 || te.Chunks[0].From != 0 || te.Chunks[0].To != 64*1024 {
+		t.Fatalf("unexpected failed chunks: %+v", te.Chunks)
+	}
+	var se *StatusCodeError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the status code of the failed chunk, got %v", err)
+	}
+}
+
+func TestClientStall(t *testing.T) {
+	c, _ := New("http://127.0.0.1", WithStallTimeout(100*time.Millisecond), WithResponseTimeout(400*time.Millisecond))
+	// sends the body, which stalls after the bytes if partial, then waits the response for the period,
+	// or until aborted if 0
+	job := func(body string, partial bool, wait time.Duration) func(ctx context.Context, i uint64) error {
+		return func(ctx context.Context, _ uint64) error {
+			r := io.Reader(strings.NewReader(body))
+			if partial {
+				r = io.MultiReader(r, &blockReader{ctx: ctx})
+			}
+			if _, err := io.ReadAll(watchReader(ctx, r)); err != nil {
+				return err
+			}
+			if wait == 0 {
+				wait = time.Hour
+			}
+			select {
+			case <-time.After(wait):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	ctx := context.Background()
+	if err := c.watchStall(job("partial", true, 0))(ctx, 0); !errors.Is(err, ErrStalled) ||
+		!strings.Contains(err.Error(), "no bytes moved") {
+		t.Fatalf("expected stalled body, got %v", err)
+	}
+	// the slow server, like deriving the key or running the post-upload hooks, is not a stall
+	if err := c.watchStall(job("body", false, 250*time.Millisecond))(ctx, 0); err != nil {
+		t.Fatalf("slow response aborted: %v", err)
+	}
+	if err := c.watchStall(job("body", false, 0))(ctx, 0); !errors.Is(err, ErrStalled) ||
+		!strings.Contains(err.Error(), "no response") {
+		t.Fatalf("expected no response, got %v", err)
+	}
+
+	// the response of a GET is not waited by the long ResponseTimeout of the uploads
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() }))
+	defer slow.Close()
+	get := func(ctx context.Context, _ uint64) error {
+		r, _ := http.NewRequestWithContext(ctx, http.MethodGet, slow.URL, nil)
+		rsp, err := http.DefaultClient.Do(r)
+		if err == nil {
+			Close(rsp.Body)
+		}
+		return err
+	}
+	c, _ = New("http://127.0.0.1", WithStallTimeout(100*time.Millisecond), WithResponseTimeout(time.Hour))
+	if err := c.watchStall(get)(ctx, 0); !errors.Is(err, ErrStalled) || !strings.Contains(err.Error(), "no bytes moved") {
+		t.Fatalf("expected stalled GET, got %v", err)
+	}
+
+	setupTestRoot(t)
+	src := writeTestFile(t, 2*64*1024)
+
+	h := ServerHandle("code", "", 64*1024, 0, nil)
+	var stalls int32
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && ParseHeader(r.Header.Get("Content-Gulp")).Salt != "" &&
+			atomic.AddInt32(&stalls, 1) == 1 {
+			select { // like a half-open connection
+			case <-r.Context().Done():
+			case <-hang:
+			}
+			return
+		}
+		h(w, r)
+	}))
+	defer ts.Close()
+	defer close(hang)
+
+	c, _ = New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithRename("b.bin"),
+		WithStallTimeout(-1), WithTransferTimeout(300*time.Millisecond))
+	if err := c.Start(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+// blockReader blocks until the context is done, like a stalled connection.
+type blockReader struct{ ctx context.Context }
+
+func (r *blockReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestClientUploadDir(t *testing.T) {
+	root := setupTestRoot(t)
+	dir := filepath.Join(t.TempDir(), "dist")
+	files := map[string]int{"index.html": 100, "js/app.js": 70 * 1024, "js/app.js.map": 10, "node_modules/x.js": 10}
+	for name, size := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, bytes.Repeat([]byte("x"), size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	for _, chunkSize := range []uint64{64 * 1024, 0} {
+		c, _ := New(ts.URL, WithFullPath(dir), WithChunkSize(chunkSize), WithCode("code"), WithRename("site"),
+			WithExcludes("node_modules", "*.map"))
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if c.TotalSize != 100+70*1024 {
+			t.Fatalf("unexpected total size %d", c.TotalSize)
+		}
+	}
+
+	for name, size := range map[string]int{"site/index.html": 100, "site/js/app.js": 70 * 1024} {
+		if stat, err := os.Stat(filepath.Join(root, name)); err != nil || stat.Size() != int64(size) {
+			t.Fatalf("bad uploaded file %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"site/js/app.js.map", "site/node_modules"} {
+		if !fileNotExists(filepath.Join(root, name)) {
+			t.Fatalf("excluded %s uploaded", name)
+		}
+	}
+}
+
+// flakyReader returns the data in small pieces, like a pipe.
+type flakyReader struct{ data []byte }
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(uint64(len(p)), 1000)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestClientUploadStream(t *testing.T) {
+	root := setupTestRoot(t)
+	data := bytes.Repeat([]byte("0123456789"), 20*1024)
+
+	// the server file is longer than the stream, it should be truncated by the closing request.
+	_ = os.WriteFile(filepath.Join(root, "dump.sql"), bytes.Repeat([]byte("x"), 300*1024), 0o644)
+
+	failures := 1
+	h := ServerHandle("code", "", 64*1024, 0, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && ParseHeader(r.Header.Get("Content-Gulp")).Salt != "" && failures > 0 {
+			failures--
+			http.Error(w, "temporary failure", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}))
+	defer ts.Close()
+
+	c, _ := New(ts.URL, WithReader(&flakyReader{data: data}), WithRename("dump.sql"), WithChunkSize(64*1024),
+		WithCode("code"), WithRetryPolicy(RetryPolicy{MinWait: time.Millisecond}))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := os.ReadFile(filepath.Join(root, "dump.sql"))
+	if !bytes.Equal(data, got) || c.TotalSize != uint64(len(data)) {
+		t.Fatalf("uploaded stream differs, %d != %d", len(got), len(data))
+	}
+
+	// the forged closing request of a session which did not stream into the file is refused
+	r, _ := http.NewRequest(http.MethodPost, ts.URL, nil)
+	r.Header.Set(ContentDisposition, `attachment; filename="dump.sql"`)
+	r.Header.Set("Content-Gulp", "Session=forged; Size=1099511627776")
+	if q, err := http.DefaultClient.Do(r); err != nil || q.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 of the forged closing request, got %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(root, "dump.sql")); info.Size() != int64(len(data)) {
+		t.Fatalf("file resized by the forged closing request to %d", info.Size())
+	}
+}
+
+func TestClientDownloadOutput(t *testing.T) {
+	root := setupTestRoot(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20*1024)
+	_ = os.WriteFile(filepath.Join(root, "a.bin"), data, 0o644)
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	out := filepath.Join(t.TempDir(), "out") + "/"
+	var buf bytes.Buffer
+	wa, _ := os.Create(filepath.Join(t.TempDir(), "wa.bin"))
+	defer wa.Close()
+
+	for _, fn := range []OptFn{WithOutput(out), WithWriterAt(wa), WithWriter(&buf)} {
+		for _, chunkSize := range []uint64{0, 64 * 1024} {
+			buf.Reset()
+			c, _ := New(ts.URL+"/a.bin", fn, WithChunkSize(chunkSize), WithCode("code"), WithCoroutines(3))
+			if err := c.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if r := c.Result(); r.Hash != hashReader(bytes.NewReader(data)) {
+				t.Fatalf("unexpected result %+v", r)
+			}
+		}
+	}
+
+	got, _ := os.ReadFile(filepath.Join(out, "a.bin"))
+	gotWa, _ := os.ReadFile(wa.Name())
+	if !bytes.Equal(data, got) || !bytes.Equal(data, buf.Bytes()) || !bytes.Equal(data, gotWa) {
+		t.Fatalf("downloaded files differ")
+	}
+}
+
+// pieceReader reads the pieces one by one, and records the bytes written to w before each read.
+type pieceReader struct {
+	pieces  []string
+	w       *bytes.Buffer
+	written []int
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	if len(r.pieces) == 0 {
+		return 0, io.EOF
+	}
+	r.written = append(r.written, r.w.Len())
+	n := copy(p, r.pieces[0])
+	r.pieces = r.pieces[1:]
+	return n, nil
+}
+
+func TestWriterSinkStreams(t *testing.T) {
+	var buf bytes.Buffer
+	s := newWriterSink(&buf, &noopProgressing{})
+
+	done := make(chan error)
+	go func() { done <- s.write(1, strings.NewReader("cd"), nil) }() // out of order, buffered
+	r := &pieceReader{pieces: []string{"a", "b"}, w: &buf}
+	if err := s.write(0, r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "abcd" {
+		t.Fatalf("unexpected stream %q", buf.String())
+	}
+	if len(r.written) != 2 || r.written[1] != 1 {
+		t.Fatalf("the chunk in turn is not streamed, written before reads %v", r.written)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 3*64*1024)
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	counts := map[EventType]int{}
+	listener := func(e ProgressEvent) {
+		mu.Lock()
+		counts[e.Type]++
+		mu.Unlock()
+	}
+
+	for _, want := range []EventType{EventChunkCompleted, EventChunkSkipped} {
+		counts = map[EventType]int{}
+		c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2),
+			WithEventListener(listener))
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if counts[EventChunkQueued] != 3 || counts[EventChunkStarted] != 3 || counts[want] != 3 {
+			t.Fatalf("unexpected events %v", counts)
+		}
+		st := c.Stats()
+		if st.Done != st.TotalSize {
+			t.Fatalf("unexpected done %d of %d", st.Done, st.TotalSize)
+		}
+		if want == EventChunkSkipped && (st.Skipped != 3*64*1024 || st.Transferred != 0) {
+			t.Fatalf("unexpected stats %+v", st)
+		}
+	}
+}
+
+func TestClientResult(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 3*64*1024)
+
+	ts := httptest.NewServer(ServerHandle("code", "AES256", 64*1024, 0, nil))
+	defer ts.Close()
+
+	want, _, _ := fileHash(src)
+	for _, skipped := range []uint64{0, 3 * 64 * 1024} {
+		c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCipher("AES256"))
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		r := c.Result()
+		if r.Operation != "upload" || r.Skipped != skipped || (r.Transferred == 0) != (skipped > 0) ||
+			r.Cipher != "sio.AES_256_GCM" || r.Hash != want || r.Elapsed <= 0 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+}
+
+func TestClientDownloadMirrors(t *testing.T) {
+	root := setupTestRoot(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	_ = os.WriteFile(filepath.Join(root, "a.bin"), data, 0o644)
+
+	var mu sync.Mutex
+	hits := map[string]int{}
+	handler := ServerHandle("code", "", 64*1024, 0, nil)
+	newServer := func(name string, inconsistent bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if inconsistent && r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			handler(w, r)
+		}))
+	}
+	ts1, ts2, ts3 := newServer("a", false), newServer("b", false), newServer("c", true)
+	defer ts1.Close()
+	defer ts2.Close()
+	defer ts3.Close()
+	dead := httptest.NewServer(handler)
+	dead.Close()
+
+	out := filepath.Join(t.TempDir(), "a.bin")
+	c, _ := New(ts1.URL+"/a.bin", WithChunkSize(64*1024), WithCode("code"), WithCoroutines(3), WithOutput(out),
+		WithMirrors(ts2.URL+"/a.bin", dead.URL+"/a.bin"))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(data, got) {
+		t.Fatalf("downloaded file differs")
+	}
+	if hits["a"] < 2 || hits["b"] < 2 {
+		t.Fatalf("chunks are not spread across mirrors: %v", hits)
+	}
+
+	_ = os.Remove(out)
+	c, _ = New(ts1.URL+"/a.bin", WithChunkSize(64*1024), WithCode("code"), WithOutput(out), WithMirrors(ts3.URL+"/a.bin"))
+	if err := c.Start(); err == nil {
+		t.Fatal("inconsistent mirror is not detected")
+	}
+
+	var buf bytes.Buffer
+	c, _ = New(ts1.URL+"/a.bin", WithChunkSize(64*1024), WithCode("code"), WithCoroutines(3), WithWriter(&buf),
+		WithMirrors(ts2.URL+"/a.bin"))
+	if err := c.Start(); err != nil || !bytes.Equal(data, buf.Bytes()) {
+		t.Fatalf("download to writer with mirrors: %v", err)
+	}
+	c, _ = New(ts1.URL+"/a.bin", WithChunkSize(64*1024), WithCode("code"), WithWriter(io.Discard), WithMirrors(ts3.URL+"/a.bin"))
+	if err := c.Start(); err == nil {
+		t.Fatal("inconsistent mirror is not detected for the writer")
+	}
+}
+
+func TestClientRemoteFiles(t *testing.T) {
+	root := setupTestRoot(t)
+	_ = os.MkdirAll(filepath.Join(root, "x"), 0o755)
+	_ = os.WriteFile(filepath.Join(root, "x", "a.txt"), []byte("hello"), 0o644)
+	_ = os.WriteFile(filepath.Join(root, "b.txt"), []byte("world"), 0o644)
+
+	ts := httptest.NewServer(Bearer("token", ServerHandle("code", "", 64*1024, 0, nil)))
+	defer ts.Close()
+
+	ctx := context.Background()
+	c, _ := New(ts.URL, WithBearer("token"))
+	if entries, err := c.List(ctx, "x/"); err != nil || len(entries) != 1 || entries[0].Path != "x/a.txt" {
+		t.Fatalf("unexpected list %v, %v", entries, err)
+	}
+	if st, err := c.Stat(ctx, "x/a.txt"); err != nil || st.Size != 5 || st.Hash != hashReader(bytes.NewReader([]byte("hello"))) {
+		t.Fatalf("unexpected stat %+v, %v", st, err)
+	}
+	if err := c.Move(ctx, "x/a.txt", "y/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	var se *StatusCodeError
+	if err := c.Move(ctx, "b.txt", "y/a.txt"); !errors.As(err, &se) || se.StatusCode != http.StatusConflict {
+		t.Fatalf("unexpected move error %v", err)
+	}
+	if err := c.Delete(ctx, "y/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, "y/a.txt"); !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected stat error %v", err)
+	}
+	if err := c.Delete(ctx, "../b.txt"); err != nil { // cleaned to b.txt under the root
+		t.Fatal(err)
+	}
+
+	anonymous, _ := New(ts.URL)
+	if _, err := anonymous.List(ctx, ""); !errors.As(err, &se) || se.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected list error %v", err)
+	}
+}
+
+func TestClientListPage(t *testing.T) {
+	root := setupTestRoot(t)
+	_ = os.MkdirAll(filepath.Join(root, "a", "b"), 0o755)
+	_ = os.WriteFile(filepath.Join(root, "a", "1.txt"), []byte("1"), 0o644)
+	_ = os.WriteFile(filepath.Join(root, "a", "b", "2.txt"), []byte("222"), 0o644)
+	_ = os.WriteFile(filepath.Join(root, "c.txt"), []byte("cc"), 0o644)
+	_ = os.WriteFile(filepath.Join(root, "d.bin"), make([]byte, 10), 0o644)
+	uploads.mark("d.bin", "session", "", &chunkRange{From: 0, To: 5, PartSize: 5, TotalSize: 10})
+	defer uploads.mark("d.bin", "session", "", &chunkRange{From: 5, To: 10, PartSize: 5, TotalSize: 10})
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	ctx := context.Background()
+	c, _ := New(ts.URL)
+	if _, err := c.Stat(ctx, "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	q := ListQuery{Sort: "size", Desc: true, Limit: 3}
+	for page := 0; ; page++ {
+		entries, next, err := c.ListPage(ctx, q)
+		if err != nil || page == 0 && len(entries) != 3 {
+			t.Fatalf("unexpected page %v, %v", entries, err)
+		}
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+			switch e.Path {
+			case "c.txt":
+				if e.Hash != hashReader(bytes.NewReader([]byte("cc"))) || e.ContentType != "text/plain; charset=utf-8" {
+					t.Fatalf("unexpected entry %+v", e)
+				}
+			case "d.bin":
+				if !e.Uploading || e.Received != 5 {
+					t.Fatalf("unexpected entry %+v", e)
+				}
+			}
+		}
+		if q.Cursor = next; next == "" {
+			break
+		}
+	}
+	if fmt.Sprint(paths) != "[d.bin a/b/2.txt c.txt a/1.txt]" {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+
+	entries, _, err := c.ListPage(ctx, ListQuery{Prefix: "a/", NonRecursive: true})
+	if err != nil || len(entries) != 2 || entries[0].Path != "a/1.txt" || entries[1].Path != "a/b" || !entries[1].IsDir {
+		t.Fatalf("unexpected entries %+v, %v", entries, err)
+	}
+}
+
+func TestClientQuota(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 200*1024)
+	big := writeTestFile(t, 300*1024)
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil,
+		WithQuota(Quota{MaxFileSize: 256 * 1024, UserBytes: 300 * 1024}),
+		WithUsageFile(filepath.Join(t.TempDir(), "usage.json"))))
+	defer ts.Close()
+
+	upload := func(rename, src string) error {
+		c, _ := New(ts.URL, WithFullPath(src), WithRename(rename), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+		return c.Start()
+	}
+
+	if err := upload("a.bin", src); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload("a.bin", src); err != nil { // replacing the own file
+		t.Fatal(err)
+	}
+	var se *StatusCodeError
+	if err := upload("b.bin", src); !errors.Is(err, ErrQuotaExceeded) ||
+		!errors.As(err, &se) || se.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %v", err)
+	}
+	if err := upload("c.bin", big); !errors.Is(err, ErrQuotaExceeded) ||
+		!errors.As(err, &se) || se.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %v", err)
+	}
+}
+
+func TestUploadMetaNameRefused(t *testing.T) {
+	root := setupTestRoot(t)
+	src := writeTestFile(t, 100)
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	var se *StatusCodeError
+	c, _ := New(ts.URL, WithFullPath(src), WithRename("a.txt.goupmeta"), WithChunkSize(64*1024), WithCode("code"))
+	if err := c.Start(); !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 of the chunked upload, got %v", err)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("file", "a.txt.goupmeta")
+	_, _ = fw.Write([]byte("{}"))
+	_ = mw.Close()
+	bodyReq, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("{}"))
+	bodyReq.Header.Set("Content-Gulp", "Filename=a.txt.goupmeta")
+	formReq, _ := http.NewRequest(http.MethodPost, ts.URL, &form)
+	formReq.Header.Set("Content-Type", mw.FormDataContentType())
+	renameReq, _ := http.NewRequest(http.MethodPost, ts.URL+"/a.txt", nil)
+	renameReq.Header.Set("Content-Gulp", "Rename=b.txt.goupmeta")
+	for _, r := range []*http.Request{bodyReq, formReq, renameReq} {
+		if rsp, err := http.DefaultClient.Do(r); err != nil || rsp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 of the metadata name, got %v %v", rsp, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt.goupmeta")); !os.IsNotExist(err) {
+		t.Fatalf("metadata forged: %v", err)
+	}
+}
+
+func TestClientFileMeta(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 100*1024)
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	_ = os.Chtimes(src, old, old)
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil))
+	defer ts.Close()
+
+	c, _ := New(ts.URL, WithFullPath(src), WithRename("m.txt"), WithChunkSize(64*1024), WithCode("code"), WithTag("build", "42"))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	st, err := c.Stat(ctx, "m.txt")
+	if err != nil || st.Meta == nil || st.Meta.Uploader != "127.0.0.1" || st.Meta.Tags["build"] != "42" ||
+		!st.Meta.ModTime.Equal(old) || st.Meta.ContentType != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected stat %+v, %v", st, err)
+	}
+	if entries, err := c.List(ctx, ""); err != nil || len(entries) != 1 || entries[0].Meta == nil {
+		t.Fatalf("unexpected list %+v, %v", entries, err)
+	}
+
+	out := filepath.Join(t.TempDir(), "m.txt")
+	for _, chunkSize := range []uint64{0, 64 * 1024} {
+		d, _ := New(ts.URL+"/m.txt", WithOutput(out), WithChunkSize(chunkSize), WithCode("code"))
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(out); err != nil || !info.ModTime().Equal(old) {
+			t.Fatalf("modification time not restored %v, %v", info.ModTime(), err)
+		}
+		_ = os.Remove(out)
+	}
+
+	if err := c.Delete(ctx, "m.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := c.List(ctx, ""); err != nil || len(entries) != 0 {
+		t.Fatalf("metadata left %+v, %v", entries, err)
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	ggcodec "github.com/bingoohuang/gg/pkg/codec"
 	"github.com/bingoohuang/gg/pkg/fla9"
@@ -12,25 +19,71 @@ import (
 	"github.com/bingoohuang/golog"
 	"github.com/bingoohuang/goup"
 	"github.com/bingoohuang/goup/codec"
+	"github.com/dustin/go-humanize"
 	"github.com/k0kubun/go-ansi"
 	"github.com/schollz/progressbar/v3"
 	"github.com/segmentio/ksuid"
+	"github.com/sirupsen/logrus"
 )
 
 type Arg struct {
-	ChunkSize   uint64 `flag:",c" size:"true" val:"10MiB"`
-	LimitRate   uint64 `flag:",L" size:"true" val:"0"`
-	Coroutines  int    `flag:",t"`
-	Port        int    `flag:",p" val:"2110"`
-	Version     bool   `flag:",v"`
-	Init        bool
-	Code        fla9.StringBool `flag:"P"`
-	Cipher      string          `flag:"C"`
-	ServerUrl   string          `flag:",u"`
-	FilePath    string          `flag:",f"`
-	Rename      string          `flag:",r"`
-	BearerToken string          `flag:",b"`
-	Paths       []string        `flag:"path"`
+	ChunkSize    uint64 `flag:",c" size:"true" val:"10MiB"`
+	LimitRate    uint64 `flag:",L" size:"true" val:"0"`
+	Coroutines   int    `flag:",t"`
+	Port         int    `flag:",p" val:"2110"`
+	Version      bool   `flag:",v"`
+	Events       bool
+	Json         bool
+	Init         bool
+	Code         fla9.StringBool `flag:"P"`
+	Cipher       string          `flag:"C"`
+	ServerUrl    string          `flag:",u"`
+	FilePath     string          `flag:",f"`
+	Output       string          `flag:",o"`
+	Rename       string          `flag:",r"`
+	Includes     []string        `flag:"include"`
+	Excludes     []string        `flag:"exclude"`
+	BearerToken  string          `flag:",b"`
+	AdminToken   string          `flag:"admin-token"`
+	Session      string          `flag:"session"`
+	Paths        []string        `flag:"path"`
+	Bandwidth    []string        `flag:"bandwidth"`
+	MaxChunks    int             `flag:"max-chunks"`
+	ClientChunks int             `flag:"client-chunks"`
+	ChunkQueue   int             `flag:"chunk-queue"`
+	QueueTimeout time.Duration   `flag:"queue-timeout" val:"30s"`
+	Mounts       []string        `flag:"mount"`
+	MountsFile   string          `flag:"mounts"`
+	ConfigFile   string          `flag:"config"`
+	Drain        time.Duration   `flag:"drain" val:"30s"`
+	MetricsAddr  string          `flag:"metrics-addr"`
+	Mirrors      []string        `flag:"mirror"`
+	Hooks        []string        `flag:"hook"`
+	Quarantine   string          `flag:"quarantine"`
+	Storage      string          `flag:"storage"`
+	QuotaTotal   uint64          `flag:"quota-total" size:"true"`
+	QuotaUser    uint64          `flag:"quota-user" size:"true"`
+	MaxFileSize  uint64          `flag:"max-file-size" size:"true"`
+	MinFree      uint64          `flag:"min-free" size:"true"`
+	Retentions   []string        `flag:"retention"`
+	Webhooks     []string        `flag:"webhook"`
+	WebhookKey   string          `flag:"webhook-secret"`
+	Sort         string          `flag:"sort"`
+	Shallow      bool            `flag:"shallow"`
+	Limit        int             `flag:"limit"`
+	Tags         []string        `flag:"tag"`
+	RestoreMode  bool            `flag:"restore-mode"`
+
+	RetryMax      int           `flag:"retry-max" val:"10"`
+	RetryDeadline time.Duration `flag:"retry-deadline"`
+	RetryMinWait  time.Duration `flag:"retry-min-wait" val:"100ms"`
+	RetryMaxWait  time.Duration `flag:"retry-max-wait" val:"1h"`
+	StallTimeout  time.Duration `flag:"stall-timeout" val:"1m"`
+	RespTimeout   time.Duration `flag:"response-timeout" val:"10m"`
+	Timeout       time.Duration `flag:"timeout"`
+	PartialTTL    time.Duration `flag:"partial-ttl"`
+	JanitorEvery  time.Duration `flag:"janitor-interval" val:"10m"`
+	JanitorDryRun bool          `flag:"janitor-dry-run"`
 }
 
 // Usage is optional for customized show.
@@ -38,18 +91,76 @@ func (a Arg) Usage() string {
 	return fmt.Sprintf(`
 Usage of goup:
   -b    string Bearer token for client or server, auto for server to generate a random one
+  -admin-token string Bearer token of the admin API for server, see goup admin
   -c    string Chunk size for client (default 10MB, 0 to disable chunks), upload limit size for server.
   -t    int    Threads (go-routines) for client
-  -f    string Upload file path for client
+  -f    string Upload file or directory path for client, - for stdin (-r is required), like pg_dump | goup -u :2110 -f - -r dump.sql
+  -o    string Output file path or directory for client downloading (default ./.goup/)
   -p    int    Listening port for server
-  -r    string Rename to another filename
+  -r    string Rename to another filename (or directory name when uploading a directory)
+  -include glob Glob patterns of the files to upload in a directory, like *.js
+  -exclude glob Glob patterns of the files or directories to skip in a directory, like node_modules
   -u    string Server upload url for client to connect to
+  -mirror url  Mirrored server url holding the same file for client to download from in parallel, like -mirror http://b:2110/a.zip
   -P    string Password for PAKE
-  -L    string Limit rate /s, like 10K for limit 10K/s
+  -L    string Limit rate /s, like 10K for limit 10K/s, per client IP for server
+  -bandwidth [up:|down:]global=rate,user=rate,ip=rate Bandwidth limits for server split fairly among the connections,
+             like -bandwidth down:global=100MiB,user=10MiB -bandwidth up:ip=5MiB, instead of -L
+  -max-chunks    int      Max concurrent chunk requests of all the clients for server, the excess ones get 429 with Retry-After
+  -client-chunks int      Max concurrent chunk requests of each client (bearer identity or IP) for server
+  -chunk-queue   int      Max chunk requests waiting for the slots for server (default no limit)
+  -queue-timeout duration Time limit of a chunk request waiting for the slots for server (default 30s)
   -C    string Cipher AES256: AES-256 GCM, C20P1305: ChaCha20 Poly1305
   -v    bool   Show version
+  -events bool Log the chunk events (queued, skipped, started, retried, completed, failed) with speed and ETA for client
+  -json   bool Print the transfer result as JSON to stdout for client, the progress bar goes to stderr then
+  -tag   key=value Custom tag of the uploading file metadata for client, like -tag build=42
+  -restore-mode bool Restore the file mode from the metadata for client downloading (the modification time is always restored)
   -path /short=/short.zip Short URLs
-  -init bool   Create init ctl shell script`)
+  -mount  [ro,upload-only,list:]/prefix[=root] Mount the directory or the storage (see -storage) at the URL path prefix for server,
+          like -mount ro,list:/pub=/srv/pub, without root to set only the flags of the path, like -mount upload-only:/inbox
+  -mounts string JSON file of the mounts like [{"prefix":"/pub","root":"/srv/pub","readOnly":true,"listable":true},{"prefix":"/short","alias":"/short.zip"}],
+          reloaded on SIGHUP
+  -hook [reject|quarantine|ignore|async][,timeout=5m]:command Post-upload hook for server, like "quarantine:clamscan --no-summary {path}",
+        killed after the timeout (default 10m, timeout=0 for no limit)
+  -quarantine string Quarantine directory for the files failed by hooks
+  -quota-total   string Total size limit of all the files for server, like 100GiB
+  -quota-user    string Total size limit of the files uploaded by each user (bearer identity or IP) for server
+  -max-file-size string Size limit of a single uploaded file for server, like 4GiB
+  -min-free      string Free disk space to reserve for server, like 1GiB
+  -partial-ttl      duration Delete the incomplete uploads idle longer than it for server, like 24h
+  -retention        string   Expire the files by the path prefix for server, like prefix=tmp/,age=720h,idle=168h
+  -janitor-interval duration Period of the janitor deleting the partial uploads and the expired files (default 10m)
+  -janitor-dry-run  bool     Only log the files the janitor would delete
+  -webhook        [upload,download,delete:]url Webhook to POST the JSON events to for server, like upload:http://ci:8080/artifacts
+  -webhook-secret string Secret to sign the webhook bodies by HMAC-SHA256 in X-Goup-Signature: sha256=hex
+  -storage string Storage backend for server: local[:dir], mem or s3://key:secret@host/bucket?region=us-east-1&tls=false (default local)
+  -retry-max      int      Max attempts of a chunk for client (default 10)
+  -retry-deadline duration Total time limit of retrying a chunk for client, like 10m (default no limit)
+  -retry-min-wait duration Min backoff wait between attempts for client (default 100ms)
+  -retry-max-wait duration Max backoff wait between attempts for client (default 1h)
+  -stall-timeout  duration Abort and retry a chunk when no bytes move for the period for client (default 1m, -1s to disable)
+  -response-timeout duration Abort and retry a chunk when no response arrives for the period after it is uploaded for client (default 10m)
+  -timeout        duration Time limit of the whole transfer for client, like 2h (default no limit)
+  -drain  duration Time limit of waiting the in-flight transfers on SIGINT or SIGTERM for server (default 30s)
+  -metrics-addr string Listening address of the Prometheus metrics at /metrics for server, like 127.0.0.1:9110 (default not served)
+  -config string YAML configuration file of the server, instead of the server flags, auth users and mounts reloaded on SIGHUP
+  -init bool   Create init ctl shell script
+
+Remote file management for client:
+  goup ls   [prefix]      -u url [-b token] [-json]  List the files whose paths have the prefix
+            [-sort path|name|size|mtime, prefix - for descending like -sort -mtime]
+            [-shallow] List only the direct children of the directory, like goup ls x/ -shallow
+            [-limit n] Fetch the listing by pages of n entries
+  goup stat path...       -u url [-b token] [-json]  Show the size, modification time and SHA-256
+  goup rm   path...       -u url [-b token]          Delete the files or empty directories
+  goup mv   path newpath  -u url [-b token]          Rename or move a file
+
+Admin of the live transfers for client, -b is the admin token of the server:
+  goup admin sessions|uploads|downloads -u url -b token [-json]  List the sessions or the transfers in progress
+  goup admin kill   session -u url -b token                      Kill the session, its transfers are refused later
+  goup admin cancel path    -u url -b token [-session id]        Cancel the upload and discard its partial data
+  goup admin close  path    -u url -b token [-session id]        Force-close the download`)
 }
 
 // VersionInfo is optional for customized version.
@@ -58,11 +169,22 @@ func (a Arg) VersionInfo() string { return v.Version() }
 func main() {
 	golog.Setup()
 
+	cmd, operands, args := splitCommand(os.Args)
 	c := &Arg{}
-	flagparse.Parse(c)
+	flagparse.ParseArgs(c, args)
+	if cmd != "" {
+		c.runCommand(cmd, operands)
+		return
+	}
+
 	c.processCode()
 	log.Printf("Args: %s", ggcodec.Json(c))
 
+	if c.ServerUrl == "" && c.ConfigFile != "" {
+		c.serveConfig()
+		return
+	}
+
 	if c.ServerUrl == "" {
 		if c.BearerToken == "auto" {
 			c.BearerToken = goup.BearerTokenGenerate()
@@ -72,33 +194,298 @@ func main() {
 		if err := goup.InitServer(); err != nil {
 			log.Fatalf("init goup server: %v", err)
 		}
-		http.HandleFunc("/", goup.Bearer(c.BearerToken, goup.ServerHandle(c.Code.String(), c.Cipher, c.ChunkSize, c.LimitRate, c.Paths)))
-		log.Printf("Listening on %d", c.Port)
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", c.Port), nil); err != nil {
-			log.Printf("E! listen failed: %v", err)
+		storage, err := goup.ParseStorage(c.Storage)
+		if err != nil {
+			log.Fatalf("parse storage %s: %v", c.Storage, err)
+		}
+		serverOpts := []goup.ServerOptFn{goup.WithStorage(storage), goup.WithQuota(goup.Quota{
+			TotalBytes:   int64(c.QuotaTotal),
+			UserBytes:    int64(c.QuotaUser),
+			MaxFileSize:  int64(c.MaxFileSize),
+			MinFreeBytes: int64(c.MinFree),
+		})}
+		janitor := goup.Janitor{Interval: c.JanitorEvery, PartialTTL: c.PartialTTL, DryRun: c.JanitorDryRun}
+		for _, spec := range c.Retentions {
+			retention, err := goup.ParseRetention(spec)
+			if err != nil {
+				log.Fatalf("parse retention %s: %v", spec, err)
+			}
+			janitor.Retentions = append(janitor.Retentions, retention)
+		}
+		serverOpts = append(serverOpts, goup.WithJanitor(janitor))
+		for _, spec := range c.Webhooks {
+			webhook, err := goup.ParseWebhook(spec)
+			if err != nil {
+				log.Fatalf("parse webhook %s: %v", spec, err)
+			}
+			webhook.Secret = c.WebhookKey
+			serverOpts = append(serverOpts, goup.WithWebhooks(webhook))
+		}
+		for _, spec := range c.Hooks {
+			hook, err := goup.ParseHook(spec)
+			if err != nil {
+				log.Fatalf("parse hook %s: %v", spec, err)
+			}
+			serverOpts = append(serverOpts, goup.WithHooks(hook))
+		}
+		if c.Quarantine != "" {
+			serverOpts = append(serverOpts, goup.WithQuarantineDir(c.Quarantine))
+		}
+		bandwidth, err := goup.ParseBandwidth(c.Bandwidth...)
+		if err != nil {
+			log.Fatalf("parse bandwidth: %v", err)
 		}
+		serverOpts = append(serverOpts, goup.WithMounts(c.newMounts()), goup.WithAdminToken(c.AdminToken), goup.WithBandwidth(bandwidth),
+			goup.WithAdmission(goup.Admission{Global: c.MaxChunks, Client: c.ClientChunks, Queue: c.ChunkQueue, QueueTimeout: c.QueueTimeout}))
+		s := goup.NewServer(c.Code.String(), c.Cipher, c.ChunkSize, c.LimitRate, c.Paths, serverOpts...)
+		serve(s, goup.Bearer(c.BearerToken, s.ServeHTTP, c.AdminToken), []string{fmt.Sprintf(":%d", c.Port)}, c.MetricsAddr, "", "", c.Drain)
 		return
 	}
 
-	g, err := goup.New(c.ServerUrl,
-		goup.WithFullPath(c.FilePath),
+	var source goup.OptFn
+	if c.FilePath == "-" {
+		source = goup.WithReader(os.Stdin)
+	} else {
+		source = goup.WithFullPath(c.FilePath)
+	}
+
+	opts := []goup.OptFn{
+		source,
 		goup.WithRename(c.Rename),
+		goup.WithOutput(c.Output),
+		goup.WithMirrors(c.Mirrors...),
+		goup.WithIncludes(c.Includes...),
+		goup.WithExcludes(c.Excludes...),
 		goup.WithBearer(c.BearerToken),
 		goup.WithChunkSize(c.ChunkSize),
-		goup.WithProgress(newSchollzProgressbar()),
+		goup.WithProgress(newSchollzProgressbar(c.Json)),
 		goup.WithCoroutines(c.Coroutines),
 		goup.WithCode(c.Code.String()),
 		goup.WithCipher(c.Cipher),
-	)
+		goup.WithEventListener(c.eventListener()),
+		goup.WithStallTimeout(c.StallTimeout),
+		goup.WithResponseTimeout(c.RespTimeout),
+		goup.WithTransferTimeout(c.Timeout),
+		goup.WithRetryPolicy(goup.RetryPolicy{
+			MaxAttempts: c.RetryMax,
+			Deadline:    c.RetryDeadline,
+			MinWait:     c.RetryMinWait,
+			MaxWait:     c.RetryMaxWait,
+		}),
+		goup.WithRestoreMode(c.RestoreMode),
+	}
+	for _, tag := range c.Tags {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" {
+			log.Fatalf("bad tag %s, should be key=value", tag)
+		}
+		opts = append(opts, goup.WithTag(k, v))
+	}
+
+	g, err := goup.New(c.ServerUrl, opts...)
 	if err != nil {
 		log.Fatalf("new goup client: %v", err)
 	}
 
-	if err := g.Start(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = g.StartContext(ctx)
+	c.printResult(g.Result())
+	if err != nil {
 		log.Fatalf("start goup client: %v", err)
 	}
+}
+
+// serveConfig runs the server of the configuration file, and reloads it on SIGHUP.
+func (a *Arg) serveConfig() {
+	cfg, err := goup.LoadConfig(a.ConfigFile)
+	if err != nil {
+		log.Fatalf("load config: %v", err)
+	}
+	if cfg.Log != "" {
+		golog.Setup(golog.Spec(cfg.Log))
+	}
+	if err := goup.InitServer(); err != nil {
+		log.Fatalf("init goup server: %v", err)
+	}
+
+	users, mounts := goup.NewUsers(nil), &goup.Mounts{}
+	if err := cfg.Apply(users, mounts); err != nil {
+		log.Fatalf("apply config: %v", err)
+	}
+	s, handler := cfg.NewServer(users, mounts)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		current := cfg
+		for range hup {
+			newCfg, err := goup.LoadConfig(a.ConfigFile)
+			if err == nil {
+				err = newCfg.Apply(users, mounts)
+			}
+			if err != nil {
+				log.Printf("E! reload config failed, keep the current one: %v", err)
+				continue
+			}
+			newCfg.Reload(s)
+			level, err := logrus.ParseLevel(newCfg.LogLevel())
+			if err != nil {
+				level = logrus.InfoLevel // like golog.Setup
+			}
+			logrus.SetLevel(level)
+			log.Printf("config %s reloaded", a.ConfigFile)
+			if current.NeedsRestart(newCfg) {
+				log.Printf("W! config changes other than the users, the mounts, the limits, the admission, the quota, the hooks and the log level need a restart")
+			}
+			current = newCfg
+		}
+	}()
+
+	drain := cfg.DrainTimeout()
+	if drain == 0 {
+		drain = a.Drain
+	}
+	metricsAddr := cfg.MetricsAddr
+	if metricsAddr == "" {
+		metricsAddr = a.MetricsAddr
+	}
+	serve(s, handler, cfg.Listen, metricsAddr, cfg.TLS.Cert, cfg.TLS.Key, drain)
+}
+
+// serve listens on the addresses until SIGINT or SIGTERM, then refuses the new requests,
+// and waits the in-flight transfers up to the drain timeout before exiting.
+// The metrics are served on their own address, apart from the files and the bearer auth.
+func serve(s *goup.Server, handler http.HandlerFunc, addrs []string, metricsAddr, certFile, keyFile string, drain time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, len(addrs)+1)
+	servers := make([]*http.Server, 0, len(addrs)+1)
+	for _, addr := range addrs {
+		hs := &http.Server{Addr: addr, Handler: handler}
+		servers = append(servers, hs)
+		go func() {
+			log.Printf("Listening on %s", hs.Addr)
+			if certFile != "" {
+				errs <- hs.ListenAndServeTLS(certFile, keyFile)
+			} else {
+				errs <- hs.ListenAndServe()
+			}
+		}()
+	}
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", goup.DefaultMetrics)
+		hs := &http.Server{Addr: metricsAddr, Handler: mux}
+		servers = append(servers, hs)
+		go func() {
+			log.Printf("Serving metrics on %s/metrics", hs.Addr)
+			errs <- hs.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		log.Printf("E! listen failed: %v", err)
+	case <-ctx.Done():
+		stop() // a second signal kills immediately
+		log.Printf("shutting down, waiting the in-flight transfers up to %s", drain)
+	}
+
+	dctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := s.Shutdown(dctx); err != nil {
+		log.Printf("W! drain: %v", err)
+	}
+	for _, hs := range servers {
+		if err := hs.Shutdown(dctx); err != nil {
+			log.Printf("W! shutdown %s: %v", hs.Addr, err)
+		}
+	}
+	log.Printf("server stopped")
+}
+
+// newMounts creates the mounts of the -mount flags, and the -mounts file which is reloaded on SIGHUP.
+func (a *Arg) newMounts() *goup.Mounts {
+	var fixed []goup.Mount
+	for _, spec := range a.Mounts {
+		m, err := goup.ParseMount(spec)
+		if err != nil {
+			log.Fatalf("parse mount %s: %v", spec, err)
+		}
+		fixed = append(fixed, m)
+	}
+	mounts, err := goup.NewMounts(fixed...)
+	if err != nil {
+		log.Fatalf("mount: %v", err)
+	}
+	if a.MountsFile == "" {
+		return mounts
+	}
+
+	load := func() error {
+		m, err := goup.LoadMounts(a.MountsFile)
+		if err != nil {
+			return err
+		}
+		return mounts.Set(m)
+	}
+	if err := load(); err != nil {
+		log.Fatalf("load mounts: %v", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := load(); err != nil {
+				log.Printf("E! reload mounts failed, keep the current ones: %v", err)
+			} else {
+				log.Printf("mounts %s reloaded", a.MountsFile)
+			}
+		}
+	}()
+	return mounts
+}
+
+func (a *Arg) printResult(r goup.Result) {
+	if a.Json {
+		fmt.Println(string(ggcodec.Json(r)))
+		return
+	}
+
+	cipher, hash := r.Cipher, r.Hash
+	if cipher == "" {
+		cipher = "none"
+	}
+	if hash == "" {
+		hash = "unknown"
+	}
+	log.Printf("%s %s %s, transferred %s, skipped %s, retried chunks %d (retries %d), elapsed %s, throughput %s/s, cipher %s, sha256 %s",
+		r.Operation, r.ID, r.Path, humanize.IBytes(r.Transferred), humanize.IBytes(r.Skipped),
+		r.RetriedChunks, r.Retries, r.Elapsed.Round(time.Millisecond), humanize.IBytes(uint64(r.Throughput)), cipher, hash)
+}
+
+func (a *Arg) eventListener() goup.EventListener {
+	if !a.Events {
+		return nil
+	}
 
-	g.Wait()
+	return func(e goup.ProgressEvent) {
+		if e.Type == goup.EventChunkQueued {
+			return
+		}
+		errMsg := ""
+		if e.Err != nil {
+			errMsg = ", error: " + e.Err.Error()
+		}
+		log.Printf("chunk %d %s, bytes %d-%d, attempt %d, done %s/%s, speed %s/s, ETA %s%s",
+			e.Index+1, e.Type, e.From, e.To, e.Attempt,
+			humanize.IBytes(e.Stats.Done), humanize.IBytes(e.Stats.TotalSize),
+			humanize.IBytes(uint64(e.Stats.Speed)), e.Stats.ETA.Round(time.Second), errMsg)
+	}
 }
 
 func (a *Arg) processCode() {
@@ -116,18 +503,23 @@ func (a *Arg) processCode() {
 
 type schollzProgressbar struct {
 	bar *progressbar.ProgressBar
+	out io.Writer
 }
 
 func (s *schollzProgressbar) Start(value uint64) {
+	max := int64(value)
+	if max == 0 { // unknown size, like streaming from stdin
+		max = -1
+	}
 	s.bar = progressbar.NewOptions64(
-		int64(value),
-		progressbar.OptionSetWriter(ansi.NewAnsiStdout()),
+		max,
+		progressbar.OptionSetWriter(s.out),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionSetWidth(10),
 		progressbar.OptionShowCount(),
 		progressbar.OptionOnCompletion(func() {
-			fmt.Printf("\n")
+			_, _ = fmt.Fprintf(s.out, "\n")
 		}),
 		progressbar.OptionSetTheme(progressbar.Theme{
 			Saucer:        "[green]=[reset]",
@@ -147,6 +539,10 @@ func (s schollzProgressbar) Finish() {
 	s.bar.Finish()
 }
 
-func newSchollzProgressbar() *schollzProgressbar {
-	return &schollzProgressbar{}
+// newSchollzProgressbar creates the progress bar on stdout, or on stderr to keep stdout for the JSON result.
+func newSchollzProgressbar(json bool) *schollzProgressbar {
+	if json {
+		return &schollzProgressbar{out: ansi.NewAnsiStderr()}
+	}
+	return &schollzProgressbar{out: ansi.NewAnsiStdout()}
 }
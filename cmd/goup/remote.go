@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	ggcodec "github.com/bingoohuang/gg/pkg/codec"
+	"github.com/bingoohuang/goup"
+	"github.com/dustin/go-humanize"
+)
+
+// commands are the remote file management commands, like goup ls [prefix] -u :2110.
+var commands = map[string]func(a *Arg, ctx context.Context, g *goup.Client, operands []string) error{
+	"ls":   (*Arg).list,
+	"stat": (*Arg).stat,
+	"rm":   (*Arg).remove,
+	"mv":   (*Arg).move,
+
+	"admin": (*Arg).admin,
+}
+
+// splitCommand splits the args like goup ls [operands...] [flags...] into the command,
+// the operands and the args for the flag parsing.
+func splitCommand(args []string) (cmd string, operands, flagArgs []string) {
+	if len(args) < 2 || commands[args[1]] == nil {
+		return "", nil, args
+	}
+
+	cmd, rest := args[1], args[2:]
+	for len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		operands, rest = append(operands, rest[0]), rest[1:]
+	}
+	return cmd, operands, append([]string{args[0]}, rest...)
+}
+
+func (a *Arg) runCommand(cmd string, operands []string) {
+	if a.ServerUrl == "" {
+		log.Fatalf("-u is required for %s", cmd)
+	}
+	g, err := goup.New(a.ServerUrl, goup.WithBearer(a.BearerToken))
+	if err != nil {
+		log.Fatalf("new goup client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := commands[cmd](a, ctx, g, operands); err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+}
+
+func (a *Arg) list(ctx context.Context, g *goup.Client, operands []string) error {
+	prefix := ""
+	if len(operands) > 0 {
+		prefix = operands[0]
+	}
+	q := goup.ListQuery{Prefix: prefix, NonRecursive: a.Shallow, Limit: a.Limit}
+	q.Sort = strings.TrimPrefix(a.Sort, "-")
+	q.Desc = strings.HasPrefix(a.Sort, "-")
+	var all []goup.Entry
+	for {
+		entries, next, err := g.ListPage(ctx, q)
+		if err != nil {
+			return err
+		}
+		if a.Json {
+			all = append(all, entries...)
+		} else {
+			for _, e := range entries {
+				printEntry(e)
+			}
+		}
+		if q.Cursor = next; next == "" {
+			break
+		}
+	}
+	if a.Json {
+		fmt.Println(string(ggcodec.Json(all)))
+	}
+	return nil
+}
+
+func printEntry(e goup.Entry) {
+	name := e.Path
+	switch {
+	case e.IsDir:
+		name += "/"
+	case e.Uploading:
+		name += fmt.Sprintf(" (uploading, %s received)", humanize.IBytes(e.Received))
+	}
+	fmt.Printf("%10s  %s  %s\n", humanize.IBytes(uint64(e.Size)), e.ModTime.Format("2006-01-02 15:04:05"), name)
+}
+
+func (a *Arg) stat(ctx context.Context, g *goup.Client, operands []string) error {
+	if len(operands) == 0 {
+		return fmt.Errorf("usage: goup stat path... -u url")
+	}
+	for _, name := range operands {
+		st, err := g.Stat(ctx, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if a.Json {
+			fmt.Println(string(ggcodec.Json(st)))
+			continue
+		}
+		fmt.Printf("%s  %s  %s  %s\n", st.Path, humanize.IBytes(uint64(st.Size)), st.ModTime.Format(time.RFC3339), st.Hash)
+		if m := st.Meta; m != nil {
+			fmt.Printf("  uploaded by %s at %s, from %s, modified at %s, %s\n", m.Uploader,
+				m.UploadedAt.Format(time.RFC3339), m.OriginalPath, m.ModTime.Format(time.RFC3339), m.ContentType)
+			for k, v := range m.Tags {
+				fmt.Printf("  %s=%s\n", k, v)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Arg) remove(ctx context.Context, g *goup.Client, operands []string) error {
+	if len(operands) == 0 {
+		return fmt.Errorf("usage: goup rm path... -u url")
+	}
+	for _, name := range operands {
+		if err := g.Delete(ctx, name); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("%s deleted", name)
+	}
+	return nil
+}
+
+func (a *Arg) move(ctx context.Context, g *goup.Client, operands []string) error {
+	if len(operands) != 2 {
+		return fmt.Errorf("usage: goup mv path newpath -u url")
+	}
+	if err := g.Move(ctx, operands[0], operands[1]); err != nil {
+		return err
+	}
+	log.Printf("%s moved to %s", operands[0], operands[1])
+	return nil
+}
+
+func (a *Arg) admin(ctx context.Context, g *goup.Client, operands []string) error {
+	if len(operands) == 0 {
+		return fmt.Errorf("usage: goup admin sessions|uploads|downloads|kill|cancel|close -u url -b token")
+	}
+	switch sub, args := operands[0], operands[1:]; {
+	case sub == "sessions":
+		sessions, err := g.AdminSessions(ctx)
+		if err != nil || a.Json {
+			fmt.Println(string(ggcodec.Json(sessions)))
+			return err
+		}
+		for _, s := range sessions {
+			fmt.Printf("%s  %s  %s  %s  %d active\n", s.ID, s.Created.Format(time.RFC3339), s.RemoteAddr, s.Identity, s.Active)
+		}
+	case sub == "uploads" || sub == "downloads":
+		list, err := g.AdminUploads(ctx)
+		if sub == "downloads" {
+			list, err = g.AdminDownloads(ctx)
+		}
+		if err != nil || a.Json {
+			fmt.Println(string(ggcodec.Json(list)))
+			return err
+		}
+		for _, t := range list {
+			fmt.Printf("%s  %s/%s  session %s  %s  updated %s  %d active\n", t.Name, humanize.IBytes(t.Transferred),
+				humanize.IBytes(t.TotalSize), t.Session, t.Identity, t.Updated.Format(time.RFC3339), t.Active)
+		}
+	case sub == "kill" && len(args) == 1:
+		if err := g.AdminKillSession(ctx, args[0]); err != nil {
+			return err
+		}
+		log.Printf("session %s killed", args[0])
+	case sub == "cancel" && len(args) == 1:
+		if err := g.AdminCancelUpload(ctx, args[0], a.Session); err != nil {
+			return err
+		}
+		log.Printf("upload %s canceled", args[0])
+	case sub == "close" && len(args) == 1:
+		if err := g.AdminCloseDownload(ctx, args[0], a.Session); err != nil {
+			return err
+		}
+		log.Printf("download %s closed", args[0])
+	default:
+		return fmt.Errorf("usage: goup admin sessions|uploads|downloads|kill session|cancel path|close path -u url -b token")
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package goup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/yaml"
+	"github.com/dustin/go-humanize"
+)
+
+// Config is the YAML configuration file of the server, like:
+//
+//	listen: [":2110"]
+//	metricsAddr: 127.0.0.1:9110
+//	tls: {cert: server.crt, key: server.key}
+//	auth:
+//	  users: {alice: token1, bob: token2}
+//	  admin: token0
+//	mounts:
+//	  - {prefix: /pub, root: /srv/pub, readOnly: true, listable: true}
+//	limits: {chunkSize: 10MiB, bandwidth: ["down:global=100MiB,user=10MiB", "up:ip=5MiB"]}
+//	admission: {global: 64, client: 8, queueTimeout: 30s}
+//	quota: {total: 100GiB, user: 10GiB}
+//	hooks: ["quarantine:clamscan --no-summary {path}"]
+//	log: level=info,file=/var/log/goup.log
+//
+// The auth users and the mounts are reloaded by Apply, the rate and bandwidth limits, the admission, the quota and the hooks by Reload,
+// the other changes need a restart.
+type Config struct {
+	// Listen are the listening addresses, default :2110.
+	Listen []string `yaml:"listen"`
+	// MetricsAddr is the listening address of the Prometheus metrics at /metrics, not served if empty.
+	MetricsAddr string    `yaml:"metricsAddr"`
+	TLS         ConfigTLS `yaml:"tls"`
+	// Code is the PAKE password, Cipher is one of AES256 and C20P1305.
+	Code   string     `yaml:"code"`
+	Cipher string     `yaml:"cipher"`
+	Auth   ConfigAuth `yaml:"auth"`
+	// Storage is the storage spec, see ParseStorage.
+	Storage string  `yaml:"storage"`
+	Mounts  []Mount `yaml:"mounts"`
+	// Paths are the aliases of the single files, like /short=/short.zip.
+	Paths      []string        `yaml:"paths"`
+	Limits     ConfigLimits    `yaml:"limits"`
+	Admission  ConfigAdmission `yaml:"admission"`
+	Quota      ConfigQuota     `yaml:"quota"`
+	Hooks      []string        `yaml:"hooks"`
+	Quarantine string          `yaml:"quarantine"`
+	Janitor    ConfigJanitor   `yaml:"janitor"`
+	Webhooks   ConfigWebhooks  `yaml:"webhooks"`
+	// Log is the golog spec, like level=info,file=/var/log/goup.log,maxSize=100M.
+	Log string `yaml:"log"`
+	// Drain limits the waiting of the in-flight transfers on shutdown, like 30s.
+	Drain string `yaml:"drain"`
+
+	file         string
+	data         []byte
+	chunkSize    uint64
+	limitRate    uint64
+	drainTimeout time.Duration
+	bandwidth    Bandwidth
+	admission    Admission
+	quota        Quota
+	hooks        []Hook
+	opts         []ServerOptFn
+}
+
+// ConfigTLS is the certificate and the key files to serve HTTPS.
+type ConfigTLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// ConfigAuth is the bearer tokens, Token is shared without identity, Users maps the users to their tokens,
+// Admin is the token of the admin API.
+type ConfigAuth struct {
+	Token string            `yaml:"token"`
+	Users map[string]string `yaml:"users"`
+	Admin string            `yaml:"admin"`
+}
+
+// ConfigLimits is the chunk size (also the upload limit size) and the rate limit per client IP, like 10MiB,
+// and the bandwidth specs like up:global=100MiB,user=10MiB,ip=5MiB, see ParseBandwidth.
+type ConfigLimits struct {
+	ChunkSize string   `yaml:"chunkSize"`
+	Rate      string   `yaml:"rate"`
+	Bandwidth []string `yaml:"bandwidth"`
+}
+
+// ConfigAdmission is the Admission with the durations like 30s.
+type ConfigAdmission struct {
+	Global       int    `yaml:"global"`
+	Client       int    `yaml:"client"`
+	Queue        int    `yaml:"queue"`
+	QueueTimeout string `yaml:"queueTimeout"`
+	RetryAfter   string `yaml:"retryAfter"`
+}
+
+// ConfigQuota is the Quota with the sizes like 10GiB.
+type ConfigQuota struct {
+	Total       string `yaml:"total"`
+	User        string `yaml:"user"`
+	MaxFileSize string `yaml:"maxFileSize"`
+	MinFree     string `yaml:"minFree"`
+}
+
+// ConfigJanitor is the Janitor with the durations like 24h, and the retention specs like prefix=tmp/,age=720h.
+type ConfigJanitor struct {
+	Interval   string   `yaml:"interval"`
+	PartialTTL string   `yaml:"partialTTL"`
+	Retentions []string `yaml:"retentions"`
+	DryRun     bool     `yaml:"dryRun"`
+}
+
+// ConfigWebhooks is the webhook specs like upload:http://ci:8080/artifacts, signed by the secret.
+type ConfigWebhooks struct {
+	URLs   []string `yaml:"urls"`
+	Secret string   `yaml:"secret"`
+}
+
+// LoadConfig loads and validates the configuration file, the errors are reported with the line numbers.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{file: file, data: data}
+	if err := yaml.UnmarshalWithOptions(data, c, yaml.DisallowUnknownField()); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, yaml.FormatError(err, false, true))
+	}
+	if err := c.parse(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// errorf returns the error at the YAML path with the line number.
+func (c *Config) errorf(yamlPath string, format string, args ...interface{}) error {
+	line := 0
+	if p, err := yaml.PathString(yamlPath); err == nil {
+		if n, err := p.ReadNode(bytes.NewReader(c.data)); err == nil && n != nil {
+			line = n.GetToken().Position.Line
+		}
+	}
+	return fmt.Errorf("%s:%d: %s: %s", c.file, line, yamlPath, fmt.Sprintf(format, args...))
+}
+
+func (c *Config) parseSize(yamlPath, v string) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := humanize.ParseBytes(v)
+	if err != nil {
+		return 0, c.errorf(yamlPath, "bad size %q", v)
+	}
+	return n, nil
+}
+
+func (c *Config) parseDuration(yamlPath, v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, c.errorf(yamlPath, "bad duration %q", v)
+	}
+	return d, nil
+}
+
+// parse validates the values and creates the server options.
+func (c *Config) parse() (err error) {
+	if len(c.Listen) == 0 {
+		c.Listen = []string{":2110"}
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return c.errorf("$.tls", "both cert and key are required")
+	}
+	if c.chunkSize, err = c.parseSize("$.limits.chunkSize", c.Limits.ChunkSize); err != nil {
+		return err
+	}
+	if c.limitRate, err = c.parseSize("$.limits.rate", c.Limits.Rate); err != nil {
+		return err
+	}
+	if c.drainTimeout, err = c.parseDuration("$.drain", c.Drain); err != nil {
+		return err
+	}
+	for i, spec := range c.Limits.Bandwidth {
+		if _, err := ParseBandwidth(spec); err != nil {
+			return c.errorf(fmt.Sprintf("$.limits.bandwidth[%d]", i), "%v", err)
+		}
+	}
+	c.bandwidth, _ = ParseBandwidth(c.Limits.Bandwidth...)
+	if c.bandwidth == (Bandwidth{}) && c.limitRate > 0 {
+		c.bandwidth.Upload.IP, c.bandwidth.Download.IP = c.limitRate, c.limitRate
+	}
+	c.opts = append(c.opts, WithBandwidth(c.bandwidth))
+
+	a := Admission{Global: c.Admission.Global, Client: c.Admission.Client, Queue: c.Admission.Queue}
+	if a.QueueTimeout, err = c.parseDuration("$.admission.queueTimeout", c.Admission.QueueTimeout); err != nil {
+		return err
+	}
+	if a.RetryAfter, err = c.parseDuration("$.admission.retryAfter", c.Admission.RetryAfter); err != nil {
+		return err
+	}
+	c.admission = a
+	c.opts = append(c.opts, WithAdmission(a))
+
+	storage, err := ParseStorage(c.Storage)
+	if err != nil {
+		return c.errorf("$.storage", "%v", err)
+	}
+	c.opts = append(c.opts, WithStorage(storage), WithAdminToken(c.Auth.Admin))
+
+	q := &c.quota
+	for _, v := range []struct {
+		path, value string
+		dst         *int64
+	}{
+		{"$.quota.total", c.Quota.Total, &q.TotalBytes},
+		{"$.quota.user", c.Quota.User, &q.UserBytes},
+		{"$.quota.maxFileSize", c.Quota.MaxFileSize, &q.MaxFileSize},
+		{"$.quota.minFree", c.Quota.MinFree, &q.MinFreeBytes},
+	} {
+		n, err := c.parseSize(v.path, v.value)
+		if err != nil {
+			return err
+		}
+		*v.dst = int64(n)
+	}
+	c.opts = append(c.opts, WithQuota(*q))
+
+	if err := c.validateMounts(); err != nil {
+		return err
+	}
+	for i, p := range c.Paths {
+		if _, err := ParseAlias(p); err != nil {
+			return c.errorf(fmt.Sprintf("$.paths[%d]", i), "%v", err)
+		}
+	}
+
+	for i, spec := range c.Hooks {
+		hook, err := ParseHook(spec)
+		if err != nil {
+			return c.errorf(fmt.Sprintf("$.hooks[%d]", i), "%v", err)
+		}
+		c.hooks = append(c.hooks, hook)
+	}
+	c.opts = append(c.opts, WithHooks(c.hooks...))
+	if c.Quarantine != "" {
+		c.opts = append(c.opts, WithQuarantineDir(c.Quarantine))
+	}
+
+	j := Janitor{DryRun: c.Janitor.DryRun}
+	if j.Interval, err = c.parseDuration("$.janitor.interval", c.Janitor.Interval); err != nil {
+		return err
+	}
+	if j.PartialTTL, err = c.parseDuration("$.janitor.partialTTL", c.Janitor.PartialTTL); err != nil {
+		return err
+	}
+	for i, spec := range c.Janitor.Retentions {
+		r, err := ParseRetention(spec)
+		if err != nil {
+			return c.errorf(fmt.Sprintf("$.janitor.retentions[%d]", i), "%v", err)
+		}
+		j.Retentions = append(j.Retentions, r)
+	}
+	c.opts = append(c.opts, WithJanitor(j))
+
+	for i, spec := range c.Webhooks.URLs {
+		w, err := ParseWebhook(spec)
+		if err != nil {
+			return c.errorf(fmt.Sprintf("$.webhooks.urls[%d]", i), "%v", err)
+		}
+		w.Secret = c.Webhooks.Secret
+		c.opts = append(c.opts, WithWebhooks(w))
+	}
+	return nil
+}
+
+// validateMounts checks the mounts by a trial mount table.
+func (c *Config) validateMounts() error {
+	for i, m := range c.Mounts {
+		if !strings.HasPrefix(m.Prefix, "/") {
+			return c.errorf(fmt.Sprintf("$.mounts[%d].prefix", i), "bad prefix %q", m.Prefix)
+		}
+	}
+	trial := &Mounts{}
+	if err := trial.Set(c.Mounts); err != nil {
+		return c.errorf("$.mounts", "%v", err)
+	}
+	return nil
+}
+
+// Apply sets the auth users and the mounts, on the start or the reload.
+func (c *Config) Apply(users *Users, mounts *Mounts) error {
+	all := map[string]string{"": c.Auth.Token}
+	for user, token := range c.Auth.Users {
+		all[user] = token
+	}
+	if err := mounts.Set(c.Mounts); err != nil {
+		return err
+	}
+	users.Set(all)
+	return nil
+}
+
+// NewServer creates the server routed by the mounts, and its handler authenticated by the users.
+func (c *Config) NewServer(users *Users, mounts *Mounts) (*Server, http.HandlerFunc) {
+	opts := append(append([]ServerOptFn(nil), c.opts...), WithMounts(mounts))
+	s := NewServer(c.Code, c.Cipher, c.chunkSize, c.limitRate, c.Paths, opts...)
+	return s, BearerUsers(users, s.ServeHTTP, c.Auth.Admin)
+}
+
+// DrainTimeout returns the parsed Drain, 0 if not set.
+func (c *Config) DrainTimeout() time.Duration { return c.drainTimeout }
+
+// Reload sets the rate and bandwidth limits, the admission, the quota and the hooks of the server created by NewServer.
+func (c *Config) Reload(s *Server) {
+	s.SetBandwidth(c.bandwidth)
+	s.SetAdmission(c.admission)
+	s.SetQuota(c.quota)
+	s.SetHooks(c.hooks...)
+}
+
+// NeedsRestart tells whether the new configuration changes anything besides the ones of Apply and Reload, and the log level.
+func (c *Config) NeedsRestart(newConfig *Config) bool {
+	strip := func(c *Config) []byte {
+		v := *c
+		v.Auth, v.Mounts = ConfigAuth{Admin: c.Auth.Admin}, nil
+		v.Limits.Rate, v.Limits.Bandwidth, v.Admission, v.Hooks = "", nil, ConfigAdmission{}, nil
+		// the per-user quota needs the usage ledger created on the start
+		v.Quota = ConfigQuota{}
+		if c.quota.UserBytes > 0 {
+			v.Quota.User = "on"
+		}
+		v.Log = logOutput(c.Log)
+		data, _ := json.Marshal(v)
+		return data
+	}
+	return !bytes.Equal(strip(c), strip(newConfig))
+}
+
+// LogLevel returns the level of Log, like debug, "" if not set.
+func (c *Config) LogLevel() string {
+	for _, kv := range strings.Split(c.Log, ",") {
+		if k, v, _ := strings.Cut(strings.TrimSpace(kv), "="); k == "level" {
+			return v
+		}
+	}
+	return ""
+}
+
+// logOutput returns the golog spec without the level.
+func logOutput(spec string) string {
+	var kvs []string
+	for _, kv := range strings.Split(spec, ",") {
+		if k, _, _ := strings.Cut(strings.TrimSpace(kv), "="); k != "level" {
+			kvs = append(kvs, kv)
+		}
+	}
+	return strings.Join(kvs, ",")
+}
@@ -0,0 +1,99 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "goup.yaml")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConfigErrors(t *testing.T) {
+	for content, want := range map[string]string{
+		"listen: [\":2110\"]\nquota:\n  total: 10XB\n":        "goup.yaml:3: $.quota.total: bad size",
+		"limits:\n  chunkSize: 1MiB\n  rates: 1MiB\n":         "[3:3] unknown field \"rates\"",
+		"mounts:\n  - prefix: /a\n  - prefix: pub\n":          "goup.yaml:3: $.mounts[1].prefix: bad prefix",
+		"janitor:\n  retentions:\n    - prefix=tmp/,age=1x\n": "goup.yaml:3: $.janitor.retentions[0]",
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, content)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("config %q: unexpected error %v, want %s", content, err, want)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	root := setupTestRoot(t)
+	_ = os.MkdirAll(filepath.Join(root, "in"), 0o755)
+	_ = os.WriteFile(filepath.Join(root, "in", "a.txt"), []byte("aaa"), 0o644)
+
+	file := writeTestConfig(t, `
+auth:
+  users: {alice: t1}
+limits: {chunkSize: 64KiB}
+`)
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, mounts := NewUsers(nil), &Mounts{}
+	if err := cfg.Apply(users, mounts); err != nil {
+		t.Fatal(err)
+	}
+	s, handler := cfg.NewServer(users, mounts)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	ctx := context.Background()
+	alice, _ := New(ts.URL, WithBearer("t1"))
+	bob, _ := New(ts.URL, WithBearer("t2"))
+	var se *StatusCodeError
+	if _, err := bob.Stat(ctx, "in/a.txt"); !errors.As(err, &se) || se.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", err)
+	}
+	if _, err := alice.Stat(ctx, "in/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = os.WriteFile(file, []byte(`
+auth:
+  users: {alice: t1, bob: t2}
+mounts:
+  - {prefix: /in, uploadOnly: true}
+limits: {chunkSize: 64KiB, rate: 10MiB}
+admission: {global: 4}
+quota: {maxFileSize: 1KiB}
+log: level=debug
+`), 0o644)
+	newCfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newCfg.Apply(users, mounts); err != nil {
+		t.Fatal(err)
+	}
+	newCfg.Reload(s)
+	if cfg.NeedsRestart(newCfg) {
+		t.Fatal("unexpected restart for the users, the mounts, the limits, the quota and the log level")
+	}
+	r, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(strings.Repeat("x", 2048)))
+	r.Header.Set("Content-Gulp", "Filename=b.txt")
+	r.Header.Set(Authorization, "Bearer t1")
+	if rsp, err := http.DefaultClient.Do(r); err != nil || rsp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 of the reloaded quota, got %v %v", rsp, err)
+	}
+	if _, err := bob.Stat(ctx, "in/a.txt"); !errors.As(err, &se) || se.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", err)
+	}
+}
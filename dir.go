@@ -0,0 +1,177 @@
+package goup
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+
+	"go.uber.org/multierr"
+)
+
+// dirFile is a file to upload in a directory.
+type dirFile struct {
+	FullPath string
+	Name     string // slash separated path relative to the parent of the directory
+	Size     uint64
+}
+
+// matchAny tells whether the slash separated relative path or its base name matches any of the glob patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// walkDir walks the directory, and returns the files to upload filtered by Includes and Excludes.
+func (c *Client) walkDir(dir string) (files []dirFile, err error) {
+	prefix := c.Rename
+	if prefix == "" {
+		prefix = filepath.Base(filepath.Clean(dir))
+	}
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if matchAny(c.Excludes, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		if len(c.Includes) > 0 && !matchAny(c.Includes, rel) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, dirFile{FullPath: p, Name: path.Join(prefix, rel), Size: uint64(info.Size())})
+		return nil
+	})
+
+	return files, err
+}
+
+// fork creates a client to upload the file in the directory,
+// which shares the session, the context and the pause state with c.
+func (c *Client) fork(f dirFile) *Client {
+	opt := *c.Opt
+	opt.FullPath = f.FullPath
+	opt.Rename = f.Name
+	opt.Progress = &addOnlyProgress{Adder: c.Progress}
+
+	return &Client{
+		Opt:                &opt,
+		url:                c.url,
+		ID:                 c.ID,
+		contentDisposition: mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}),
+		sessionKey:         c.sessionKey,
+		LimitRate:          c.LimitRate,
+		ctx:                c.ctx,
+		cancel:             c.cancel,
+		gate:               c.gate,
+		stats:              c.stats,
+	}
+}
+
+// initUploadDir uploads the files in the directory recursively with their relative paths,
+// every file is uploaded by chunks, so it can be resumed at chunk level.
+func (c *Client) initUploadDir() error {
+	dir := c.FullPath
+	files, err := c.walkDir(dir)
+	if err != nil {
+		return fmt.Errorf("walk dir %s: %w", dir, err)
+	}
+
+	c.TotalSize = 0
+	for _, f := range files {
+		c.TotalSize += f.Size
+	}
+
+	log.Printf("Upload %s started: %v, %d files", c.ID, dir, len(files))
+	defer log.Printf("Upload %s complete: %v", c.ID, dir)
+
+	c.Progress.Start(c.TotalSize)
+	defer c.Progress.Finish()
+
+	for _, f := range files {
+		if err = multierr.Append(err, c.fork(f).uploadFile()); c.ctx.Err() != nil {
+			return c.ctx.Err()
+		}
+	}
+
+	return err
+}
+
+func (c *Client) uploadFile() error {
+	if c.ChunkSize > 0 {
+		return c.initUpload()
+	}
+
+	r, err := CreateChunkReader(c.FullPath, 0, 0, c.LimitRate, c.onWait())
+	if err != nil {
+		return err
+	}
+	defer Close(r)
+
+	if err := c.uploadBody(r); err != nil {
+		return err
+	}
+
+	log.Printf("Upload %s complete: %v", c.ID, c.FullPath)
+	return nil
+}
+
+// uploadBody uploads the whole reader as the request body with the name of Rename.
+func (c *Client) uploadBody(r io.Reader) error {
+	q, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, &PbReader{Reader: r, Adder: c.Progress})
+	if err != nil {
+		return err
+	}
+	q = withEndpoint(q, "body")
+	q.Header.Set(Authorization, c.Bearer)
+	q.Header.Set("Content-Gulp", "Filename="+url.QueryEscape(c.Rename))
+	c.setMeta(q)
+	rsp, err := c.Client.Do(q)
+	if err != nil {
+		return err
+	}
+	defer Close(rsp.Body)
+
+	if rsp.StatusCode != http.StatusOK {
+		return newStatusCodeError(rsp)
+	}
+
+	return nil
+}
+
+// addOnlyProgress forwards Add only, the Start and Finish are done by the aggregate progress.
+type addOnlyProgress struct {
+	Adder
+}
+
+func (addOnlyProgress) Start(uint64) {}
+func (addOnlyProgress) Finish()      {}
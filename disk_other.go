@@ -0,0 +1,6 @@
+//go:build !linux && !darwin
+
+package goup
+
+// diskFree returns -1 for the unknown free bytes on the other platforms.
+func diskFree(string) int64 { return -1 }
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package goup
+
+import "syscall"
+
+// diskFree returns the free bytes of the disk of the path for the unprivileged users, -1 if unknown.
+func diskFree(path string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
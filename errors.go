@@ -0,0 +1,124 @@
+package goup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChunkError is the failure of a chunk transfer.
+type ChunkError struct {
+	Index uint64
+	From  uint64
+	To    uint64
+	Err   error
+}
+
+func (e ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d bytes %d-%d: %v", e.Index+1, e.From, e.To, e.Err)
+}
+
+func (e ChunkError) Unwrap() error { return e.Err }
+
+// TransferError is the error of a transfer which has failed chunks.
+type TransferError struct {
+	Operation string
+	FullPath  string
+	Chunks    []ChunkError
+}
+
+func (e *TransferError) Error() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%s %s failed, %d chunks failed", e.Operation, e.FullPath, len(e.Chunks))
+	for _, c := range e.Chunks {
+		b.WriteString("; ")
+		b.WriteString(c.Error())
+	}
+	return b.String()
+}
+
+// Is tells whether any of the failed chunks matches the target, for errors.Is before Go 1.20 unwraps multiple errors.
+func (e *TransferError) Is(target error) bool {
+	for _, c := range e.Chunks {
+		if errors.Is(c, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the failed chunks that matches the target, for errors.As like Is.
+func (e *TransferError) As(target interface{}) bool {
+	for _, c := range e.Chunks {
+		if errors.As(c, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) newChunkError(i uint64, err error) ChunkError {
+	cr := newChunkRange(i, c.ChunkSize, GetPartSize(c.TotalSize, c.ChunkSize, i), c.TotalSize)
+	return ChunkError{Index: i, From: cr.From, To: cr.To, Err: err}
+}
+
+// StatusCodeError is the error of an unexpected http response status code.
+type StatusCodeError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the Retry-After of the response, 0 if absent.
+	RetryAfter time.Duration
+}
+
+func (e *StatusCodeError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("bad status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("bad status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// ErrUnknownSession is the error of a chunk refused because the server does not know the session key,
+// like after a restart, the client negotiates the key again and retries the chunk.
+var ErrUnknownSession = errors.New("unknown session")
+
+// Is tells that the 413 and 507 responses are ErrQuotaExceeded,
+// and the 403 responses of the unknown session are ErrUnknownSession.
+func (e *StatusCodeError) Is(target error) bool {
+	switch target {
+	case ErrQuotaExceeded:
+		return e.StatusCode == http.StatusRequestEntityTooLarge || e.StatusCode == http.StatusInsufficientStorage
+	case ErrUnknownSession:
+		return e.StatusCode == http.StatusForbidden && strings.HasPrefix(e.Body, ErrUnknownSession.Error())
+	}
+	return false
+}
+
+// newStatusCodeError returns the StatusCodeError of the response with the leading body as the message.
+func newStatusCodeError(q *http.Response) *StatusCodeError {
+	body, _ := io.ReadAll(io.LimitReader(q.Body, 1024))
+	return &StatusCodeError{StatusCode: q.StatusCode, Body: strings.TrimSpace(string(body)), RetryAfter: parseRetryAfter(q.Header)}
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or the http date.
+func parseRetryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
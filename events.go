@@ -0,0 +1,200 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of the progress event.
+type EventType string
+
+const (
+	// EventChunkQueued means the chunk is queued to transfer.
+	EventChunkQueued EventType = "queued"
+	// EventChunkSkipped means the chunk is identical on both sides by checksum, and it is not transferred.
+	EventChunkSkipped EventType = "skipped"
+	// EventChunkStarted means an attempt of the chunk transfer is started.
+	EventChunkStarted EventType = "started"
+	// EventChunkRetried means the chunk is retried after the failure Err.
+	EventChunkRetried EventType = "retried"
+	// EventChunkCompleted means the chunk is transferred.
+	EventChunkCompleted EventType = "completed"
+	// EventChunkFailed means the chunk is failed after all attempts.
+	EventChunkFailed EventType = "failed"
+)
+
+// ProgressEvent is the event of a chunk lifecycle, with the aggregated stats of the transfer.
+type ProgressEvent struct {
+	Type    EventType
+	Index   uint64
+	From    uint64
+	To      uint64
+	Attempt int
+	Err     error
+	Stats   Stats
+}
+
+// EventListener listens the progress events, it must be safe for concurrent use.
+type EventListener func(e ProgressEvent)
+
+// WithEventListener set EventListener.
+func WithEventListener(v EventListener) OptFn { return func(c *Opt) { c.EventListener = v } }
+
+// Stats is the aggregated stats of a transfer.
+type Stats struct {
+	TotalSize uint64
+	// Done is the plaintext bytes of the chunks transferred or skipped.
+	Done uint64
+	// Transferred is the bytes actually sent or received.
+	Transferred uint64
+	// Skipped is the bytes skipped by the checksum matches.
+	Skipped uint64
+	// RetriedChunks is the number of chunks needed more than one attempt.
+	RetriedChunks uint64
+	Retries       uint64
+	Elapsed       time.Duration
+	// Speed is the average transferred bytes per second.
+	Speed float64
+	// ETA is the estimated time to finish, 0 for unknown.
+	ETA time.Duration
+}
+
+// transferStats collects the stats of a transfer, it is also a Progress wrapper counting the bytes.
+type transferStats struct {
+	Progress
+	start         time.Time
+	end           int64 // unix nano when finished, 0 when running
+	total         uint64
+	done          uint64
+	skipped       uint64
+	retries       uint64
+	retriedChunks uint64
+	// chunked is 1 when the transfer is by chunks, then done counts the plaintext of the completed chunks,
+	// instead of the bytes moved, which include the encryption overhead and the failed attempts.
+	chunked uint32
+}
+
+func (s *transferStats) Start(value uint64) {
+	atomic.StoreUint64(&s.total, value)
+	s.Progress.Start(value)
+}
+
+func (s *transferStats) Add(value uint64) {
+	if atomic.LoadUint32(&s.chunked) == 0 {
+		atomic.AddUint64(&s.done, value)
+	}
+	s.Progress.Add(value)
+}
+
+// complete counts the plaintext size of the chunk transferred.
+func (s *transferStats) complete(value uint64) {
+	atomic.AddUint64(&s.done, value)
+}
+
+func (s *transferStats) skip(value uint64) {
+	atomic.AddUint64(&s.skipped, value)
+	atomic.AddUint64(&s.done, value)
+	s.Progress.Add(value)
+}
+
+func (s *transferStats) reset() {
+	s.start = time.Now()
+	atomic.StoreUint64(&s.total, 0)
+	atomic.StoreUint64(&s.done, 0)
+	atomic.StoreUint64(&s.skipped, 0)
+	atomic.StoreUint64(&s.retries, 0)
+	atomic.StoreUint64(&s.retriedChunks, 0)
+	atomic.StoreInt64(&s.end, 0)
+	atomic.StoreUint32(&s.chunked, 0)
+}
+
+func (s *transferStats) finish() { atomic.StoreInt64(&s.end, time.Now().UnixNano()) }
+
+func (s *transferStats) snapshot() Stats {
+	totalSize := atomic.LoadUint64(&s.total)
+	done, skipped := atomic.LoadUint64(&s.done), atomic.LoadUint64(&s.skipped)
+	end := time.Now()
+	if n := atomic.LoadInt64(&s.end); n > 0 {
+		end = time.Unix(0, n)
+	}
+	st := Stats{
+		TotalSize:     totalSize,
+		Done:          done,
+		Transferred:   done - skipped,
+		Skipped:       skipped,
+		RetriedChunks: atomic.LoadUint64(&s.retriedChunks),
+		Retries:       atomic.LoadUint64(&s.retries),
+		Elapsed:       end.Sub(s.start),
+	}
+	if secs := st.Elapsed.Seconds(); secs > 0 {
+		st.Speed = float64(st.Transferred) / secs
+	}
+	if st.Speed > 0 && totalSize > done {
+		st.ETA = time.Duration(float64(totalSize-done) / st.Speed * float64(time.Second))
+	}
+	return st
+}
+
+// Stats returns the aggregated stats of the running or finished transfer.
+func (c *Client) Stats() Stats { return c.stats.snapshot() }
+
+func (c *Client) emit(t EventType, i uint64, cr *chunkRange, attempt int, err error) {
+	if c.EventListener == nil {
+		return
+	}
+
+	e := ProgressEvent{Type: t, Index: i, Attempt: attempt, Err: err, Stats: c.Stats()}
+	if cr != nil {
+		e.From, e.To = cr.From, cr.To
+	}
+	c.EventListener(e)
+}
+
+// errChunkSkipped is returned by the chunk jobs when the chunk is identical on both sides.
+var errChunkSkipped = errors.New("chunk skipped")
+
+func (c *Client) skipChunk(partSize uint64) error {
+	c.stats.skip(partSize)
+	return errChunkSkipped
+}
+
+// transferChunk runs the chunk job with retrying, and emits the chunk events.
+func (c *Client) transferChunk(i uint64, cr *chunkRange, job func(ctx context.Context, i uint64) error) error {
+	atomic.StoreUint32(&c.stats.chunked, 1)
+	attempt := 0
+	var lastErr error
+	err := retryJob(c.ctx, c.RetryPolicy, func() error {
+		if attempt++; attempt > 1 {
+			atomic.AddUint64(&c.stats.retries, 1)
+			c.emit(EventChunkRetried, i, cr, attempt, lastErr)
+		}
+		c.emit(EventChunkStarted, i, cr, attempt, nil)
+
+		lastErr = c.runChunk(c.watchStall(job), i)
+		switch {
+		case errors.Is(lastErr, errChunkSkipped):
+			c.Metrics.IncChunk(ChunkSkipped)
+			c.emit(EventChunkSkipped, i, cr, attempt, nil)
+			return nil
+		case lastErr == nil:
+			c.stats.complete(cr.PartSize)
+			c.Metrics.IncChunk(ChunkWritten)
+			c.emit(EventChunkCompleted, i, cr, attempt, nil)
+		}
+		return lastErr
+	})
+
+	if attempt > 1 {
+		atomic.AddUint64(&c.stats.retriedChunks, 1)
+	}
+	if err != nil && c.ctx.Err() == nil {
+		c.emit(EventChunkFailed, i, cr, attempt, err)
+	}
+	return err
+}
+
+func (c *Client) chunkRange(i uint64) *chunkRange {
+	return newChunkRange(i, c.ChunkSize, GetPartSize(c.TotalSize, c.ChunkSize, i), c.TotalSize)
+}
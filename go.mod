@@ -12,6 +12,7 @@ require (
 	github.com/schollz/pake/v3 v3.0.5
 	github.com/schollz/progressbar/v3 v3.14.1
 	github.com/segmentio/ksuid v1.0.4
+	github.com/sirupsen/logrus v1.9.3
 	github.com/vthiery/retry v0.1.0
 	go.uber.org/multierr v1.11.0
 	golang.org/x/crypto v0.15.0
@@ -28,7 +29,6 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/tscholl2/siec v0.0.0-20210707234609-9bdfc483d499 // indirect
 	golang.org/x/sys v0.14.0 // indirect
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
@@ -0,0 +1,304 @@
+package goup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/shellwords"
+)
+
+// HookEvent is the event passed to the hooks when an upload completes.
+type HookEvent struct {
+	// FullPath is the local path of the uploaded file on the server, empty if the storage is not local.
+	FullPath string
+	// Name is the path relative to the root of the storage.
+	Name     string
+	Identity string
+	// Hash is the hex encoded SHA-256 of the uploaded file.
+	Hash string
+	Size int64
+}
+
+// HookFunc is a func prototype which handles a completed upload.
+type HookFunc func(ctx context.Context, e HookEvent) error
+
+// HookFailAction is the action taken when a hook fails.
+type HookFailAction string
+
+const (
+	// HookReject removes the uploaded file and rejects the upload.
+	HookReject HookFailAction = "reject"
+	// HookQuarantine moves the uploaded file to the quarantine directory and rejects the upload.
+	HookQuarantine HookFailAction = "quarantine"
+	// HookIgnore only logs the failure.
+	HookIgnore HookFailAction = "ignore"
+)
+
+// DefaultHookTimeout is the default time limit of the hooks parsed by ParseHook.
+const DefaultHookTimeout = 10 * time.Minute
+
+// Hook is a post-upload hook, like a virus scanner, a format validator or a downstream job trigger.
+type Hook struct {
+	Name string
+	Func HookFunc
+	// OnFailure is the action when Func fails, default HookReject.
+	OnFailure HookFailAction
+	// Async runs the hook in the background, its failure is only logged.
+	Async bool
+	// Timeout limits the running time of the hook, 0 for no limit.
+	Timeout time.Duration
+}
+
+// CommandHook creates a HookFunc which runs an external command.
+// The placeholders {path}, {name}, {identity}, {hash} and {size} in the command line are replaced
+// by the event's values, and they are also passed by the environments GOUP_PATH, GOUP_NAME,
+// GOUP_IDENTITY, GOUP_HASH and GOUP_SIZE. A non-zero exit status means failure.
+func CommandHook(command string) (HookFunc, error) {
+	args, err := shellwords.Parse(command)
+	if err != nil {
+		return nil, fmt.Errorf("parse command %s: %w", command, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	return func(ctx context.Context, e HookEvent) error {
+		size := strconv.FormatInt(e.Size, 10)
+		replacer := strings.NewReplacer("{path}", e.FullPath, "{name}", e.Name,
+			"{identity}", e.Identity, "{hash}", e.Hash, "{size}", size)
+		cmdArgs := make([]string, len(args))
+		for i, arg := range args {
+			cmdArgs[i] = replacer.Replace(arg)
+		}
+
+		cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+		cmd.Env = append(os.Environ(), "GOUP_PATH="+e.FullPath, "GOUP_NAME="+e.Name,
+			"GOUP_IDENTITY="+e.Identity, "GOUP_HASH="+e.Hash, "GOUP_SIZE="+size)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("run %s: %w, output: %s", command, err, bytesTrim(out))
+		}
+		return nil
+	}, nil
+}
+
+// ParseHook parses the hook spec like `[reject|quarantine|ignore|async][,timeout=5m]:command args...`,
+// the timeout is DefaultHookTimeout if not set, timeout=0 for no limit.
+func ParseHook(spec string) (Hook, error) {
+	h := Hook{Name: spec, OnFailure: HookReject, Timeout: DefaultHookTimeout}
+	if flags, command, ok := strings.Cut(spec, ":"); ok {
+		// the flags are all known, or else the colon is a part of the command
+		f := h
+		for _, flag := range strings.Split(flags, ",") {
+			switch a := HookFailAction(flag); {
+			case a == HookReject, a == HookQuarantine, a == HookIgnore:
+				f.OnFailure = a
+			case flag == "async":
+				f.Async = true
+			case strings.HasPrefix(flag, "timeout="):
+				d, err := time.ParseDuration(flag[len("timeout="):])
+				if err != nil {
+					return h, fmt.Errorf("parse hook %s: %w", spec, err)
+				}
+				f.Timeout = d
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			h, spec = f, command
+		}
+	}
+
+	f, err := CommandHook(spec)
+	if err != nil {
+		return h, err
+	}
+
+	h.Func = f
+	return h, nil
+}
+
+func bytesTrim(b []byte) string {
+	const maxLen = 1024
+	s := strings.TrimSpace(string(b))
+	if len(s) > maxLen {
+		s = s[:maxLen] + "..."
+	}
+	return s
+}
+
+// ErrHookRejected is the error when a hook rejects the uploaded file.
+var ErrHookRejected = errors.New("upload rejected by hook")
+
+// complete runs the hooks on the completely uploaded file, saves its metadata, and commits it to the storage.
+func (o *ServerOpt) complete(r *http.Request, name string) error {
+	identity := Identity(r)
+	o.janitor.completed(name)
+	unmarkPartial(o.Storage, name)
+	// the hooks are not bound to the request, which may be aborted by the client, their Timeout limits them
+	if err := o.runHooks(context.Background(), name, identity); err != nil {
+		o.used.update(name) // deleted or quarantined
+		return err
+	}
+	if err := o.writeMeta(r, name); err != nil {
+		return err
+	}
+	if o.usage != nil {
+		if info, err := o.Storage.Stat(name); err == nil {
+			o.usage.record(name, identity, info.Size)
+		}
+	}
+	if c, ok := o.Storage.(StorageCommitter); ok {
+		if err := c.Commit(name); err != nil {
+			return err
+		}
+	}
+	o.used.update(name)
+	if o.webhooks != nil {
+		o.webhooks.emit(o.fileEvent(EventUpload, name, identity))
+	}
+	return nil
+}
+
+// SetHooks replaces the hooks without restart, the uploads completing meanwhile run the old ones.
+func (s *Server) SetHooks(hooks ...Hook) {
+	s.opt.mu.Lock()
+	s.opt.Hooks = hooks
+	s.opt.mu.Unlock()
+}
+
+func (o *ServerOpt) hooks() []Hook {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.Hooks
+}
+
+// runHooks runs the hooks on the completed upload file.
+// It returns an error with http.StatusUnprocessableEntity when the file is rejected or quarantined.
+func (o *ServerOpt) runHooks(ctx context.Context, name, identity string) error {
+	hooks := o.hooks()
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	e, err := o.newHookEvent(name, identity)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		if h.Async {
+			go func(h Hook) {
+				if err := h.run(context.Background(), e); err != nil {
+					log.Printf("E! async hook %s on %s failed: %v", h.Name, e.Name, err)
+				}
+			}(h)
+			continue
+		}
+
+		err := h.run(ctx, e)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("E! hook %s on %s failed: %v", h.Name, e.Name, err)
+		switch h.OnFailure {
+		case HookIgnore:
+			continue
+		case HookQuarantine:
+			if qe := o.quarantine(e); qe != nil {
+				log.Printf("E! quarantine %s failed: %v", e.Name, qe)
+			}
+		default:
+			if re := o.Storage.Delete(e.Name); re != nil {
+				log.Printf("E! remove %s failed: %v", e.Name, re)
+			}
+		}
+
+		return &statusError{Code: http.StatusUnprocessableEntity, Err: fmt.Errorf("%w: %s: %v", ErrHookRejected, h.Name, err)}
+	}
+
+	return nil
+}
+
+func (h Hook) run(ctx context.Context, e HookEvent) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	return h.Func(ctx, e)
+}
+
+// quarantine moves the local file to QuarantineDir,
+// or to the .goup-quarantine directory in the storage if the file is not local.
+func (o *ServerOpt) quarantine(e HookEvent) error {
+	base := time.Now().Format("20060102150405.") + path.Base(e.Name)
+	if e.FullPath == "" {
+		target := ".goup-quarantine/" + base
+		log.Printf("quarantine %s to %s in the storage", e.Name, target)
+		return o.Storage.Rename(e.Name, target)
+	}
+
+	if err := ensureDir(o.QuarantineDir); err != nil {
+		return err
+	}
+	target := filepath.Join(o.QuarantineDir, base)
+	log.Printf("quarantine %s to %s", e.FullPath, target)
+	return os.Rename(e.FullPath, target)
+}
+
+func (o *ServerOpt) newHookEvent(name, identity string) (HookEvent, error) {
+	hash, size, err := cachedHash(o.Storage, name)
+	if err != nil {
+		return HookEvent{}, fmt.Errorf("hash file %s error: %w", name, err)
+	}
+
+	e := HookEvent{Name: name, Identity: identity, Hash: hash, Size: size}
+	if lp, ok := o.Storage.(LocalPather); ok {
+		e.FullPath, _ = lp.LocalPath(name)
+	}
+	return e, nil
+}
+
+// fileHash returns the hex encoded SHA-256 and the size of the file.
+func fileHash(fullPath string) (string, int64, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("open file %s error: %w", fullPath, err)
+	}
+	defer Close(f)
+
+	hash, n, err := hashReaderN(f)
+	if err != nil {
+		return "", 0, fmt.Errorf("read file %s error: %w", fullPath, err)
+	}
+	return hash, n, nil
+}
+
+// hashReaderN returns the hex encoded SHA-256 and the size of the reader.
+func hashReaderN(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,179 @@
+package goup
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setupTestRoot(t *testing.T) string {
+	t.Helper()
+	old := RootDir
+	RootDir = filepath.Join(t.TempDir(), ".goup")
+	t.Cleanup(func() { RootDir = old })
+	if err := InitServer(); err != nil {
+		t.Fatal(err)
+	}
+	return RootDir
+}
+
+func writeTestFile(t *testing.T, size int) string {
+	t.Helper()
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	p := filepath.Join(t.TempDir(), "src.bin")
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHookOnChunkedUpload(t *testing.T) {
+	root := setupTestRoot(t)
+	src := writeTestFile(t, 3*64*1024+100)
+
+	var events []HookEvent
+	accept := Hook{Name: "record", Func: func(_ context.Context, e HookEvent) error {
+		events = append(events, e)
+		return nil
+	}}
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil, WithHooks(accept)))
+	defer ts.Close()
+
+	c, err := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Name != "src.bin" || events[0].Size != 3*64*1024+100 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if want, _, _ := fileHash(src); events[0].Hash != want {
+		t.Fatalf("hash mismatch: %s != %s", events[0].Hash, want)
+	}
+
+	// the same file again, all chunks are skipped by checksum, but the hook is still run.
+	c, _ = New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "src.bin")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHookReject(t *testing.T) {
+	root := setupTestRoot(t)
+	src := writeTestFile(t, 100)
+
+	reject, err := ParseHook("false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(ServerHandle("code", "", 0, 0, nil, WithHooks(reject)))
+	defer ts.Close()
+
+	f, _ := os.Open(src)
+	defer f.Close()
+	r, _ := http.NewRequest(http.MethodPost, ts.URL, f)
+	r.Header.Set("Content-Gulp", "Filename=rejected.bin")
+	rsp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rsp.StatusCode)
+	}
+	if !fileNotExists(filepath.Join(root, "rejected.bin")) {
+		t.Fatal("rejected file should be removed")
+	}
+}
+
+func TestHookClientAborted(t *testing.T) {
+	root := setupTestRoot(t)
+	src := writeTestFile(t, 2*64*1024)
+
+	var runs int32
+	started := make(chan struct{}, 1)
+	slow := Hook{Name: "slow", Func: func(ctx context.Context, e HookEvent) error {
+		atomic.AddInt32(&runs, 1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		select {
+		case <-time.After(300 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+	h := ServerHandle("code", "", 64*1024, 0, nil, WithHooks(slow))
+	var aborted int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gulp := ParseHeader(r.Header.Get("Content-Gulp"))
+		if gulp.Salt == "" || !strings.HasPrefix(gulp.Range, "bytes 65536-") || !atomic.CompareAndSwapInt32(&aborted, 0, 1) {
+			h(w, r)
+			return
+		}
+		// the client gives up the completing chunk while the hook runs, and retries it
+		ctx, cancel := context.WithCancel(r.Context())
+		go func() {
+			<-started
+			cancel()
+		}()
+		h(httptest.NewRecorder(), r.WithContext(ctx))
+		http.Error(w, "aborted", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"),
+		WithRetryPolicy(RetryPolicy{MinWait: time.Millisecond}))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&aborted) != 1 || atomic.LoadInt32(&runs) != 1 {
+		t.Fatalf("unexpected aborted %d, hook runs %d", aborted, runs)
+	}
+	want, _, _ := fileHash(src)
+	if got, _, err := fileHash(filepath.Join(root, "src.bin")); err != nil || got != want {
+		t.Fatalf("uploaded file differs: %v", err)
+	}
+}
+
+func TestParseHookTimeout(t *testing.T) {
+	for spec, want := range map[string]Hook{
+		"true":                                  {OnFailure: HookReject, Timeout: DefaultHookTimeout},
+		"quarantine,timeout=1m:clamscan {path}": {OnFailure: HookQuarantine, Timeout: time.Minute},
+		"async,timeout=0:true":                  {OnFailure: HookReject, Async: true},
+		"echo a:b":                              {OnFailure: HookReject, Timeout: DefaultHookTimeout},
+	} {
+		h, err := ParseHook(spec)
+		if err != nil || h.OnFailure != want.OnFailure || h.Async != want.Async || h.Timeout != want.Timeout {
+			t.Fatalf("ParseHook(%s) = %+v, %v", spec, h, err)
+		}
+	}
+
+	h, _ := ParseHook("timeout=100ms:sleep 5")
+	start := time.Now()
+	if err := h.run(context.Background(), HookEvent{}); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 3*time.Second {
+		t.Fatalf("expected the hook timed out, got %v after %s", err, time.Since(start))
+	}
+}
@@ -0,0 +1,291 @@
+package goup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Janitor deletes the stale partial uploads and the expired files periodically.
+type Janitor struct {
+	// Interval is the period of the runs, default 10m.
+	Interval time.Duration
+	// PartialTTL deletes the incomplete uploads idle longer than it, 0 to keep them.
+	PartialTTL time.Duration
+	// Retentions expire the completed files, the first one whose prefix matches the path applies.
+	Retentions []Retention
+	// DryRun only logs the files to delete.
+	DryRun bool
+	// StateFile keeps the incomplete uploads and the last access times across restarts,
+	// default .goup-janitor.json beside RootDir.
+	StateFile string
+}
+
+// Retention expires the completed files whose paths have the prefix, the zero durations for no limits.
+type Retention struct {
+	Prefix string
+	// MaxAge is the max duration since the last modification.
+	MaxAge time.Duration
+	// MaxIdle is the max duration since the last download, or the last modification if never downloaded.
+	MaxIdle time.Duration
+}
+
+// WithJanitor set Janitor.
+func WithJanitor(v Janitor) ServerOptFn { return func(o *ServerOpt) { o.Janitor = v } }
+
+// ParseRetention parses the retention spec, like prefix=logs/,age=720h,idle=168h.
+func ParseRetention(spec string) (r Retention, err error) {
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		switch k {
+		case "prefix":
+			r.Prefix = strings.TrimPrefix(v, "/")
+		case "age":
+			r.MaxAge, err = time.ParseDuration(v)
+		case "idle":
+			r.MaxIdle, err = time.ParseDuration(v)
+		default:
+			return r, fmt.Errorf("unknown retention key %q in %s", k, spec)
+		}
+		if err != nil {
+			return r, fmt.Errorf("parse retention %s: %w", spec, err)
+		}
+	}
+	if r.MaxAge <= 0 && r.MaxIdle <= 0 {
+		return r, fmt.Errorf("retention %s has neither age nor idle", spec)
+	}
+	return r, nil
+}
+
+// JanitorItem is a file deleted, or to delete in the dry run, by the janitor.
+type JanitorItem struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Reason  string
+}
+
+type janitorState struct {
+	// Partials are the last update times of the incomplete uploads.
+	Partials map[string]time.Time `json:"partials"`
+	// Accesses are the last download times of the files.
+	Accesses map[string]time.Time `json:"accesses"`
+}
+
+type janitor struct {
+	Janitor
+	sync.Mutex
+	st       Storage
+	state    janitorState
+	webhooks *webhookQueue
+	used     *storageUsage
+}
+
+func newJanitor(j Janitor, st Storage) *janitor {
+	if j.Interval <= 0 {
+		j.Interval = 10 * time.Minute
+	}
+	if j.StateFile == "" {
+		j.StateFile = filepath.Join(filepath.Dir(filepath.Clean(RootDir)), ".goup-janitor.json")
+	}
+
+	t := &janitor{Janitor: j, st: st}
+	data, err := os.ReadFile(j.StateFile)
+	if err == nil {
+		err = json.Unmarshal(data, &t.state)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("E! read janitor state %s failed: %v", j.StateFile, err)
+	}
+	if t.state.Partials == nil {
+		t.state.Partials = map[string]time.Time{}
+	}
+	if t.state.Accesses == nil {
+		t.state.Accesses = map[string]time.Time{}
+	}
+	return t
+}
+
+func (t *janitor) start(done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(t.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.run(time.Now())
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// flush saves the uploads in progress and the last access times on shutdown.
+func (t *janitor) flush() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	for name, s := range uploads.inProgress() {
+		t.state.Partials[name] = s.Updated
+	}
+	t.save()
+}
+
+// accessed records the download of the file.
+func (t *janitor) accessed(name string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	t.state.Accesses[name] = time.Now()
+	t.Unlock()
+}
+
+// completed forgets the incomplete upload of the file.
+func (t *janitor) completed(name string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.state.Partials[name]; ok {
+		delete(t.state.Partials, name)
+		t.save()
+	}
+}
+
+func (t *janitor) save() {
+	data, _ := json.Marshal(t.state)
+	err := ensureDir(filepath.Dir(t.StateFile))
+	if err == nil {
+		err = os.WriteFile(t.StateFile, data, 0o644)
+	}
+	if err != nil {
+		log.Printf("E! write janitor state %s failed: %v", t.StateFile, err)
+	}
+}
+
+// run deletes the stale partial uploads and the expired files, and returns them.
+func (t *janitor) run(now time.Time) []JanitorItem {
+	t.Lock()
+	defer t.Unlock()
+
+	// the uploads in progress since the last run, or the restart
+	for name, s := range uploads.inProgress() {
+		t.state.Partials[name] = s.Updated
+	}
+
+	infos, err := t.st.List("")
+	if err != nil {
+		log.Printf("E! janitor list files failed: %v", err)
+		return nil
+	}
+	// the uploads marked partial in the storage, which are abandoned before the restart without the state
+	marked := map[string]bool{}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name, partialSuffix) {
+			marked[strings.TrimSuffix(info.Name, partialSuffix)] = true
+		}
+	}
+	for _, info := range infos {
+		if _, ok := t.state.Partials[info.Name]; !ok && marked[info.Name] {
+			t.state.Partials[info.Name] = info.ModTime
+		}
+	}
+
+	var items []JanitorItem
+	for _, info := range infos {
+		if isMetaName(info.Name) {
+			continue
+		}
+		if updated, ok := t.state.Partials[info.Name]; ok {
+			if t.PartialTTL > 0 && now.Sub(updated) > t.PartialTTL {
+				items = append(items, JanitorItem{Name: info.Name, Size: info.Size, ModTime: info.ModTime,
+					Reason: fmt.Sprintf("incomplete upload idle since %s", updated.Format(time.RFC3339))})
+			}
+			continue
+		}
+		if reason := t.expired(info, now); reason != "" {
+			items = append(items, JanitorItem{Name: info.Name, Size: info.Size, ModTime: info.ModTime, Reason: reason})
+		}
+	}
+
+	for _, item := range items {
+		if t.DryRun {
+			log.Printf("janitor dry run, would delete %s (%d bytes): %s", item.Name, item.Size, item.Reason)
+			continue
+		}
+		if _, partial := t.state.Partials[item.Name]; partial && !uploads.expire(item.Name, now.Add(-t.PartialTTL)) {
+			continue // resumed just now
+		}
+		if err := t.st.Delete(item.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("E! janitor delete %s failed: %v", item.Name, err)
+			continue
+		}
+		deleteMeta(t.st, item.Name)
+		t.used.update(item.Name)
+		log.Printf("janitor deleted %s (%d bytes): %s", item.Name, item.Size, item.Reason)
+		t.webhooks.emit(WebhookEvent{Type: EventDelete, Path: item.Name, Size: item.Size, ModTime: item.ModTime, Reason: item.Reason})
+		delete(t.state.Partials, item.Name)
+		delete(t.state.Accesses, item.Name)
+	}
+
+	// forgets the deleted and renamed files
+	exists := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		exists[info.Name] = true
+	}
+	for _, m := range []map[string]time.Time{t.state.Partials, t.state.Accesses} {
+		for name := range m {
+			if !exists[name] {
+				delete(m, name)
+			}
+		}
+	}
+	for name := range marked {
+		if !exists[name] && !t.DryRun {
+			unmarkPartial(t.st, name)
+		}
+	}
+
+	t.save()
+	return items
+}
+
+// expired returns the reason if the completed file is expired by the retentions, or else "".
+func (t *janitor) expired(info StorageInfo, now time.Time) string {
+	for _, r := range t.Retentions {
+		if !strings.HasPrefix(info.Name, r.Prefix) {
+			continue
+		}
+		if r.MaxAge > 0 && now.Sub(info.ModTime) > r.MaxAge {
+			return fmt.Sprintf("modified at %s, older than %s", info.ModTime.Format(time.RFC3339), r.MaxAge)
+		}
+		if r.MaxIdle > 0 {
+			last := info.ModTime
+			if accessed := t.state.Accesses[info.Name]; accessed.After(last) {
+				last = accessed
+			}
+			if now.Sub(last) > r.MaxIdle {
+				return fmt.Sprintf("last accessed at %s, idle longer than %s", last.Format(time.RFC3339), r.MaxIdle)
+			}
+		}
+		return ""
+	}
+	return ""
+}
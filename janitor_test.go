@@ -0,0 +1,104 @@
+package goup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	root := setupTestRoot(t)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	for _, name := range []string{"p.bin", "tmp/old.txt", "tmp/new.txt", "keep/a.txt", "keep/b.txt"} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(p), 0o755)
+		_ = os.WriteFile(p, []byte(name), 0o644)
+		if name != "tmp/new.txt" {
+			_ = os.Chtimes(p, old, old)
+		}
+	}
+
+	// p.bin was being uploaded before the restart
+	stateFile := filepath.Join(t.TempDir(), "janitor.json")
+	data, _ := json.Marshal(janitorState{Partials: map[string]time.Time{"p.bin": old}})
+	_ = os.WriteFile(stateFile, data, 0o644)
+
+	j := Janitor{
+		PartialTTL: 24 * time.Hour,
+		Retentions: []Retention{{Prefix: "tmp/", MaxAge: time.Hour}, {Prefix: "keep/", MaxIdle: time.Hour}},
+		DryRun:     true,
+		StateFile:  stateFile,
+	}
+	opt := newServerOpt(WithJanitor(j))
+	opt.janitor.accessed("keep/a.txt")
+
+	want := []string{"keep/b.txt", "p.bin", "tmp/old.txt"}
+	if items := opt.janitor.run(now); len(items) != len(want) {
+		t.Fatalf("unexpected dry run %+v", items)
+	}
+	if _, err := os.Stat(filepath.Join(root, "p.bin")); err != nil {
+		t.Fatal("file deleted in dry run")
+	}
+
+	j.DryRun = false
+	opt = newServerOpt(WithJanitor(j)) // reloads the state
+	opt.janitor.accessed("keep/a.txt")
+	items := opt.janitor.run(now)
+	for i, item := range items {
+		if item.Name != want[i] {
+			t.Fatalf("unexpected deleted %+v", items)
+		}
+		if _, err := os.Stat(filepath.Join(root, item.Name)); !os.IsNotExist(err) {
+			t.Fatalf("file %s not deleted", item.Name)
+		}
+	}
+	for _, name := range []string{"tmp/new.txt", "keep/a.txt"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Fatalf("file %s deleted", name)
+		}
+	}
+}
+
+func TestJanitorPartialWithoutState(t *testing.T) {
+	root := setupTestRoot(t)
+	h := ServerHandle("code", "", 64*1024, 0, nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the upload of p.bin breaks after its first chunk
+		gulp := ParseHeader(r.Header.Get("Content-Gulp"))
+		if strings.Contains(r.Header.Get(ContentDisposition), "p.bin") && gulp.Range != "" && !strings.HasPrefix(gulp.Range, "bytes 0-") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}))
+	defer ts.Close()
+
+	src := writeTestFile(t, 192*1024)
+	for _, name := range []string{"c.bin", "p.bin"} {
+		c, _ := New(ts.URL, WithFullPath(src), WithRename(name), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(1))
+		if err := c.Start(); (err != nil) != (name == "p.bin") {
+			t.Fatalf("upload %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "c.bin.goupart")); !os.IsNotExist(err) {
+		t.Fatalf("completed upload still marked partial: %v", err)
+	}
+
+	uploads.expire("p.bin", time.Now().Add(time.Hour)) // like restarted
+	j := Janitor{PartialTTL: time.Hour, StateFile: filepath.Join(t.TempDir(), "janitor.json")}
+	opt := newServerOpt(WithJanitor(j))
+	if items := opt.janitor.run(time.Now().Add(2 * time.Hour)); len(items) != 1 || items[0].Name != "p.bin" {
+		t.Fatalf("unexpected deleted %+v", items)
+	}
+	for _, name := range []string{"p.bin", "p.bin.goupart"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Fatalf("file %s not deleted", name)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package goup
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/codec/b64"
+)
+
+// NextCursorHeader is the response header of the cursor to the next page of the listing.
+const NextCursorHeader = "X-Next-Cursor"
+
+// Entry is the file item for list.
+type Entry struct {
+	Name string `json:"name"`
+	// Path is the slash separated path relative to the root.
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	IsDir       bool      `json:"isDir,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	// Hash is the hex encoded SHA-256 of the file, only when it is cached on the server.
+	Hash string `json:"hash,omitempty"`
+	// Uploading is true when the file is being uploaded by chunks, Received is the received bytes.
+	Uploading bool   `json:"uploading,omitempty"`
+	Received  uint64 `json:"received,omitempty"`
+	// Meta is the metadata of the uploaded file, nil if it has none.
+	Meta *FileMeta `json:"meta,omitempty"`
+}
+
+// ListQuery is the query of the remote listing.
+type ListQuery struct {
+	// Prefix filters the paths, like x/ for the files in the directory x.
+	Prefix string
+	// NonRecursive lists only the direct children of the directory of Prefix,
+	// the deeper files are collapsed into their directories.
+	NonRecursive bool
+	// Sort is one of path (default), name, size and mtime.
+	Sort string
+	Desc bool
+	// Limit is the max entries of a page, 0 for no limit.
+	Limit int
+	// Cursor is the cursor returned with the previous page.
+	Cursor string
+}
+
+func (q ListQuery) values() url.Values {
+	v := url.Values{}
+	if q.Prefix != "" {
+		v.Set("prefix", q.Prefix)
+	}
+	if q.NonRecursive {
+		v.Set("recursive", "false")
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Desc {
+		v.Set("order", "desc")
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	return v
+}
+
+func parseListQuery(v url.Values) (q ListQuery, err error) {
+	q = ListQuery{
+		Prefix:       strings.TrimPrefix(v.Get("prefix"), "/"),
+		NonRecursive: v.Get("recursive") == "false",
+		Sort:         v.Get("sort"),
+		Desc:         v.Get("order") == "desc",
+		Cursor:       v.Get("cursor"),
+	}
+	if dir := strings.Trim(v.Get("dir"), "/"); dir != "" {
+		q.Prefix = dir + "/"
+	}
+	switch q.Sort {
+	case "", "path", "name", "size", "mtime":
+	default:
+		return q, &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("unknown sort %s", q.Sort)}
+	}
+	if limit := v.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return q, &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("bad limit %s", limit)}
+		}
+	}
+	return q, nil
+}
+
+// listCursor is the position after the last entry of a page.
+type listCursor struct {
+	Path    string    `json:"p"`
+	Size    int64     `json:"s"`
+	ModTime time.Time `json:"t"`
+}
+
+func (c listCursor) entry() *Entry {
+	return &Entry{Name: path.Base(c.Path), Path: c.Path, Size: c.Size, ModTime: c.ModTime}
+}
+
+func encodeCursor(e *Entry) string {
+	data, _ := json.Marshal(listCursor{Path: e.Path, Size: e.Size, ModTime: e.ModTime})
+	return b64.EncodeBytes2String(data, b64.URL, b64.Raw)
+}
+
+func decodeCursor(s string) (*Entry, error) {
+	data, err := b64.DecodeString(s)
+	if err != nil {
+		return nil, &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("bad cursor %s", s)}
+	}
+	var c listCursor
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return nil, &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("bad cursor %s", s)}
+	}
+	return c.entry(), nil
+}
+
+// less orders the entries by the sort field, then by the path, so that the order is total for the cursors.
+func (q ListQuery) less(a, b *Entry) bool {
+	if q.Desc {
+		a, b = b, a
+	}
+	switch q.Sort {
+	case "name":
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	case "size":
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+	case "mtime":
+		if !a.ModTime.Equal(b.ModTime) {
+			return a.ModTime.Before(b.ModTime)
+		}
+	}
+	return a.Path < b.Path
+}
+
+// listEntries lists the entries of the query, and returns the cursor of the next page, "" for the last page.
+func listEntries(opt *ServerOpt, q ListQuery) ([]Entry, string, error) {
+	st := opt.Storage
+	infos, err := st.List(q.Prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	progress := uploads.inProgress()
+	dir := q.Prefix[:strings.LastIndex(q.Prefix, "/")+1]
+	dirs := map[string]int{}
+	metas := map[string]bool{}
+	entries := make([]Entry, 0, len(infos))
+	for _, info := range infos {
+		if isMetaName(info.Name) {
+			metas[strings.TrimSuffix(info.Name, metaSuffix)] = true
+			continue
+		}
+		if !opt.Mounts.listable(info.Name) {
+			continue
+		}
+		if q.NonRecursive {
+			if i := strings.Index(info.Name[len(dir):], "/"); i >= 0 {
+				d := info.Name[:len(dir)+i]
+				j, ok := dirs[d]
+				if !ok {
+					j, dirs[d] = len(entries), len(entries)
+					entries = append(entries, Entry{Name: path.Base(d), Path: d, IsDir: true})
+				}
+				if e := &entries[j]; info.ModTime.After(e.ModTime) {
+					e.ModTime = info.ModTime
+				}
+				entries[j].Size += info.Size
+				continue
+			}
+		}
+
+		e := Entry{
+			Name:        path.Base(info.Name),
+			Path:        info.Name,
+			Size:        info.Size,
+			ModTime:     info.ModTime,
+			ContentType: mime.TypeByExtension(path.Ext(info.Name)),
+			Hash:        hashes.get(info),
+		}
+		if s, ok := progress[info.Name]; ok {
+			e.Uploading, e.Received = true, s.Received
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return q.less(&entries[i], &entries[j]) })
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = entries[sort.Search(len(entries), func(i int) bool { return q.less(c, &entries[i]) }):]
+	}
+	next := ""
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+		next = encodeCursor(&entries[q.Limit-1])
+	}
+	for i, e := range entries {
+		if !e.IsDir && metas[e.Path] {
+			if entries[i].Meta, err = readMeta(st, e.Path); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	return entries, next, nil
+}
+
+func servList(w http.ResponseWriter, r *http.Request, opt *ServerOpt) error {
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		return err
+	}
+	entries, next, err := listEntries(opt, q)
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		w.Header().Set(NextCursorHeader, next)
+	}
+	return WriteJSON(w, entries)
+}
+
+// hashCache caches the hashes of the files, which are valid until the sizes or the modification times change.
+type hashCache struct {
+	sync.Mutex
+	hashes map[string]hashCacheItem
+}
+
+type hashCacheItem struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+var hashes = &hashCache{hashes: map[string]hashCacheItem{}}
+
+func (c *hashCache) get(info StorageInfo) string {
+	c.Lock()
+	defer c.Unlock()
+
+	if v, ok := c.hashes[info.Name]; ok && v.Size == info.Size && v.ModTime.Equal(info.ModTime) {
+		return v.Hash
+	}
+	return ""
+}
+
+func (c *hashCache) put(info StorageInfo, hash string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.hashes[info.Name] = hashCacheItem{Size: info.Size, ModTime: info.ModTime, Hash: hash}
+}
+
+// cachedHash returns the hex encoded SHA-256 and the size of the file, the file is read only when it changed.
+func cachedHash(st Storage, name string) (string, int64, error) {
+	info, err := st.Stat(name)
+	if err != nil {
+		return "", 0, err
+	}
+	if hash := hashes.get(info); hash != "" {
+		return hash, info.Size, nil
+	}
+
+	hash, size, err := storageHash(st, name)
+	if err != nil {
+		return "", 0, err
+	}
+	if size == info.Size {
+		hashes.put(info, hash)
+	}
+	return hash, size, nil
+}
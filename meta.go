@@ -0,0 +1,229 @@
+package goup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/codec/b64"
+)
+
+// MetaHeader is the header of the base64 (URL, raw) encoded JSON FileMeta,
+// sent by the client when uploading, and by the server when downloading.
+const MetaHeader = "X-Goup-Meta"
+
+// metaSuffix is the suffix of the sidecar file keeping the FileMeta beside the file in the storage.
+const metaSuffix = ".goupmeta"
+
+// partialSuffix is the suffix of the sidecar file marking an incomplete upload until it completes,
+// so that the janitor finds the abandoned uploads after a restart.
+const partialSuffix = ".goupart"
+
+// FileMeta is the metadata of an uploaded file.
+type FileMeta struct {
+	// Uploader is the identity of the uploader, set by the server.
+	Uploader string `json:"uploader,omitempty"`
+	// UploadedAt is the time of the upload completion, set by the server.
+	UploadedAt time.Time `json:"uploadedAt"`
+	// OriginalPath is the local path of the file on the client.
+	OriginalPath string `json:"originalPath,omitempty"`
+	// ModTime and Mode are the modification time and the mode of the file on the client.
+	ModTime     time.Time         `json:"modTime"`
+	Mode        fs.FileMode       `json:"mode,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// WithTag adds a custom key=value tag to the uploading file metadata.
+func WithTag(key, value string) OptFn {
+	return func(c *Opt) {
+		if c.Tags == nil {
+			c.Tags = map[string]string{}
+		}
+		c.Tags[key] = value
+	}
+}
+
+// WithRestoreMode set RestoreMode.
+func WithRestoreMode(v bool) OptFn { return func(c *Opt) { c.RestoreMode = v } }
+
+func encodeMeta(m *FileMeta) string {
+	data, _ := json.Marshal(m)
+	return b64.EncodeBytes2String(data, b64.URL, b64.Raw)
+}
+
+func decodeMeta(s string) (*FileMeta, error) {
+	data, err := b64.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var m FileMeta
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// setMeta sets the metadata header of the uploading file.
+func (c *Client) setMeta(r *http.Request) {
+	c.metaOnce.Do(func() {
+		m := &FileMeta{Tags: c.Tags}
+		name := c.Rename
+		if c.Reader == nil && c.FullPath != "" {
+			if stat, err := os.Stat(c.FullPath); err == nil {
+				m.ModTime, m.Mode = stat.ModTime(), stat.Mode()
+			}
+			if abs, err := filepath.Abs(c.FullPath); err == nil {
+				m.OriginalPath = abs
+			}
+			if name == "" {
+				name = c.FullPath
+			}
+		}
+		m.ContentType = mime.TypeByExtension(filepath.Ext(name))
+		c.meta = encodeMeta(m)
+	})
+	r.Header.Set(MetaHeader, c.meta)
+}
+
+// restoreMeta restores the modification time, and the mode if RestoreMode, of the downloaded local file.
+func (c *Client) restoreMeta(header http.Header) {
+	if _, ok := c.sink.(*fileSink); !ok || header.Get(MetaHeader) == "" {
+		return
+	}
+	m, err := decodeMeta(header.Get(MetaHeader))
+	if err != nil {
+		log.Printf("W! decode metadata of %s failed: %v", c.FullPath, err)
+		return
+	}
+
+	if !m.ModTime.IsZero() {
+		if err := os.Chtimes(c.FullPath, time.Now(), m.ModTime); err != nil {
+			log.Printf("W! restore modification time of %s failed: %v", c.FullPath, err)
+		}
+	}
+	if c.RestoreMode && m.Mode != 0 {
+		if err := os.Chmod(c.FullPath, m.Mode.Perm()); err != nil {
+			log.Printf("W! restore mode of %s failed: %v", c.FullPath, err)
+		}
+	}
+}
+
+func metaName(name string) string { return name + metaSuffix }
+
+func partialName(name string) string { return name + partialSuffix }
+
+// isMetaName tells whether the name is of a sidecar file, the metadata or the partial marker.
+func isMetaName(name string) bool {
+	return strings.HasSuffix(name, metaSuffix) || strings.HasSuffix(name, partialSuffix)
+}
+
+// uploadName returns the storage name of the uploading file, the names of the sidecar files are refused,
+// so that a client can't forge the metadata of the other files.
+func uploadName(filename string) (string, error) {
+	name := storageName(filename)
+	if isMetaName(name) {
+		return "", &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("%s is reserved for the metadata", name)}
+	}
+	return name, nil
+}
+
+// markPartial marks the file as an incomplete upload in the storage.
+func markPartial(st Storage, name string) {
+	_, err := writeStorage(st, partialName(name), strings.NewReader(""), nil)
+	if c, ok := st.(StorageCommitter); ok && err == nil {
+		err = c.Commit(partialName(name))
+	}
+	if err != nil {
+		log.Printf("E! mark partial upload %s failed: %v", name, err)
+	}
+}
+
+// unmarkPartial removes the partial marker of the completed file.
+func unmarkPartial(st Storage, name string) {
+	if err := st.Delete(partialName(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("E! unmark partial upload %s failed: %v", name, err)
+	}
+}
+
+// readMeta reads the metadata of the file, nil if it has no metadata.
+func readMeta(st Storage, name string) (*FileMeta, error) {
+	r, err := st.ReadRange(metaName(name), 0, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer Close(r)
+
+	var m FileMeta
+	if err := json.NewDecoder(r).Decode(&m); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("decode metadata of %s: %w", name, err)
+	}
+	return &m, nil
+}
+
+// writeMeta writes the metadata sent in the request with the uploader of the file.
+func (o *ServerOpt) writeMeta(r *http.Request, name string) error {
+	m := &FileMeta{}
+	if v := r.Header.Get(MetaHeader); v != "" {
+		var err error
+		if m, err = decodeMeta(v); err != nil {
+			return &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("decode %s: %w", MetaHeader, err)}
+		}
+	}
+	m.Uploader, m.UploadedAt = Identity(r), time.Now()
+	if m.ContentType == "" {
+		m.ContentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+
+	data, _ := json.Marshal(m)
+	if _, err := writeStorage(o.Storage, metaName(name), strings.NewReader(string(data)), nil); err != nil {
+		return err
+	}
+	if c, ok := o.Storage.(StorageCommitter); ok {
+		return c.Commit(metaName(name))
+	}
+	return nil
+}
+
+// setMetaHeader sets the metadata header of the downloading file.
+func setMetaHeader(w http.ResponseWriter, st Storage, name string) {
+	m, err := readMeta(st, name)
+	if err != nil {
+		log.Printf("E! read metadata of %s failed: %v", name, err)
+	}
+	if m != nil {
+		w.Header().Set(MetaHeader, encodeMeta(m))
+	}
+}
+
+// deleteMeta deletes the metadata and the partial marker of the deleted file.
+func deleteMeta(st Storage, name string) {
+	if err := st.Delete(metaName(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("E! delete metadata of %s failed: %v", name, err)
+	}
+	unmarkPartial(st, name)
+}
+
+// renameMeta moves the metadata and the partial marker of the renamed file.
+func renameMeta(st Storage, name, newName string) {
+	for _, sidecar := range []func(string) string{metaName, partialName} {
+		if _, err := st.Stat(sidecar(name)); err != nil {
+			continue
+		}
+		if err := st.Rename(sidecar(name), sidecar(newName)); err != nil {
+			log.Printf("E! rename metadata of %s failed: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package goup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bingoohuang/goup/shapeio"
+	"github.com/minio/sio"
+)
+
+// The outcomes of the chunks counted by MetricsRecorder.IncChunk.
+const (
+	ChunkWritten       = "written"
+	ChunkSkipped       = "skipped" // 304, identical on both sides
+	ChunkDecryptFailed = "decrypt_failed"
+)
+
+// MetricsRecorder records the transfer counters, it is implemented by Metrics,
+// or by an adapter to another metrics registry.
+type MetricsRecorder interface {
+	// AddBytes adds the HTTP body bytes, direction is in or out.
+	AddBytes(direction string, n int64)
+	// IncChunk counts a chunk by its outcome, like ChunkWritten.
+	IncChunk(outcome string)
+	// ObserveRequest observes the latency of a request of the endpoint type, like upload, with the status code.
+	ObserveRequest(endpoint string, code int, d time.Duration)
+	// IncAuthFailure counts a request rejected by the bearer auth.
+	IncAuthFailure()
+	// ObserveRateLimitWait observes the duration blocked by the rate limit.
+	ObserveRateLimitWait(d time.Duration)
+}
+
+// DefaultMetrics is the metrics of the server, exposed at /metrics by goup.
+var DefaultMetrics = NewMetrics()
+
+func init() {
+	DefaultMetrics.SetGauge("goup_active_sessions", "The PAKE sessions in the cache.", func() float64 {
+		n := 0
+		pakeCache.Range(func(_, _ interface{}) bool { n++; return true })
+		return float64(n)
+	})
+}
+
+// metricsBuckets are the upper bounds in seconds of the latency histograms.
+var metricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics is a MetricsRecorder written in the Prometheus text format.
+type Metrics struct {
+	sync.Mutex
+	bytes     map[string]int64
+	chunks    map[string]int64
+	requests  map[string]int64 // by endpoint and code
+	latencies map[string]*histogram
+	authFails int64
+	waits     histogram
+	gauges    map[string]gauge
+}
+
+type histogram struct {
+	counts []int64 // by metricsBuckets
+	count  int64
+	sum    float64
+}
+
+type gauge struct {
+	help string
+	f    func() float64
+}
+
+// NewMetrics creates a Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		bytes:     map[string]int64{},
+		chunks:    map[string]int64{},
+		requests:  map[string]int64{},
+		latencies: map[string]*histogram{},
+		gauges:    map[string]gauge{},
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(metricsBuckets))
+	}
+	s := d.Seconds()
+	for i, le := range metricsBuckets {
+		if s <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// SetGauge sets the gauge whose value is got by f on every writing.
+func (m *Metrics) SetGauge(name, help string, f func() float64) {
+	m.Lock()
+	m.gauges[name] = gauge{help: help, f: f}
+	m.Unlock()
+}
+
+// AddBytes adds the HTTP body bytes, direction is in or out.
+func (m *Metrics) AddBytes(direction string, n int64) {
+	m.Lock()
+	m.bytes[direction] += n
+	m.Unlock()
+}
+
+// IncChunk counts a chunk by its outcome.
+func (m *Metrics) IncChunk(outcome string) {
+	m.Lock()
+	m.chunks[outcome]++
+	m.Unlock()
+}
+
+// ObserveRequest observes the latency of a request of the endpoint type.
+func (m *Metrics) ObserveRequest(endpoint string, code int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.requests[fmt.Sprintf(`endpoint=%q,code="%d"`, endpoint, code)]++
+	h := m.latencies[endpoint]
+	if h == nil {
+		h = &histogram{}
+		m.latencies[endpoint] = h
+	}
+	h.observe(d)
+}
+
+// IncAuthFailure counts a request rejected by the bearer auth.
+func (m *Metrics) IncAuthFailure() {
+	m.Lock()
+	m.authFails++
+	m.Unlock()
+}
+
+// ObserveRateLimitWait observes the duration blocked by the rate limit.
+func (m *Metrics) ObserveRateLimitWait(d time.Duration) {
+	m.Lock()
+	m.waits.observe(d)
+	m.Unlock()
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	gauges := make(map[string]gauge, len(m.gauges))
+	for k, v := range m.gauges {
+		gauges[k] = v
+	}
+	m.Unlock()
+	values := make(map[string]float64, len(gauges))
+	for name, g := range gauges { // out of the lock, f may be slow
+		values[name] = g.f()
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	var b bytes.Buffer
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	counters := func(name, help, label string, values map[string]int64) {
+		header(name, "counter", help)
+		for _, k := range sortedKeys(values) {
+			fmt.Fprintf(&b, "%s{%s=%q} %d\n", name, label, k, values[k])
+		}
+	}
+	buckets := func(name, labels string, h *histogram) {
+		sep, set := "", ""
+		if labels != "" {
+			sep, set = ",", "{"+labels+"}"
+		}
+		for i, le := range metricsBuckets {
+			fmt.Fprintf(&b, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, le, h.counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+		fmt.Fprintf(&b, "%s_sum%s %g\n%s_count%s %d\n", name, set, h.sum, name, set, h.count)
+	}
+
+	counters("goup_bytes_total", "The HTTP body bytes transferred.", "direction", m.bytes)
+	counters("goup_chunks_total", "The chunks by outcome.", "outcome", m.chunks)
+
+	header("goup_requests_total", "counter", "The requests by endpoint type and status code.")
+	for _, k := range sortedKeys(m.requests) {
+		fmt.Fprintf(&b, "goup_requests_total{%s} %d\n", k, m.requests[k])
+	}
+	header("goup_request_duration_seconds", "histogram", "The request latencies by endpoint type.")
+	for _, k := range sortedKeys(m.latencies) {
+		buckets("goup_request_duration_seconds", fmt.Sprintf("endpoint=%q", k), m.latencies[k])
+	}
+
+	header("goup_auth_failures_total", "counter", "The requests rejected by the bearer auth.")
+	fmt.Fprintf(&b, "goup_auth_failures_total %d\n", m.authFails)
+	header("goup_rate_limit_wait_seconds", "histogram", "The durations blocked by the rate limit.")
+	if m.waits.counts == nil {
+		m.waits.counts = make([]int64, len(metricsBuckets))
+	}
+	buckets("goup_rate_limit_wait_seconds", "", &m.waits)
+
+	for _, name := range sortedKeys(values) {
+		header(name, "gauge", gauges[name].help)
+		fmt.Fprintf(&b, "%s %g\n", name, values[name])
+	}
+
+	return b.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics for the Prometheus scraping.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set(ContentType, "text/plain; version=0.0.4")
+	_, _ = m.WriteTo(w)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// endpointKey is the context key of the endpoint label of the request.
+type endpointKey struct{}
+
+// withEndpoint returns the request labeled by the endpoint, the server relabels it where it routes the request.
+func withEndpoint(r *http.Request, endpoint string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), endpointKey{}, &endpoint))
+}
+
+// setEndpoint sets the endpoint label of the request routed by the server.
+func setEndpoint(r *http.Request, endpoint string) {
+	if p, ok := r.Context().Value(endpointKey{}).(*string); ok {
+		*p = endpoint
+	}
+}
+
+// endpointOf returns the endpoint label of the request, other if not labeled.
+func endpointOf(r *http.Request) string {
+	if p, ok := r.Context().Value(endpointKey{}).(*string); ok {
+		return *p
+	}
+	return "other"
+}
+
+// isDecryptError tells whether the error is of the decryption, like the authentication failure of a wrong key,
+// but not of the reading and the writing.
+func isDecryptError(err error) bool {
+	var se sio.Error
+	return errors.As(err, &se)
+}
+
+// nopMetrics is the MetricsRecorder of the client without WithMetrics.
+type nopMetrics struct{}
+
+func (nopMetrics) AddBytes(string, int64)                    {}
+func (nopMetrics) IncChunk(string)                           {}
+func (nopMetrics) ObserveRequest(string, int, time.Duration) {}
+func (nopMetrics) IncAuthFailure()                           {}
+func (nopMetrics) ObserveRateLimitWait(time.Duration)        {}
+
+// WithMetrics set Metrics, to record the counters of the client, like the server's.
+func WithMetrics(v MetricsRecorder) OptFn { return func(c *Opt) { c.Metrics = v } }
+
+// metricsTransport records the requests of the client.
+type metricsTransport struct {
+	http.RoundTripper
+	MetricsRecorder
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	endpoint := endpointOf(r)
+	if r.Body != nil && r.Body != http.NoBody {
+		r2 := *r // RoundTrip should not modify the request
+		r2.Body = &metricsBody{ReadCloser: r.Body, m: t.MetricsRecorder, direction: "out"}
+		r = &r2
+	}
+	rsp, err := t.RoundTripper.RoundTrip(r)
+	if err != nil {
+		t.ObserveRequest(endpoint, 0, time.Since(start))
+		return rsp, err
+	}
+	t.ObserveRequest(endpoint, rsp.StatusCode, time.Since(start))
+	if rsp.StatusCode == http.StatusUnauthorized {
+		t.IncAuthFailure()
+	}
+	rsp.Body = &metricsBody{ReadCloser: rsp.Body, m: t.MetricsRecorder, direction: "in"}
+	return rsp, nil
+}
+
+// metricsBody adds the bytes read to the metrics on closing.
+type metricsBody struct {
+	io.ReadCloser
+	m         MetricsRecorder
+	direction string
+	n         int64
+}
+
+func (b *metricsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+func (b *metricsBody) Close() error {
+	if n := atomic.SwapInt64(&b.n, 0); n > 0 {
+		b.m.AddBytes(b.direction, n)
+	}
+	return b.ReadCloser.Close()
+}
+
+// instrument wraps the transport of the client by the metrics.
+func instrument(client *http.Client, m MetricsRecorder) *http.Client {
+	c := *client
+	if c.Transport == nil {
+		c.Transport = http.DefaultTransport
+	}
+	c.Transport = &metricsTransport{RoundTripper: c.Transport, MetricsRecorder: m}
+	return &c
+}
+
+// onWait records the waits of the client rate limit.
+func (o *Opt) onWait() shapeio.LimitConfigFn {
+	return shapeio.WithOnWait(o.Metrics.ObserveRateLimitWait)
+}
@@ -0,0 +1,91 @@
+package goup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bingoohuang/goup/shapeio"
+)
+
+// metricValue returns the value of the metric line, like goup_chunks_total{outcome="written"}.
+func metricValue(t *testing.T, m *Metrics, metric string) float64 {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for s := bufio.NewScanner(&b); s.Scan(); {
+		if line := s.Text(); strings.HasPrefix(line, metric+" ") {
+			f, _ := strconv.ParseFloat(strings.TrimPrefix(line, metric+" "), 64)
+			return f
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	setupTestRoot(t)
+	ts := httptest.NewServer(Bearer("t1", ServerHandle("code", "", 64*1024, 0, nil)))
+	defer ts.Close()
+
+	written := metricValue(t, DefaultMetrics, `goup_chunks_total{outcome="written"}`)
+	skipped := metricValue(t, DefaultMetrics, `goup_chunks_total{outcome="skipped"}`)
+	authFailures := metricValue(t, DefaultMetrics, "goup_auth_failures_total")
+
+	src := writeTestFile(t, 100*1024)
+	m := NewMetrics()
+	for i := 0; i < 2; i++ {
+		c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithBearer("t1"),
+			WithMetrics(m), WithLimitRate(128*1024))
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for metric, want := range map[string]float64{
+		`goup_chunks_total{outcome="written"}`:                   2,
+		`goup_chunks_total{outcome="skipped"}`:                   2,
+		`goup_requests_total{endpoint="pake",code="200"}`:        2,
+		`goup_request_duration_seconds_count{endpoint="upload"}`: 6, // 4 checksums, 2 chunks
+	} {
+		if got := metricValue(t, m, metric); got != want {
+			t.Fatalf("client %s = %v, want %v", metric, got, want)
+		}
+	}
+	if metricValue(t, m, `goup_bytes_total{direction="out"}`) < 100*1024 {
+		t.Fatal("client bytes out not recorded")
+	}
+	// the chunks may not wait, when the tokens accumulated during the key derivation cover them,
+	// so read right after the limiter is set up, 32KiB at 256KiB/s waits about 125ms.
+	c, _ := New(ts.URL, WithFullPath(src), WithMetrics(m), WithLimitRate(256*1024))
+	waits := metricValue(t, m, "goup_rate_limit_wait_seconds_count")
+	r := shapeio.NewReader(bytes.NewReader(make([]byte, 32*1024)), shapeio.WithRateLimit(float64(c.LimitRate)), c.onWait())
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if metricValue(t, m, "goup_rate_limit_wait_seconds_count") == waits {
+		t.Fatal("client rate limit waits not recorded")
+	}
+
+	if got := metricValue(t, DefaultMetrics, `goup_chunks_total{outcome="written"}`) - written; got != 2 {
+		t.Fatalf("server written chunks %v, want 2", got)
+	}
+	if got := metricValue(t, DefaultMetrics, `goup_chunks_total{outcome="skipped"}`) - skipped; got != 2 {
+		t.Fatalf("server skipped chunks %v, want 2", got)
+	}
+	if rsp, err := http.Get(ts.URL + "/a.txt"); err != nil || rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", err)
+	}
+	if got := metricValue(t, DefaultMetrics, "goup_auth_failures_total") - authFailures; got != 1 {
+		t.Fatalf("server auth failures %v, want 1", got)
+	}
+	if metricValue(t, DefaultMetrics, "goup_active_sessions") < 2 {
+		t.Fatal("server active sessions not recorded")
+	}
+}
@@ -0,0 +1,178 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/rest"
+)
+
+// maxMirrorFailures is the consecutive chunk failures to drop a mirror.
+const maxMirrorFailures = 3
+
+// mirror is a server to download the chunks from.
+type mirror struct {
+	url        string
+	sessionKey []byte
+
+	inflight int
+	failures int // consecutive
+	cost     float64
+	dead     bool
+}
+
+// mirrorSet spreads the chunks across the mirrors by their responsiveness.
+type mirrorSet struct {
+	sync.Mutex
+	list []*mirror
+}
+
+// pick picks the alive mirror expected to finish a new chunk first,
+// the untried mirrors are picked first to measure them.
+func (s *mirrorSet) pick() *mirror {
+	s.Lock()
+	defer s.Unlock()
+
+	var best *mirror
+	var bestCost float64
+	for _, m := range s.list {
+		if m.dead {
+			continue
+		}
+		if cost := float64(m.inflight+1) * m.cost; best == nil || cost < bestCost {
+			best, bestCost = m, cost
+		}
+	}
+	best.inflight++
+	return best
+}
+
+// done updates the cost (seconds per byte, moving average) of the mirror by the result of a chunk,
+// the mirror failed continuously is dropped unless it is the last one.
+func (s *mirrorSet) done(m *mirror, size uint64, d time.Duration, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	m.inflight--
+	switch {
+	case err == nil:
+		m.failures = 0
+		if cost := d.Seconds() / float64(size); m.cost == 0 {
+			m.cost = cost
+		} else {
+			m.cost = 0.7*m.cost + 0.3*cost
+		}
+	case errors.Is(err, errChunkSkipped):
+		m.failures = 0
+	case errors.Is(err, context.Canceled):
+	default:
+		if m.failures++; m.failures >= maxMirrorFailures && !m.dead && s.alive() > 1 {
+			m.dead = true
+			log.Printf("E! mirror %s dropped after %d failures: %v", m.url, m.failures, err)
+		}
+	}
+}
+
+func (s *mirrorSet) alive() (n int) {
+	for _, m := range s.list {
+		if !m.dead {
+			n++
+		}
+	}
+	return n
+}
+
+// setupMirrors negotiates the session keys with the mirrors, and checks the sizes with the main server,
+// the failed or the inconsistent mirrors are dropped.
+func (c *Client) setupMirrors() {
+	c.mirrors = &mirrorSet{list: []*mirror{{url: c.url, sessionKey: c.sessionKey}}}
+
+	var wg sync.WaitGroup
+	for _, u := range c.Mirrors {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+
+			m, err := c.setupMirror(u)
+			if err != nil {
+				log.Printf("E! mirror %s dropped: %v", u, err)
+				return
+			}
+			c.mirrors.Lock()
+			c.mirrors.list = append(c.mirrors.list, m)
+			c.mirrors.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	if len(c.Mirrors) > 0 {
+		log.Printf("Download %s from %d servers", c.ID, len(c.mirrors.list))
+	}
+}
+
+func (c *Client) setupMirror(u string) (*mirror, error) {
+	fixedURL := rest.FixURI(u)
+	if !fixedURL.OK() {
+		return nil, fixedURL.Err
+	}
+	m := &mirror{url: fixedURL.Data.String()}
+
+	var err error
+	if m.sessionKey, err = c.pakeSessionKey(m.url); err != nil {
+		return nil, err
+	}
+	cr, _, err := c.probeDownload(m.url)
+	if err != nil {
+		return nil, err
+	}
+	if cr.TotalSize != c.TotalSize {
+		return nil, fmt.Errorf("size %d differs from %d", cr.TotalSize, c.TotalSize)
+	}
+	return m, nil
+}
+
+// verifyMirrors checks the checksum of the downloaded file with the alive mirrors,
+// because the chunks from the mirrors holding different files make a corrupted file.
+func (c *Client) verifyMirrors() error {
+	if len(c.mirrors.list) < 2 {
+		return nil
+	}
+
+	cr := &chunkRange{From: 0, To: c.TotalSize, PartSize: c.TotalSize, TotalSize: c.TotalSize}
+	checksum, err := c.sink.checksum(cr)
+	if err != nil {
+		return fmt.Errorf("checksum %s: %w", c.FullPath, err)
+	}
+	if checksum == "" { // like the WriterAt not readable
+		log.Printf("W! verifying with mirrors skipped, the downloaded file is unreadable")
+		return nil
+	}
+
+	for _, m := range c.mirrors.list {
+		if m.dead {
+			continue
+		}
+
+		r, err := http.NewRequestWithContext(c.ctx, http.MethodHead, m.url, nil)
+		if err != nil {
+			return err
+		}
+		r = withEndpoint(r, "download")
+		r.Header.Set(Authorization, c.Bearer)
+		r.Header.Set("Content-Gulp", "Session="+c.ID+"; Range="+cr.createContentRange()+"; Checksum="+checksum)
+		q, err := c.Client.Do(r)
+		if err != nil {
+			return fmt.Errorf("verify with mirror %s: %w", m.url, err)
+		}
+		Close(q.Body)
+		if q.StatusCode != http.StatusNotModified {
+			return fmt.Errorf("verify with mirror %s: file is inconsistent: %w", m.url, &StatusCodeError{StatusCode: q.StatusCode})
+		}
+	}
+	return nil
+}
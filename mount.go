@@ -0,0 +1,376 @@
+package goup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mount maps the URL path prefix to a root directory (or another storage), or to a single file as an alias.
+type Mount struct {
+	// Prefix is the URL path prefix, like /pub, / for the default root.
+	Prefix string `json:"prefix"`
+	// Root is the directory, or the storage spec (see ParseStorage), of the files under Prefix,
+	// empty for the same path in the default root storage, to set only the flags.
+	Root string `json:"root,omitempty"`
+	// Alias is the path of the file downloaded by the URL path Prefix, like /short.zip for the Prefix /short.
+	// The alias is read only, the file is written by its own path.
+	Alias string `json:"alias,omitempty"`
+	// ReadOnly refuses the uploads, the deletions and the renames.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// UploadOnly refuses the downloads, the stats and the listing.
+	UploadOnly bool `json:"uploadOnly,omitempty"`
+	// Listable shows the files in the listing, always true for the implicit default root.
+	Listable bool `json:"listable,omitempty"`
+}
+
+// ParseMount parses the mount spec like [ro,upload-only,list:]/prefix[=root].
+func ParseMount(spec string) (Mount, error) {
+	var m Mount
+	s := spec
+	if !strings.HasPrefix(s, "/") {
+		flags, rest, _ := strings.Cut(s, ":")
+		for _, f := range strings.Split(flags, ",") {
+			switch f {
+			case "ro", "read-only":
+				m.ReadOnly = true
+			case "wo", "upload-only":
+				m.UploadOnly = true
+			case "list", "listable":
+				m.Listable = true
+			default:
+				return m, fmt.Errorf("unknown mount flag %s in %s", f, spec)
+			}
+		}
+		s = rest
+	}
+	if m.Prefix, m.Root, _ = strings.Cut(s, "="); !strings.HasPrefix(m.Prefix, "/") {
+		return m, fmt.Errorf("bad mount %s, should be [ro,upload-only,list:]/prefix[=root]", spec)
+	}
+	return m, nil
+}
+
+// ParseAlias parses the alias spec of a single file like /short=/short.zip, or /short:/short.zip.
+func ParseAlias(spec string) (Mount, error) {
+	i := strings.IndexAny(spec, "=:")
+	if i <= 0 || i == len(spec)-1 || storageName(spec[:i]) == "" {
+		return Mount{}, fmt.Errorf("bad path %s, should be /short=/short.zip", spec)
+	}
+	return Mount{Prefix: spec[:i], Alias: spec[i+1:]}, nil
+}
+
+// LoadMounts loads the JSON array of the mounts from the file.
+func LoadMounts(file string) ([]Mount, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []Mount
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		return nil, fmt.Errorf("parse mounts %s: %w", file, err)
+	}
+	return mounts, nil
+}
+
+// WithMounts set Mounts.
+func WithMounts(v *Mounts) ServerOptFn { return func(o *ServerOpt) { o.Mounts = v } }
+
+// Mounts is the mount table of the server, which can be replaced by Set without restart.
+// It is also the Storage routing the names to the storages of the mounts.
+type Mounts struct {
+	sync.RWMutex
+	base    Storage
+	fixed   []Mount
+	dynamic []Mount
+	mounts  []*mount // the longest prefix first
+}
+
+type mount struct {
+	Mount
+	// name is the storage name of Prefix, "" for the default root.
+	name string
+	st   Storage
+}
+
+// NewMounts creates the Mounts, the fixed mounts are kept by Set, like the aliases of the -path flags.
+func NewMounts(fixed ...Mount) (*Mounts, error) {
+	m := &Mounts{fixed: fixed}
+	if err := m.Set(nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Set replaces the mounts except the fixed ones, the mounts are unchanged if any one is invalid.
+func (m *Mounts) Set(mounts []Mount) error {
+	all := append(append([]Mount(nil), m.fixed...), mounts...)
+
+	m.RLock()
+	old := m.mounts
+	m.RUnlock()
+
+	table := make([]*mount, 0, len(all)+1)
+	names := map[string]bool{}
+	for _, v := range all {
+		t := &mount{Mount: v, name: storageName(v.Prefix)}
+		if names[t.name] {
+			return fmt.Errorf("duplicate mount %s", v.Prefix)
+		}
+		names[t.name] = true
+		if t.Alias != "" {
+			if t.name == "" {
+				return fmt.Errorf("alias %s can not be the root", v.Alias)
+			}
+			t.Alias = storageName(t.Alias)
+		} else if t.Root != "" {
+			// reuses the storage of the unchanged root, like the files in the memory
+			for _, o := range old {
+				if o.Root == t.Root && o.st != nil {
+					t.st = o.st
+				}
+			}
+			if t.st == nil {
+				st, err := parseMountRoot(t.Root)
+				if err != nil {
+					return fmt.Errorf("mount %s: %w", v.Prefix, err)
+				}
+				t.st = st
+			}
+		}
+		table = append(table, t)
+	}
+	if !names[""] {
+		table = append(table, &mount{Mount: Mount{Prefix: "/", Listable: true}})
+	}
+	sort.SliceStable(table, func(i, j int) bool { return len(table[i].name) > len(table[j].name) })
+
+	m.Lock()
+	m.mounts, m.dynamic = table, mounts
+	m.Unlock()
+	return nil
+}
+
+// withPaths adds the aliases of the -path flags, like /short=/short.zip, to the fixed mounts.
+func withPaths(paths []string) ServerOptFn {
+	return func(o *ServerOpt) {
+		var aliases []Mount
+		for _, p := range paths {
+			a, err := ParseAlias(p)
+			if err != nil {
+				log.Printf("E! %v", err)
+				continue
+			}
+			aliases = append(aliases, a)
+		}
+		if len(aliases) == 0 {
+			return
+		}
+
+		if o.Mounts == nil {
+			o.Mounts = &Mounts{}
+		}
+		o.Mounts.fixed = append(o.Mounts.fixed, aliases...)
+		if err := o.Mounts.Set(o.Mounts.dynamic); err != nil {
+			log.Printf("E! add paths %v failed: %v", paths, err)
+		}
+	}
+}
+
+// parseMountRoot parses the root of the mount, a local directory if it is not a storage spec.
+func parseMountRoot(root string) (Storage, error) {
+	if root == "mem" || strings.Contains(root, ":") {
+		return ParseStorage(root)
+	}
+	return NewLocalStorage(root), nil
+}
+
+// lookup returns the mount of the name, and the name relative to the mount.
+func (m *Mounts) lookup(name string) (*mount, string) {
+	name = storageName(name)
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, t := range m.mounts {
+		if t.Alias != "" {
+			continue
+		}
+		if t.name == "" || t.st == nil && (name == t.name || strings.HasPrefix(name, t.name+"/")) {
+			return t, name
+		}
+		if name == t.name || strings.HasPrefix(name, t.name+"/") {
+			return t, strings.TrimPrefix(name[len(t.name):], "/")
+		}
+	}
+	return nil, name // never happens, the root is always mounted
+}
+
+func (m *Mounts) storage(t *mount) Storage {
+	if t.st != nil {
+		return t.st
+	}
+	return m.base
+}
+
+// resolve returns the file name the alias stands for, or the name itself.
+func (m *Mounts) resolve(name string) string {
+	if m == nil {
+		return name
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, t := range m.mounts {
+		if t.Alias != "" && t.name == name {
+			return t.Alias
+		}
+	}
+	return name
+}
+
+// allow checks the flags of the mount of the name, write for the uploads, the deletions and the renames.
+func (m *Mounts) allow(name string, write bool) error {
+	if m == nil {
+		return nil
+	}
+
+	if write && m.resolve(name) != name {
+		return &statusError{Code: http.StatusForbidden, Err: fmt.Errorf("%s is an alias", name)}
+	}
+	t, _ := m.lookup(name)
+	if write && t.ReadOnly {
+		return &statusError{Code: http.StatusForbidden, Err: fmt.Errorf("%s is read only", name)}
+	}
+	if !write && t.UploadOnly {
+		return &statusError{Code: http.StatusForbidden, Err: fmt.Errorf("%s is upload only", name)}
+	}
+	return nil
+}
+
+// listable tells whether the file is shown in the listing.
+func (m *Mounts) listable(name string) bool {
+	if m == nil {
+		return true
+	}
+	t, _ := m.lookup(name)
+	return t.Listable && !t.UploadOnly
+}
+
+// OpenWrite opens the file of the mount to write.
+func (m *Mounts) OpenWrite(name string) (StorageFile, error) {
+	t, rel := m.lookup(name)
+	return m.storage(t).OpenWrite(rel)
+}
+
+// ReadRange opens the bytes [from, to) of the file of the mount.
+func (m *Mounts) ReadRange(name string, from, to uint64) (io.ReadCloser, error) {
+	t, rel := m.lookup(name)
+	return m.storage(t).ReadRange(rel, from, to)
+}
+
+// Stat returns the info of the file of the mount.
+func (m *Mounts) Stat(name string) (StorageInfo, error) {
+	t, rel := m.lookup(name)
+	info, err := m.storage(t).Stat(rel)
+	info.Name = storageName(name)
+	return info, err
+}
+
+// List lists the files of all the mounts whose names have the prefix.
+func (m *Mounts) List(prefix string) ([]StorageInfo, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	m.RLock()
+	mounts := m.mounts
+	m.RUnlock()
+
+	var infos []StorageInfo
+	baseListed := false
+	for _, t := range mounts {
+		if t.Alias != "" || t.st == nil && baseListed {
+			continue
+		}
+		var sub string // the prefix in the storage of the mount
+		switch {
+		case t.st == nil, t.name == "":
+			sub, baseListed = prefix, baseListed || t.st == nil
+		case strings.HasPrefix(prefix, t.name+"/"):
+			sub = prefix[len(t.name)+1:]
+		case strings.HasPrefix(t.name+"/", prefix):
+		default:
+			continue
+		}
+
+		list, err := m.storage(t).List(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range list {
+			if t.st != nil && t.name != "" {
+				info.Name = t.name + "/" + info.Name
+			}
+			// skips the files shadowed by the deeper mounts
+			owner, _ := m.lookup(info.Name)
+			if (owner == t || owner.st == nil && t.st == nil) && strings.HasPrefix(info.Name, prefix) {
+				infos = append(infos, info)
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Delete deletes the file of the mount.
+func (m *Mounts) Delete(name string) error {
+	t, rel := m.lookup(name)
+	return m.storage(t).Delete(rel)
+}
+
+// Rename renames the file, it is copied and deleted if the new name is in another mount.
+func (m *Mounts) Rename(name, newName string) error {
+	t, rel := m.lookup(name)
+	nt, newRel := m.lookup(newName)
+	if st := m.storage(t); st == m.storage(nt) {
+		return st.Rename(rel, newRel)
+	}
+
+	r, err := m.storage(t).ReadRange(rel, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer Close(r)
+
+	if _, err := writeStorage(m.storage(nt), newRel, r, nil); err != nil {
+		return err
+	}
+	if err := m.Commit(newName); err != nil {
+		return err
+	}
+	if err := m.storage(t).Delete(rel); err != nil {
+		log.Printf("E! delete %s moved to %s failed: %v", name, newName, err)
+	}
+	return nil
+}
+
+// Commit commits the file if the storage of the mount is a StorageCommitter.
+func (m *Mounts) Commit(name string) error {
+	t, rel := m.lookup(name)
+	if c, ok := m.storage(t).(StorageCommitter); ok {
+		return c.Commit(rel)
+	}
+	return nil
+}
+
+// LocalPath returns the local path of the file if the storage of the mount is a LocalPather.
+func (m *Mounts) LocalPath(name string) (string, bool) {
+	t, rel := m.lookup(name)
+	if lp, ok := m.storage(t).(LocalPather); ok {
+		return lp.LocalPath(rel)
+	}
+	return "", false
+}
@@ -0,0 +1,103 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMounts(t *testing.T) {
+	root := setupTestRoot(t)
+	pub := t.TempDir()
+	_ = os.WriteFile(filepath.Join(root, "a.txt"), []byte("aaa"), 0o644)
+	_ = os.WriteFile(filepath.Join(pub, "p.txt"), []byte("ppp"), 0o644)
+	_ = os.MkdirAll(filepath.Join(root, "inbox"), 0o755)
+	_ = os.WriteFile(filepath.Join(root, "inbox", "secret.txt"), []byte("sss"), 0o644)
+
+	mounts, err := NewMounts(Mount{Prefix: "/pub", Root: pub, ReadOnly: true, Listable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mounts.Set([]Mount{{Prefix: "/inbox", UploadOnly: true}, {Prefix: "/tmp", Root: "mem", Listable: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, []string{"/short=/a.txt", "/empty="}, WithMounts(mounts)))
+	defer ts.Close()
+
+	get := func(p string) (int, string) {
+		rsp, err := http.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+	for p, want := range map[string]string{
+		"/short": "200 aaa", "/pub/p.txt": "200 ppp", "/inbox/secret.txt": "403 ", "/s": "404 ", "/empty": "404 ",
+	} {
+		if code, body := get(p); fmt.Sprintf("%d %s", code, body) != want {
+			t.Fatalf("GET %s: %d %s, want %s", p, code, body, want)
+		}
+	}
+
+	ctx := context.Background()
+	c, _ := New(ts.URL)
+	var se *StatusCodeError
+	for _, err := range []error{c.Delete(ctx, "pub/p.txt"), c.Delete(ctx, "short"), c.Move(ctx, "short", "b.txt"), c.Move(ctx, "a.txt", "short")} {
+		if !errors.As(err, &se) || se.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected 403, got %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); err != nil {
+		t.Fatalf("aliased file changed: %v", err)
+	}
+
+	src := writeTestFile(t, 100*1024)
+	u, _ := New(ts.URL, WithFullPath(src), WithRename("tmp/x.bin"), WithChunkSize(64*1024), WithCode("code"))
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp", "x.bin")); !os.IsNotExist(err) {
+		t.Fatal("file uploaded to the root instead of the mount")
+	}
+	if err := c.Move(ctx, "tmp/x.bin", "x.bin"); err != nil { // across the mounts
+		t.Fatal(err)
+	}
+	if err := c.Move(ctx, "x.bin", "tmp/y.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := func() string {
+		entries, err := c.List(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+		}
+		return fmt.Sprint(paths)
+	}
+	if got := paths(); got != "[a.txt pub/p.txt tmp/y.bin]" {
+		t.Fatalf("unexpected listing %s", got)
+	}
+
+	// reloads, the files in the memory are kept
+	if err := mounts.Set([]Mount{{Prefix: "/tmp", Root: "mem", Listable: true}, {Prefix: "/tmp", Root: "mem"}}); err == nil {
+		t.Fatal("duplicate mounts accepted")
+	}
+	if err := mounts.Set([]Mount{{Prefix: "/tmp", Root: "mem", Listable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(); got != "[a.txt inbox/secret.txt pub/p.txt tmp/y.bin]" {
+		t.Fatalf("unexpected listing after reload %s", got)
+	}
+}
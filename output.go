@@ -0,0 +1,210 @@
+package goup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bingoohuang/gg/pkg/codec/b64"
+	"github.com/cespare/xxhash/v2"
+)
+
+// downloadSink is the destination of the downloaded chunks.
+type downloadSink interface {
+	// checksum returns the checksum of the chunk already in the destination, "" for unknown.
+	checksum(cr *chunkRange) (string, error)
+	// write writes the i-th chunk.
+	write(i uint64, r io.Reader, cr *chunkRange) error
+	// abort aborts the sink when the i-th chunk is failed.
+	abort(i uint64, err error)
+}
+
+// fileSink writes the chunks to the local file.
+type fileSink struct {
+	FullPath string
+	Progress
+}
+
+func (s *fileSink) checksum(cr *chunkRange) (string, error) {
+	return readChunkChecksum(s.FullPath, cr.From, cr.To)
+}
+
+func (s *fileSink) write(_ uint64, r io.Reader, cr *chunkRange) error {
+	_, err := writeChunk(s.FullPath, s.Progress, r, cr)
+	return err
+}
+
+func (s *fileSink) abort(uint64, error) {}
+
+// writerAtSink writes the chunks at their offsets of an io.WriterAt.
+type writerAtSink struct {
+	io.WriterAt
+	Progress
+}
+
+func (s *writerAtSink) checksum(cr *chunkRange) (string, error) {
+	ra, ok := s.WriterAt.(io.ReaderAt)
+	if !ok {
+		return "", nil
+	}
+
+	return checksumReader(io.NewSectionReader(ra, int64(cr.From), int64(cr.PartSize))), nil
+}
+
+func (s *writerAtSink) write(_ uint64, r io.Reader, cr *chunkRange) error {
+	w := &offsetWriter{WriterAt: s.WriterAt}
+	if cr != nil {
+		w.Offset = int64(cr.From)
+	}
+	_, err := io.Copy(w, &PbReader{Reader: r, Adder: s.Progress})
+	return err
+}
+
+func (s *writerAtSink) abort(uint64, error) {}
+
+// writerSink writes the chunks in order to a sequential io.Writer.
+// The chunks downloaded out of order are buffered until their turns,
+// every coroutine holds at most one chunk, so the memory is limited to Coroutines * ChunkSize,
+// and the chunk in turn, like the whole response without chunks, is streamed to the writer without buffering.
+// The stream is hashed as it is written, to verify the whole of it with the mirrors.
+type writerSink struct {
+	io.Writer
+	Progress
+
+	cond    sync.Cond
+	mu      sync.Mutex
+	next    uint64
+	err     error
+	digest  *xxhash.Digest
+	written uint64
+}
+
+func newWriterSink(w io.Writer, progress Progress) *writerSink {
+	digest := xxhash.New()
+	s := &writerSink{Writer: io.MultiWriter(w, digest), Progress: progress, digest: digest}
+	s.cond.L = &s.mu
+	return s
+}
+
+// checksum returns the checksum of the stream when the range is all written, the chunks can't be read back.
+func (s *writerSink) checksum(cr *chunkRange) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cr.From != 0 || cr.To != s.written {
+		return "", nil
+	}
+	return b64.EncodeBytes2String(s.digest.Sum(nil), b64.Raw, b64.URL), nil
+}
+
+func (s *writerSink) write(i uint64, r io.Reader, _ *chunkRange) error {
+	r = &PbReader{Reader: r, Adder: s.Progress}
+
+	s.mu.Lock()
+	if s.next != i && s.err == nil { // out of order, buffered until its turn
+		s.mu.Unlock()
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			return err
+		}
+		r = &buf
+
+		s.mu.Lock()
+		for s.next != i && s.err == nil {
+			s.cond.Wait()
+		}
+	}
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// only the chunk in turn writes, the others wait for it
+	n, err := io.Copy(s.Writer, r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.written += uint64(n)
+	if err != nil {
+		if n > 0 { // the sequential writer can't be rewound for a retry
+			s.err = fmt.Errorf("chunk %d broken after %d bytes written: %w", i+1, n, err)
+			s.cond.Broadcast()
+		}
+		return err
+	}
+
+	s.next++
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *writerSink) abort(i uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = fmt.Errorf("chunk %d failed: %w", i+1, err)
+	}
+	s.cond.Broadcast()
+}
+
+type offsetWriter struct {
+	io.WriterAt
+	Offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteAt(p, w.Offset)
+	w.Offset += int64(n)
+	return n, err
+}
+
+// outputPath returns the local path of the downloaded file by Output,
+// which can be a file path, or a directory to put the file into (default RootDir).
+func (c *Client) outputPath(filename string) (string, error) {
+	filename = filepath.Base(filepath.Clean("/" + filename))
+
+	p := c.Output
+	switch {
+	case p == "":
+		p = filepath.Join(RootDir, filename)
+	case strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(filepath.Separator)):
+		p = filepath.Join(p, filename)
+	default:
+		if stat, err := os.Stat(p); err == nil && stat.IsDir() {
+			p = filepath.Join(p, filename)
+		}
+	}
+
+	if err := ensureDir(filepath.Dir(p)); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// newDownloadSink creates the sink of downloading by WriterAt, Writer or the local file.
+func (c *Client) newDownloadSink(filename string) (downloadSink, error) {
+	switch {
+	case c.WriterAt != nil:
+		c.FullPath = filename
+		return &writerAtSink{WriterAt: c.WriterAt, Progress: c.Progress}, nil
+	case c.Writer != nil:
+		c.FullPath = filename
+		c.hasher = sha256.New()
+		return newWriterSink(io.MultiWriter(c.Writer, c.hasher), c.Progress), nil
+	}
+
+	p, err := c.outputPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	c.FullPath = p
+	return &fileSink{FullPath: p, Progress: c.Progress}, nil
+}
@@ -0,0 +1,111 @@
+package goup
+
+import (
+	"context"
+	"sync"
+)
+
+// pauseGate blocks the chunk jobs while the transfer is paused.
+// Every resume starts a new epoch context, pausing cancels the current epoch
+// to abort the in-flight chunk requests.
+type pauseGate struct {
+	sync.Mutex
+	parent      context.Context
+	paused      bool
+	resumed     chan struct{}
+	epoch       context.Context
+	cancelEpoch context.CancelFunc
+}
+
+func (g *pauseGate) start(parent context.Context) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.parent = parent
+	if !g.paused {
+		g.epoch, g.cancelEpoch = context.WithCancel(parent)
+	}
+}
+
+func (g *pauseGate) pause() {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.paused {
+		return
+	}
+	g.paused = true
+	g.resumed = make(chan struct{})
+	if g.cancelEpoch != nil {
+		g.cancelEpoch()
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.Lock()
+	defer g.Unlock()
+
+	if !g.paused {
+		return
+	}
+	g.paused = false
+	if g.parent != nil {
+		g.epoch, g.cancelEpoch = context.WithCancel(g.parent)
+	}
+	close(g.resumed)
+}
+
+// wait blocks while paused, and returns the context of the current epoch.
+func (g *pauseGate) wait() (context.Context, error) {
+	for {
+		g.Lock()
+		parent, paused, resumed, epoch := g.parent, g.paused, g.resumed, g.epoch
+		g.Unlock()
+
+		if !paused {
+			return epoch, parent.Err()
+		}
+
+		select {
+		case <-resumed:
+		case <-parent.Done():
+			return nil, parent.Err()
+		}
+	}
+}
+
+// Pause pauses the chunked transfer, the in-flight chunk requests are aborted,
+// and they will be transferred again after Resume.
+func (c *Client) Pause() { c.gate.pause() }
+
+// Resume resumes the paused transfer.
+func (c *Client) Resume() { c.gate.resume() }
+
+// Cancel cancels the running transfer, the transferred chunks are kept
+// so that a later transfer of the same file can resume from them.
+func (c *Client) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// runChunk runs the chunk job, and reruns it after resume if it is aborted by Pause.
+func (c *Client) runChunk(job func(ctx context.Context, i uint64) error, i uint64) error {
+	for {
+		ctx, err := c.gate.wait()
+		if err != nil {
+			return err
+		}
+
+		err = job(ctx, i)
+		if err == nil || c.ctx.Err() != nil {
+			return err
+		}
+		if ctx.Err() == nil { // not aborted by Pause
+			return err
+		}
+	}
+}
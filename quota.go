@@ -0,0 +1,329 @@
+package goup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ErrQuotaExceeded is the error of an upload rejected by the quota, with http.StatusRequestEntityTooLarge
+// for a too large file, or http.StatusInsufficientStorage for the exhausted quota or disk.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the uploads, the zero values for no limits.
+type Quota struct {
+	// TotalBytes limits the total size of all the files in the storage.
+	TotalBytes int64
+	// UserBytes limits the total size of the files uploaded by each identity,
+	// the owners of the files are recorded in UsageFile.
+	UserBytes int64
+	// MaxFileSize limits the size of a single file.
+	MaxFileSize int64
+	// MinFreeBytes is the free disk space to reserve, only for the storages on the local disk.
+	MinFreeBytes int64
+}
+
+// WithQuota set Quota.
+func WithQuota(v Quota) ServerOptFn { return func(o *ServerOpt) { o.Quota = v } }
+
+// SetQuota replaces the quota without restart, but the per-user quota needs the usage ledger created on the start.
+func (s *Server) SetQuota(q Quota) {
+	s.opt.mu.Lock()
+	defer s.opt.mu.Unlock()
+
+	if q.UserBytes > 0 && s.opt.usage == nil {
+		log.Printf("W! the per-user quota needs a restart")
+	}
+	s.opt.Quota = q
+}
+
+func (o *ServerOpt) quota() Quota {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.Quota
+}
+
+// WithUsageFile set UsageFile.
+func WithUsageFile(v string) ServerOptFn { return func(o *ServerOpt) { o.UsageFile = v } }
+
+func quotaError(code int, format string, a ...interface{}) error {
+	return &statusError{Code: code, Err: fmt.Errorf("%w: "+format, append([]interface{}{ErrQuotaExceeded}, a...)...)}
+}
+
+// checkQuota checks the quota before the file of the name is (re)written to the size by the identity.
+func (o *ServerOpt) checkQuota(name, identity string, size int64) error {
+	q := o.quota()
+	if q.MaxFileSize > 0 && size > q.MaxFileSize {
+		return quotaError(http.StatusRequestEntityTooLarge, "file size %s exceeds the limit %s",
+			humanize.IBytes(uint64(size)), humanize.IBytes(uint64(q.MaxFileSize)))
+	}
+
+	var existing int64
+	if q.TotalBytes > 0 || q.UserBytes > 0 || q.MinFreeBytes > 0 {
+		if info, err := o.Storage.Stat(name); err == nil && !info.IsDir {
+			existing = info.Size
+		}
+	}
+	if growth := size - existing; growth <= 0 {
+		return nil
+	}
+
+	if q.TotalBytes > 0 {
+		used, ok, err := o.used.reserve(name, size, q.TotalBytes)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return quotaError(http.StatusInsufficientStorage, "total quota %s exhausted, used %s, file size %s",
+				humanize.IBytes(uint64(q.TotalBytes)), humanize.IBytes(uint64(used)), humanize.IBytes(uint64(size)))
+		}
+	}
+	if q.UserBytes > 0 {
+		if used := o.usage.used(identity, name); used+size > q.UserBytes {
+			return quotaError(http.StatusInsufficientStorage, "quota %s of %s exhausted, used %s, file size %s",
+				humanize.IBytes(uint64(q.UserBytes)), identity, humanize.IBytes(uint64(used)), humanize.IBytes(uint64(size)))
+		}
+	}
+	if q.MinFreeBytes > 0 {
+		if lp, ok := o.Storage.(LocalPather); ok {
+			root, _ := lp.LocalPath("")
+			if free := diskFree(root); free >= 0 && free-(size-existing) < q.MinFreeBytes {
+				return quotaError(http.StatusInsufficientStorage, "free disk %s is less than the reserved %s after writing %s",
+					humanize.IBytes(uint64(free)), humanize.IBytes(uint64(q.MinFreeBytes)), humanize.IBytes(uint64(size)))
+			}
+		}
+	}
+	return nil
+}
+
+// quotaStep is the bytes reserved ahead by a body of unknown length.
+const quotaStep = 1 << 20
+
+// quotaReader checks the quota on the bytes of a body of unknown length as they arrive,
+// reserving them by steps, but not beyond max, the limit of a single file, until it is exceeded.
+type quotaReader struct {
+	io.Reader
+	check    func(size int64) error
+	max      int64
+	n        int64
+	reserved int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.Reader.Read(p)
+	if q.n += int64(n); q.n > q.reserved {
+		q.reserved = q.n + quotaStep
+		if q.max > 0 && q.n <= q.max && q.reserved > q.max {
+			q.reserved = q.max
+		}
+		if ce := q.check(q.reserved); ce != nil {
+			return n, ce
+		}
+	}
+	return n, err
+}
+
+// reservationTTL is how long the size reserved by an upload lasts without being committed or refreshed.
+const reservationTTL = 24 * time.Hour
+
+// storageUsage is the running total size of the files in the storage for Quota.TotalBytes,
+// the storage is listed once, then the sizes are updated when the files are committed, deleted or renamed.
+// The uploads in progress reserve their growths, so that the concurrent ones can't exceed the quota together.
+type storageUsage struct {
+	sync.Mutex
+	st       Storage
+	files    map[string]int64 // by the storage name, nil until listed
+	used     int64
+	reserved map[string]reservation
+}
+
+type reservation struct {
+	growth int64
+	at     time.Time
+}
+
+func newStorageUsage(st Storage) *storageUsage {
+	return &storageUsage{st: st, reserved: map[string]reservation{}}
+}
+
+func (u *storageUsage) load() error {
+	if u.files != nil {
+		return nil
+	}
+	infos, err := u.st.List("")
+	if err != nil {
+		return err
+	}
+	u.files = make(map[string]int64, len(infos))
+	for _, info := range infos {
+		u.files[info.Name] = info.Size
+		u.used += info.Size
+	}
+	return nil
+}
+
+// reserve reserves the growth of the file of the name to the size, unless it exceeds the limit.
+// It returns the bytes used and reserved by the others.
+func (u *storageUsage) reserve(name string, size, limit int64) (used int64, ok bool, err error) {
+	u.Lock()
+	defer u.Unlock()
+
+	if err := u.load(); err != nil {
+		return 0, false, err
+	}
+	now := time.Now()
+	used = u.used
+	for n, r := range u.reserved {
+		if now.Sub(r.at) > reservationTTL {
+			delete(u.reserved, n)
+		} else if n != name {
+			used += r.growth
+		}
+	}
+	growth := size - u.files[name]
+	if growth > 0 && used+growth > limit {
+		return used, false, nil
+	}
+	u.reserved[name] = reservation{growth: growth, at: now}
+	return used, true, nil
+}
+
+// update updates the sizes of the files of the names by their current states, and releases their reservations.
+func (u *storageUsage) update(names ...string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	for _, name := range names {
+		delete(u.reserved, name)
+		if u.files == nil {
+			continue
+		}
+		u.used -= u.files[name]
+		delete(u.files, name)
+		if info, err := u.st.Stat(name); err == nil && !info.IsDir {
+			u.files[name] = info.Size
+			u.used += info.Size
+		}
+	}
+}
+
+func (u *storageUsage) rename(name, newName string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	moved := map[string]int64{}
+	for k, size := range u.files {
+		if k == name || strings.HasPrefix(k, name+"/") {
+			delete(u.files, k)
+			moved[newName+strings.TrimPrefix(k, name)] = size
+		}
+	}
+	for k, size := range moved {
+		u.files[k] = size
+	}
+}
+
+// usageLedger records the owners and the sizes of the uploaded files in a JSON file for the per-user quota.
+type usageLedger struct {
+	sync.Mutex
+	file   string
+	owners map[string]fileOwner // by the storage name
+}
+
+type fileOwner struct {
+	Identity string `json:"identity"`
+	Size     int64  `json:"size"`
+}
+
+func newUsageLedger(file string) *usageLedger {
+	l := &usageLedger{file: file, owners: map[string]fileOwner{}}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("E! read usage file %s failed: %v", file, err)
+		}
+		return l
+	}
+	if err := json.Unmarshal(data, &l.owners); err != nil {
+		log.Printf("E! parse usage file %s failed: %v", file, err)
+	}
+	return l
+}
+
+// used returns the total size of the files owned by the identity, excluding the file of the name.
+func (l *usageLedger) used(identity, excluded string) (used int64) {
+	if l == nil {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for name, o := range l.owners {
+		if o.Identity == identity && name != excluded {
+			used += o.Size
+		}
+	}
+	return used
+}
+
+func (l *usageLedger) update(f func(owners map[string]fileOwner)) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	f(l.owners)
+	data, _ := json.Marshal(l.owners)
+	err := ensureDir(filepath.Dir(l.file))
+	if err == nil {
+		err = os.WriteFile(l.file, data, 0o644)
+	}
+	if err != nil {
+		log.Printf("E! write usage file %s failed: %v", l.file, err)
+	}
+}
+
+func (l *usageLedger) record(name, identity string, size int64) {
+	l.update(func(owners map[string]fileOwner) { owners[name] = fileOwner{Identity: identity, Size: size} })
+}
+
+func (l *usageLedger) remove(name string) {
+	l.update(func(owners map[string]fileOwner) {
+		for k := range owners {
+			if k == name || strings.HasPrefix(k, name+"/") {
+				delete(owners, k)
+			}
+		}
+	})
+}
+
+func (l *usageLedger) rename(name, newName string) {
+	l.update(func(owners map[string]fileOwner) {
+		if o, ok := owners[name]; ok {
+			delete(owners, name)
+			owners[newName] = o
+		}
+	})
+}
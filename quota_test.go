@@ -0,0 +1,94 @@
+package goup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStorage counts the listings of the storage.
+type countingStorage struct {
+	Storage
+	lists int32
+}
+
+func (s *countingStorage) List(prefix string) ([]StorageInfo, error) {
+	atomic.AddInt32(&s.lists, 1)
+	return s.Storage.List(prefix)
+}
+
+func TestStorageUsage(t *testing.T) {
+	st := &countingStorage{Storage: NewMemStorage()}
+	if _, err := writeStorage(st, "old.bin", strings.NewReader(strings.Repeat("x", 40)), nil); err != nil {
+		t.Fatal(err)
+	}
+	o := newServerOpt(WithStorage(st), WithQuota(Quota{TotalBytes: 100}))
+
+	// the concurrent uploads can't exceed the quota together
+	var wg sync.WaitGroup
+	var rejected int32
+	for _, name := range []string{"a.bin", "b.bin"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := o.checkQuota(name, "u", 50); errors.Is(err, ErrQuotaExceeded) {
+				atomic.AddInt32(&rejected, 1)
+			}
+		}(name)
+	}
+	wg.Wait()
+	if rejected != 1 {
+		t.Fatalf("%d uploads rejected, want 1", rejected)
+	}
+
+	if err := st.Delete("old.bin"); err != nil {
+		t.Fatal(err)
+	}
+	o.used.update("old.bin")
+	if err := o.checkQuota("c.bin", "u", 50); err != nil {
+		t.Fatalf("deleted file still counted: %v", err)
+	}
+	if st.lists != 1 {
+		t.Fatalf("storage listed %d times, want once", st.lists)
+	}
+}
+
+func TestBodyQuota(t *testing.T) {
+	root := setupTestRoot(t)
+	_ = os.WriteFile(filepath.Join(root, "a.bin"), []byte("old"), 0o644)
+	h := ServerHandle("code", "", 0, 0, nil, WithQuota(Quota{MaxFileSize: 3 << 20, TotalBytes: 4 << 20}))
+
+	push := func(name string, size int) int {
+		// the reader hides the length, as a chunked body
+		r := httptest.NewRequest(http.MethodPost, "/", io.MultiReader(bytes.NewReader(make([]byte, size))))
+		r.ContentLength = -1
+		r.Header.Set("Content-Gulp", "Filename="+name)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	if code := push("a.bin", 3<<20+1); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.bin")); string(data) != "old" {
+		t.Fatalf("rejected upload changed the existing file to %d bytes", len(data))
+	}
+	if code := push("b.bin", 3<<20); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := push("c.bin", 2<<20); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d", code)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 3 { // a.bin, b.bin and its metadata
+		t.Fatalf("staged bodies left: %d entries", len(entries))
+	}
+}
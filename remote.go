@@ -0,0 +1,238 @@
+package goup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/jsoni"
+)
+
+// FileStat is the metadata of a remote file.
+type FileStat struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+	// Hash is the hex encoded SHA-256 of the file, empty for directories.
+	Hash string `json:"hash,omitempty"`
+	// Meta is the metadata of the uploaded file, nil if it has none.
+	Meta *FileMeta `json:"meta,omitempty"`
+}
+
+// remoteName returns the storage name of the request url path, the root itself and the metadata sidecars are refused.
+func remoteName(urlPath string) (string, error) {
+	name := storageName(urlPath)
+	if name == "" {
+		return "", &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("path is required")}
+	}
+	if isMetaName(name) {
+		return "", &statusError{Code: http.StatusNotFound, Err: fmt.Errorf("%s is a metadata file", name)}
+	}
+	return name, nil
+}
+
+func notFoundOr(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &statusError{Code: http.StatusNotFound, Err: err}
+	}
+	return err
+}
+
+func serveStat(w http.ResponseWriter, r *http.Request, opt *ServerOpt) error {
+	name, err := remoteName(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	name = opt.Mounts.resolve(name)
+	if err := opt.Mounts.allow(name, false); err != nil {
+		return err
+	}
+	st := opt.Storage
+	info, err := st.Stat(name)
+	if err != nil {
+		return notFoundOr(err)
+	}
+
+	stat := FileStat{Path: name, Size: info.Size, ModTime: info.ModTime, IsDir: info.IsDir}
+	if !info.IsDir {
+		if stat.Hash, _, err = cachedHash(st, name); err != nil {
+			return err
+		}
+		if stat.Meta, err = readMeta(st, name); err != nil {
+			return err
+		}
+	}
+	w.Header().Set(ContentType, "application/json; charset=utf-8")
+	return jsoni.NewEncoder(w).Encode(r.Context(), stat)
+}
+
+func serveDelete(w http.ResponseWriter, r *http.Request, opt *ServerOpt) error {
+	name, err := remoteName(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if err := opt.Mounts.allow(name, true); err != nil {
+		return err
+	}
+	var event WebhookEvent
+	if opt.webhooks != nil {
+		event = opt.fileEvent(EventDelete, name, Identity(r))
+	}
+	// only the files and the empty directories, to avoid removing a whole tree by mistake
+	if err := opt.Storage.Delete(name); err != nil {
+		return notFoundOr(err)
+	}
+	deleteMeta(opt.Storage, name)
+	opt.usage.remove(name)
+	opt.used.update(name)
+	opt.webhooks.emit(event)
+
+	log.Printf("file %s deleted by %s", name, Identity(r))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func serveRename(w http.ResponseWriter, r *http.Request, opt *ServerOpt, newName string) error {
+	name, err := remoteName(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := uploadName(newName); err != nil {
+		return err
+	}
+	if newName, err = remoteName(newName); err != nil {
+		return err
+	}
+	for _, n := range []string{name, newName} {
+		if err := opt.Mounts.allow(n, true); err != nil {
+			return err
+		}
+	}
+	st := opt.Storage
+	if _, err := st.Stat(name); err != nil {
+		return notFoundOr(err)
+	}
+	if _, err := st.Stat(newName); err == nil {
+		return &statusError{Code: http.StatusConflict, Err: fmt.Errorf("%s already exists", newName)}
+	}
+	if err := st.Rename(name, newName); err != nil {
+		return err
+	}
+	renameMeta(st, name, newName)
+	opt.usage.rename(name, newName)
+	opt.used.rename(name, newName)
+
+	log.Printf("file %s renamed to %s by %s", name, newName, Identity(r))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// remoteURL returns the url of the remote file name on the server of the client.
+func (c *Client) remoteURL(name string) (*url.URL, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + strings.TrimPrefix(name, "/")}, nil
+}
+
+// remoteDo sends the remote file management request of the endpoint, and returns the response body and header of 200.
+func (c *Client) remoteDo(ctx context.Context, endpoint, method string, u *url.URL, gulp string) ([]byte, http.Header, error) {
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r = withEndpoint(r, endpoint)
+	r.Header.Set(Authorization, c.Bearer)
+	r.Header.Set("Accept", "application/json")
+	if gulp != "" {
+		r.Header.Set("Content-Gulp", gulp)
+	}
+	q, err := c.Client.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Close(q.Body)
+
+	body, err := io.ReadAll(q.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q.StatusCode != http.StatusOK {
+		return nil, nil, &StatusCodeError{StatusCode: q.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return body, q.Header, nil
+}
+
+// List lists the remote files whose relative paths have the prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]Entry, error) {
+	entries, _, err := c.ListPage(ctx, ListQuery{Prefix: prefix})
+	return entries, err
+}
+
+// ListPage lists a page of the remote files by the query,
+// and returns the cursor of the next page, "" for the last page.
+func (c *Client) ListPage(ctx context.Context, q ListQuery) ([]Entry, string, error) {
+	u, err := c.remoteURL("")
+	if err != nil {
+		return nil, "", err
+	}
+	u.RawQuery = q.values().Encode()
+	body, header, err := c.remoteDo(ctx, "list", http.MethodGet, u, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, "", fmt.Errorf("decode entries: %w", err)
+	}
+	return entries, header.Get(NextCursorHeader), nil
+}
+
+// Stat returns the metadata of the remote file.
+func (c *Client) Stat(ctx context.Context, name string) (*FileStat, error) {
+	u, err := c.remoteURL(name)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := c.remoteDo(ctx, "stat", http.MethodGet, u, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var stat FileStat
+	if err := json.Unmarshal(body, &stat); err != nil {
+		return nil, fmt.Errorf("decode stat: %w", err)
+	}
+	return &stat, nil
+}
+
+// Delete deletes the remote file or empty directory.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	u, err := c.remoteURL(name)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.remoteDo(ctx, "delete", http.MethodDelete, u, "")
+	return err
+}
+
+// Move renames or moves the remote file to newName, it fails when newName exists.
+func (c *Client) Move(ctx context.Context, name, newName string) error {
+	u, err := c.remoteURL(name)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.remoteDo(ctx, "rename", http.MethodPost, u, "Rename="+url.QueryEscape(newName))
+	return err
+}
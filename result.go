@@ -0,0 +1,114 @@
+package goup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+)
+
+// Result is the summary of a finished transfer.
+type Result struct {
+	Operation string `json:"operation"`
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	TotalSize uint64 `json:"totalSize"`
+	// Transferred is the bytes actually sent or received.
+	Transferred uint64 `json:"transferred"`
+	// Skipped is the bytes skipped by the checksum matches.
+	Skipped uint64 `json:"skipped"`
+	// RetriedChunks is the number of chunks needed more than one attempt.
+	RetriedChunks uint64 `json:"retriedChunks"`
+	// Retries is the total number of retried attempts.
+	Retries uint64        `json:"retries"`
+	Elapsed time.Duration `json:"elapsed"`
+	// Throughput is the average transferred bytes per second.
+	Throughput float64 `json:"throughput"`
+	// Cipher is the cipher suite of the chunks, empty when the chunks are disabled.
+	Cipher string `json:"cipher,omitempty"`
+	// Hash is the hex encoded SHA-256 of the local file, empty for unknown.
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Result returns the summary of the last finished transfer, the hash of the local file is computed on the first call.
+func (c *Client) Result() Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.result == nil {
+		return Result{ID: c.ID}
+	}
+	if c.result.Hash == "" && c.result.Error == "" {
+		c.result.Hash = c.localHash()
+	}
+	return *c.result
+}
+
+// finish records the result of the transfer.
+func (c *Client) finish(operation string, err error) {
+	c.stats.finish()
+	st := c.stats.snapshot()
+	r := &Result{
+		Operation:     operation,
+		ID:            c.ID,
+		Path:          c.FullPath,
+		TotalSize:     c.TotalSize,
+		Transferred:   st.Transferred,
+		Skipped:       st.Skipped,
+		RetriedChunks: st.RetriedChunks,
+		Retries:       st.Retries,
+		Elapsed:       st.Elapsed,
+		Throughput:    st.Speed,
+	}
+	if c.Reader != nil {
+		r.Path = c.Rename
+	}
+	if r.TotalSize == 0 && err == nil { // unknown length of the response
+		r.TotalSize = st.Done
+	}
+	if c.ChunkSize > 0 {
+		r.Cipher, _ = parseCipherSuites(c.Cipher)
+	}
+	if err != nil {
+		r.Error = err.Error()
+	} else if c.hasher != nil {
+		r.Hash = hex.EncodeToString(c.hasher.Sum(nil))
+	}
+
+	c.mu.Lock()
+	c.result = r
+	c.mu.Unlock()
+}
+
+// localHash hashes the local file or the io.WriterAt which is also an io.ReaderAt.
+func (c *Client) localHash() string {
+	switch {
+	case c.Reader != nil, c.Writer != nil:
+		return "" // hashed while transferring, or failed
+	case c.WriterAt != nil:
+		ra, ok := c.WriterAt.(io.ReaderAt)
+		if !ok {
+			return ""
+		}
+		return hashReader(io.NewSectionReader(ra, 0, int64(c.result.TotalSize)))
+	}
+
+	if stat, err := os.Stat(c.FullPath); err != nil || !stat.Mode().IsRegular() {
+		return ""
+	}
+	h, _, err := fileHash(c.FullPath)
+	if err != nil {
+		return ""
+	}
+	return h
+}
+
+func hashReader(r io.Reader) string {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
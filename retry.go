@@ -2,36 +2,163 @@ package goup
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"syscall"
 	"time"
 
 	"github.com/vthiery/retry"
 )
 
-func retryJob(f func() error) {
-	// Define the retry strategy, with 10 attempts and an exponential backoff
+// RetryPolicy is the retry policy of the chunk transfers.
+type RetryPolicy struct {
+	// MaxAttempts is the max attempts of a chunk, default 10.
+	MaxAttempts int
+	// Deadline limits the total time of retrying a chunk, no new attempt starts after it, 0 for no limit.
+	Deadline time.Duration
+	// MinWait, MaxWait and MaxJitter are the exponential backoff parameters,
+	// the Retry-After of the 429 and 503 responses overrides the backoff, capped by MaxWait.
+	// A negative MaxJitter disables the jitter.
+	MinWait   time.Duration
+	MaxWait   time.Duration
+	MaxJitter time.Duration
+	// Retryable classifies the errors, default IsRetryable.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy returns the default retry policy, with 10 attempts and an exponential backoff.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 10,
+		MinWait:     100 * time.Millisecond,
+		MaxWait:     1 * time.Hour,
+		MaxJitter:   20 * time.Millisecond,
+		Retryable:   IsRetryable,
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	d := DefaultRetryPolicy()
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.MinWait <= 0 {
+		p.MinWait = d.MinWait
+	}
+	if p.MaxWait <= 0 {
+		p.MaxWait = d.MaxWait
+	}
+	if p.MaxJitter == 0 {
+		p.MaxJitter = d.MaxJitter
+	} else if p.MaxJitter < 0 {
+		p.MaxJitter = 0
+	}
+	if p.Retryable == nil {
+		p.Retryable = d.Retryable
+	}
+	return p
+}
+
+// IsRetryable tells whether the error is transient and worth to retry.
+// Authorization, not found and other client errors are permanent,
+// while 5xx (except 507 of the exhausted quota), 408, 429, the unknown session, timeouts, stalls and connection resets are retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrStalled) {
+		return true
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrUnknownSession) {
+		return true
+	}
+
+	var se *StatusCodeError
+	if errors.As(err, &se) {
+		switch code := se.StatusCode; {
+		case code == http.StatusInsufficientStorage:
+			return false
+		case code >= 500, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return true
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+		return false
+	}
+
+	var pe *fs.PathError
+	return !errors.As(err, &pe)
+}
+
+// retryAfterBackoff waits the Retry-After of the last error if any, or the exponential backoff.
+type retryAfterBackoff struct {
+	retry.Backoff
+	maxWait time.Duration
+	lastErr error
+}
+
+func (b *retryAfterBackoff) Next(attempt int) time.Duration {
+	var se *StatusCodeError
+	if errors.As(b.lastErr, &se) && se.RetryAfter > 0 {
+		if se.RetryAfter > b.maxWait {
+			return b.maxWait
+		}
+		return se.RetryAfter
+	}
+	return b.Backoff.Next(attempt)
+}
+
+func retryJob(ctx context.Context, policy RetryPolicy, f func() error) error {
+	policy = policy.withDefaults()
+	backoff := &retryAfterBackoff{
+		Backoff: retry.NewExponentialBackoff(policy.MinWait, policy.MaxWait, policy.MaxJitter),
+		maxWait: policy.MaxWait,
+	}
+	deadline := ctx
+	if policy.Deadline > 0 {
+		var cancel context.CancelFunc
+		deadline, cancel = context.WithTimeout(ctx, policy.Deadline)
+		defer cancel()
+	}
 	r := retry.New(
-		retry.WithMaxAttempts(10),
-		retry.WithBackoff(
-			retry.NewExponentialBackoff(
-				100*time.Millisecond, // minWait
-				1*time.Hour,          // maxWait
-				20*time.Millisecond,  // maxJitter
-			),
-		),
+		retry.WithMaxAttempts(policy.MaxAttempts),
+		retry.WithBackoff(backoff),
+		// Stop retrying when the transfer is canceled, the deadline passes or the error is permanent
+		retry.WithPolicy(func(err error) bool { return deadline.Err() == nil && policy.Retryable(err) }),
 	)
 
-	// A cancellable context can be used to stop earlier
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	// Define the function that can be retried
 	fn := func(context.Context) error {
-		return f()
+		backoff.lastErr = f()
+		return backoff.lastErr
 	}
 
 	// Call the `retry.Do` to attempt to perform `fn`
-	if err := r.Do(ctx, fn); err != nil {
-		fmt.Printf("failed to perform `fn`: %v\n", err)
+	err := r.Do(deadline, fn)
+	if err != nil && ctx.Err() == nil && deadline.Err() != nil && backoff.lastErr != nil {
+		// the deadline passed in the backoff or the last attempt, report the error of the last attempt
+		return fmt.Errorf("retry deadline %s exceeded: %w", policy.Deadline, backoff.lastErr)
 	}
+	return err
 }
@@ -0,0 +1,68 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusCodeError{StatusCode: 401}, false},
+		{&StatusCodeError{StatusCode: 404}, false},
+		{fmt.Errorf("chunk 1 upload: %w", &StatusCodeError{StatusCode: 503}), true},
+		{&StatusCodeError{StatusCode: 429}, true},
+		{&StatusCodeError{StatusCode: 507}, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, false},
+	}
+	for _, c := range cases {
+		if got := IsRetryable(c.err); got != c.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryJobPermanent(t *testing.T) {
+	attempts := 0
+	err := retryJob(context.Background(), RetryPolicy{}, func() error {
+		attempts++
+		return &StatusCodeError{StatusCode: 401}
+	})
+	if err == nil || attempts != 1 {
+		t.Fatalf("expected 1 attempt with error, got %d: %v", attempts, err)
+	}
+}
+
+func TestRetryJobDeadline(t *testing.T) {
+	lastErr := &StatusCodeError{StatusCode: 503}
+	policy := RetryPolicy{Deadline: 50 * time.Millisecond, MinWait: time.Second, MaxWait: time.Second}
+	err := retryJob(context.Background(), policy, func() error { return lastErr })
+	if !errors.Is(err, lastErr) || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the last error of the attempts, got %v", err)
+	}
+	if strings.Contains(err.Error(), "non-retryable") {
+		t.Fatalf("deadline reported as a permanent error: %v", err)
+	}
+}
+
+func TestRetryPolicyDefaultJitter(t *testing.T) {
+	if p := (RetryPolicy{}).withDefaults(); p.MaxJitter != DefaultRetryPolicy().MaxJitter {
+		t.Fatalf("expected the default jitter, got %s", p.MaxJitter)
+	}
+	if p := (RetryPolicy{MaxJitter: -1}).withDefaults(); p.MaxJitter != 0 {
+		t.Fatalf("expected no jitter, got %s", p.MaxJitter)
+	}
+}
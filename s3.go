@@ -0,0 +1,448 @@
+package goup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/iox"
+)
+
+// S3Storage is the storage of an S3 compatible bucket, like AWS S3 or MinIO.
+// The uploading files are staged in a local directory, and they are put to the bucket when committed,
+// so the chunks can be written at any offsets, the size of a file is limited to 5 GiB by the single PUT.
+type S3Storage struct {
+	// Endpoint is the url of the service, like http://127.0.0.1:9000, the path-style requests are used.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	*http.Client
+
+	staging *LocalStorage
+	// stages serializes the staging of each file, so that a chunk is never overwritten by a concurrent staging.
+	stages nameLocks
+}
+
+// nameLocks is the mutexes by the names, forgotten when unlocked by all.
+type nameLocks struct {
+	sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the name and returns the func to unlock it.
+func (l *nameLocks) lock(name string) func() {
+	l.Mutex.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*nameLock{}
+	}
+	nl, ok := l.locks[name]
+	if !ok {
+		nl = &nameLock{}
+		l.locks[name] = nl
+	}
+	nl.refs++
+	l.Mutex.Unlock()
+
+	nl.Lock()
+	return func() {
+		nl.Unlock()
+		l.Mutex.Lock()
+		if nl.refs--; nl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.Mutex.Unlock()
+	}
+}
+
+// NewS3Storage creates a S3Storage, the uploading files are staged in the stagingDir (default a temporary dir).
+func NewS3Storage(endpoint, bucket, accessKey, secretKey, stagingDir string) *S3Storage {
+	if stagingDir == "" {
+		stagingDir = filepath.Join(os.TempDir(), "goup-s3-staging", bucket)
+	}
+	return &S3Storage{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    "us-east-1",
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{},
+		staging:   NewLocalStorage(stagingDir),
+	}
+}
+
+func (s *S3Storage) staged(name string) bool {
+	_, err := s.staging.Stat(name)
+	return err == nil
+}
+
+// LocalPath returns the local path of the staged file.
+func (s *S3Storage) LocalPath(name string) (string, bool) {
+	if s.staged(name) {
+		return s.staging.LocalPath(name)
+	}
+	return "", false
+}
+
+// OpenWrite opens the staged file to write, the existing object is copied to the staging first,
+// so that the chunks not rewritten are kept.
+func (s *S3Storage) OpenWrite(name string) (StorageFile, error) {
+	name = storageName(name)
+	unlock := s.stages.lock(name)
+	defer unlock()
+
+	if !s.staged(name) {
+		if err := s.stage(name); err != nil {
+			return nil, err
+		}
+	}
+	return s.staging.OpenWrite(name)
+}
+
+// stage copies the object to a temporary staged file, which is renamed when complete,
+// so that the readers never see a partially staged file.
+func (s *S3Storage) stage(name string) error {
+	r, err := s.getObject(name, 0, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer Close(r)
+
+	tmp := name + ".goup-staging"
+	if _, err := writeStorage(s.staging, tmp, r, nil); err != nil {
+		_ = s.staging.Delete(tmp)
+		return err
+	}
+	return s.staging.Rename(tmp, name)
+}
+
+// Commit puts the staged file to the bucket, and removes it from the staging.
+func (s *S3Storage) Commit(name string) error {
+	name = storageName(name)
+	p, _ := s.staging.LocalPath(name)
+	if err := s.putFile(name, p); err != nil {
+		if errors.Is(err, fs.ErrNotExist) { // unchanged
+			return nil
+		}
+		return err
+	}
+	return s.staging.Delete(name)
+}
+
+func (s *S3Storage) putFile(name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer Close(f)
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	q, err := s.do(http.MethodPut, name, nil, f, stat.Size(), nil)
+	if err != nil {
+		return fmt.Errorf("put object %s: %w", name, err)
+	}
+	iox.DiscardClose(q.Body)
+	return nil
+}
+
+// ReadRange opens the bytes [from, to) of the staged file or the object.
+func (s *S3Storage) ReadRange(name string, from, to uint64) (io.ReadCloser, error) {
+	if s.staged(name) {
+		return s.staging.ReadRange(name, from, to)
+	}
+	return s.getObject(name, from, to)
+}
+
+func (s *S3Storage) getObject(name string, from, to uint64) (io.ReadCloser, error) {
+	h := http.Header{}
+	switch {
+	case to > from:
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to-1))
+	case to == 0 && from > 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-", from))
+	case to != 0: // empty range
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	q, err := s.do(http.MethodGet, storageName(name), nil, nil, 0, h)
+	if err != nil {
+		var se *StatusCodeError
+		if errors.As(err, &se) && se.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, err
+	}
+	return q.Body, nil
+}
+
+// Stat returns the info of the staged file, the object or the directory implied by the object keys.
+func (s *S3Storage) Stat(name string) (StorageInfo, error) {
+	name = storageName(name)
+	if info, err := s.staging.Stat(name); err == nil {
+		return info, nil
+	}
+
+	if name != "" {
+		q, err := s.do(http.MethodHead, name, nil, nil, 0, nil)
+		if err == nil {
+			iox.DiscardClose(q.Body)
+			modTime, _ := http.ParseTime(q.Header.Get("Last-Modified"))
+			return StorageInfo{Name: name, Size: q.ContentLength, ModTime: modTime}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return StorageInfo{}, err
+		}
+	}
+
+	objects, _, err := s.listObjects(strings.TrimPrefix(name+"/", "/"), "", 1)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	if len(objects) > 0 {
+		return StorageInfo{Name: name, IsDir: true}, nil
+	}
+	return StorageInfo{}, notExist("stat", name)
+}
+
+// List lists the objects and the staged files whose names have the prefix.
+func (s *S3Storage) List(prefix string) ([]StorageInfo, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	infos := map[string]StorageInfo{}
+	for token := ""; ; {
+		objects, next, err := s.listObjects(prefix, token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			infos[o.Name] = o
+		}
+		if token = next; token == "" {
+			break
+		}
+	}
+
+	staged, err := s.staging.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range staged {
+		infos[o.Name] = o
+	}
+
+	list := make([]StorageInfo, 0, len(infos))
+	for _, o := range infos {
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Delete deletes the staged file and the object.
+func (s *S3Storage) Delete(name string) error {
+	name = storageName(name)
+	stagedErr := s.staging.Delete(name)
+	if _, err := s.Stat(name); err != nil {
+		if stagedErr == nil && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	q, err := s.do(http.MethodDelete, name, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	iox.DiscardClose(q.Body)
+	return nil
+}
+
+// Rename renames the staged file, or copies the object to the new key and deletes the old one.
+func (s *S3Storage) Rename(name, newName string) error {
+	name, newName = storageName(name), storageName(newName)
+	if s.staged(name) {
+		return s.staging.Rename(name, newName)
+	}
+
+	h := http.Header{}
+	h.Set("X-Amz-Copy-Source", "/"+s.Bucket+"/"+s3Escape(name))
+	q, err := s.do(http.MethodPut, newName, nil, nil, 0, h)
+	if err != nil {
+		return fmt.Errorf("copy object %s to %s: %w", name, newName, err)
+	}
+	iox.DiscardClose(q.Body)
+
+	if q, err = s.do(http.MethodDelete, name, nil, nil, 0, nil); err != nil {
+		return err
+	}
+	iox.DiscardClose(q.Body)
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Storage) listObjects(prefix, token string, maxKeys int) ([]StorageInfo, string, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "max-keys": {strconv.Itoa(maxKeys)}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	q, err := s.do(http.MethodGet, "", query, nil, 0, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("list objects %s: %w", prefix, err)
+	}
+	defer Close(q.Body)
+
+	var result s3ListResult
+	if err := xml.NewDecoder(q.Body).Decode(&result); err != nil {
+		return nil, "", fmt.Errorf("decode list objects: %w", err)
+	}
+
+	infos := make([]StorageInfo, 0, len(result.Contents))
+	for _, c := range result.Contents {
+		infos = append(infos, StorageInfo{Name: c.Key, Size: c.Size, ModTime: c.LastModified})
+	}
+	if !result.IsTruncated {
+		return infos, "", nil
+	}
+	return infos, result.NextContinuationToken, nil
+}
+
+// do sends the signed request of the key (the bucket itself when empty),
+// a 404 is returned as fs.ErrNotExist, the other non 2xx statuses as StatusCodeError.
+func (s *S3Storage) do(method, key string, query url.Values, body io.Reader, size int64, h http.Header) (*http.Response, error) {
+	u := s.Endpoint + "/" + s3Escape(s.Bucket)
+	if key != "" {
+		u += "/" + s3Escape(key)
+	}
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+
+	r, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	if body != nil {
+		r.ContentLength = size
+	}
+	s.sign(r, time.Now().UTC())
+
+	q, err := s.Client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if q.StatusCode/100 == 2 {
+		return q, nil
+	}
+
+	defer Close(q.Body)
+	if q.StatusCode == http.StatusNotFound {
+		return nil, notExist(strings.ToLower(method), key)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(q.Body, 1024))
+	log.Printf("E! s3 %s %s failed: %d %s", method, key, q.StatusCode, msg)
+	return nil, &StatusCodeError{StatusCode: q.StatusCode, Body: strings.TrimSpace(string(msg))}
+}
+
+// sign signs the request by AWS Signature Version 4 with the unsigned payload.
+func (s *S3Storage) sign(r *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{"host": r.URL.Host}
+	for k, v := range r.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method, r.URL.EscapedPath(), s3Query(r.URL.Query()),
+		canonicalHeaders.String(), signedHeaders, "UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, v := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set(Authorization, "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the key by the URI encoding of S3, the slashes are kept.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes the sorted query with %20 for spaces.
+func s3Query(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
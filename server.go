@@ -2,26 +2,25 @@ package goup
 
 import (
 	"compress/gzip"
-	"context"
 	_ "embed" // embed
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"mime"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bingoohuang/gg/pkg/codec/b64"
 	"github.com/bingoohuang/gg/pkg/iox"
-	"github.com/bingoohuang/gg/pkg/jsoni"
 	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/bingoohuang/goup/codec"
-	"github.com/bingoohuang/goup/shapeio"
 	"github.com/minio/sio"
 	"github.com/schollz/pake/v3"
 )
@@ -38,80 +37,243 @@ func InitServer() error {
 
 type limitResponseWriter struct {
 	http.ResponseWriter
-	*shapeio.RateLimiter
+	limiter interface{ WaitBytes(n int) error }
 }
 
 // Write writes bytes from p.
 func (s *limitResponseWriter) Write(p []byte) (int, error) {
 	n, err := s.ResponseWriter.Write(p)
-	if err != nil || s.Limiter == nil {
+	if err != nil || n == 0 {
 		return n, err
 	}
 
-	err = s.WaitN(s.Context, n)
+	err = s.limiter.WaitBytes(n)
 	return n, err
 }
 
+// ServerOpt is the server options.
+type ServerOpt struct {
+	// Hooks are run in order when an upload completes.
+	Hooks []Hook
+	// QuarantineDir is the directory to move the files quarantined by hooks.
+	QuarantineDir string
+	// Storage is the backend of the files, default the local storage of RootDir.
+	Storage Storage
+	// Quota limits the uploads.
+	Quota Quota
+	// UsageFile is the JSON file recording the owners of the files for Quota.UserBytes.
+	UsageFile string
+	// Janitor deletes the stale partial uploads and the expired files.
+	Janitor Janitor
+	// Webhooks are sent when the uploads and the downloads complete, or the files are deleted.
+	Webhooks []Webhook
+	// WebhookQueueDir is the directory of the pending webhook deliveries, default .goup-webhooks beside RootDir.
+	WebhookQueueDir string
+	// Mounts maps the URL path prefixes to the directories and the files, it routes the names to their storages over Storage.
+	Mounts *Mounts
+	// StateFile keeps the uploads in progress and the session keys across the graceful restarts,
+	// default .goup-state.json beside RootDir.
+	StateFile string
+	// AdminToken is the bearer token of the admin API, which is disabled if empty.
+	AdminToken string
+	// Bandwidth limits the uploads and the downloads by the global, the per-identity and the per-IP rates,
+	// default the per-IP rate of limitRate of NewServer.
+	Bandwidth Bandwidth
+	// Admission caps the concurrent chunk requests globally and per client.
+	Admission Admission
+
+	// mu guards Hooks, Quota, bandwidth and admission, which are replaced by the setters of Server on the reload.
+	mu        sync.RWMutex
+	usage     *usageLedger
+	used      *storageUsage
+	bandwidth *bandwidthLimiters
+	admission *admission
+	janitor   *janitor
+	webhooks  *webhookQueue
+	done      chan struct{}
+}
+
+// ServerOptFn is the option pattern func prototype for the server.
+type ServerOptFn func(*ServerOpt)
+
+// WithHooks appends post-upload hooks.
+func WithHooks(v ...Hook) ServerOptFn { return func(o *ServerOpt) { o.Hooks = append(o.Hooks, v...) } }
+
+// WithQuarantineDir set QuarantineDir.
+func WithQuarantineDir(v string) ServerOptFn { return func(o *ServerOpt) { o.QuarantineDir = v } }
+
+func newServerOpt(fns ...ServerOptFn) *ServerOpt {
+	opt := &ServerOpt{done: make(chan struct{})}
+	for _, fn := range fns {
+		fn(opt)
+	}
+	if opt.QuarantineDir == "" {
+		opt.QuarantineDir = filepath.Join(filepath.Dir(filepath.Clean(RootDir)), ".goup-quarantine")
+	}
+	if opt.Storage == nil {
+		opt.Storage = NewLocalStorage(RootDir)
+	}
+	if opt.Mounts != nil {
+		opt.Mounts.base, opt.Storage = opt.Storage, opt.Mounts
+	}
+	if opt.StateFile == "" {
+		opt.StateFile = filepath.Join(filepath.Dir(filepath.Clean(RootDir)), ".goup-state.json")
+	}
+	if opt.UsageFile == "" {
+		opt.UsageFile = filepath.Join(filepath.Dir(filepath.Clean(RootDir)), ".goup-usage.json")
+	}
+	if opt.Quota.UserBytes > 0 {
+		opt.usage = newUsageLedger(opt.UsageFile)
+	}
+	// the storage is listed on the first check of the total quota, which may be set on the reload
+	opt.used = newStorageUsage(opt.Storage)
+	if opt.WebhookQueueDir == "" {
+		opt.WebhookQueueDir = filepath.Join(filepath.Dir(filepath.Clean(RootDir)), ".goup-webhooks")
+	}
+	if len(opt.Webhooks) > 0 {
+		opt.webhooks = newWebhookQueue(opt.Webhooks, opt.WebhookQueueDir)
+	}
+	if opt.Janitor.PartialTTL > 0 || len(opt.Janitor.Retentions) > 0 {
+		opt.janitor = newJanitor(opt.Janitor, opt.Storage)
+		opt.janitor.webhooks = opt.webhooks
+		opt.janitor.used = opt.used
+	}
+	return opt
+}
+
+// statusError is an error with the http status code to respond.
+type statusError struct {
+	Code int
+	Err  error
+}
+
+func (e *statusError) Error() string { return e.Err.Error() }
+func (e *statusError) Unwrap() error { return e.Err }
+
 // ServerHandle is main request/response handler for HTTP server.
-func ServerHandle(code, cipher string, chunkSize, limitRate uint64, paths []string) http.HandlerFunc {
+func ServerHandle(code, cipher string, chunkSize, limitRate uint64, paths []string, fns ...ServerOptFn) http.HandlerFunc {
+	return NewServer(code, cipher, chunkSize, limitRate, paths, fns...).ServeHTTP
+}
+
+// NewServer creates the Server, the background jobs are started, and the states saved by the last Shutdown are restored.
+func NewServer(code, cipher string, chunkSize, limitRate uint64, paths []string, fns ...ServerOptFn) *Server {
+	opt := newServerOpt(append(fns, withPaths(paths))...)
+	if opt.Bandwidth == (Bandwidth{}) && limitRate > 0 {
+		opt.Bandwidth.Upload.IP, opt.Bandwidth.Download.IP = limitRate, limitRate
+	}
+	opt.bandwidth = newBandwidthLimiters(opt.Bandwidth)
+	opt.admission = newAdmission(opt.Admission)
+	opt.restoreState()
+	if opt.janitor != nil {
+		opt.janitor.start(opt.done)
+	}
+	if opt.webhooks != nil {
+		opt.webhooks.start(opt.done)
+	}
 	f := func(w http.ResponseWriter, r *http.Request) error {
 		h := ParseHeader(r.Header.Get("Content-Gulp"))
+		if h.Session != "" && h.Admin == "" && transfers.isKilled(h.Session) {
+			return &statusError{Code: http.StatusGone, Err: fmt.Errorf("session %s is killed by admin", h.Session)}
+		}
 		if chunkSize > 0 {
 			r.Body = http.MaxBytesReader(w, r.Body, int64(chunkSize*2)) // with extra 1 MiB, for padding compatible like encryption
 		}
-		if limitRate > 0 {
-			l := shapeio.WithRateLimit(float64(limitRate))
-			r.Body = shapeio.NewReader(r.Body, l)
-			w = &limitResponseWriter{ResponseWriter: w, RateLimiter: shapeio.NewRateLimiter(l)}
+		bandwidth, admission := opt.limiters()
+		if h.Session != "" && h.Range != "" {
+			release, err := admission.admit(w, r)
+			if err != nil {
+				return err
+			}
+			defer release()
 		}
+		w, leave := bandwidth.limit(w, r)
+		defer leave()
 		defer func() {
 			iox.DiscardClose(r.Body)
 		}()
 
 		switch {
+		case h.Admin != "":
+			// 管理接口：会话与传输列表，终止会话、取消上传、关闭下载
+			setEndpoint(r, "admin")
+			return serveAdmin(w, r, h, opt)
 		case h.Filename != "" && r.Method == http.MethodPost:
 			// 明文上传（文件作为 Body)
-			return serveBodyAsFile(r.Body, h.Filename)
+			setEndpoint(r, "body")
+			return serveBodyAsFile(r, h.Filename, opt)
 		case h.Session != "" && h.Curve != "" && r.Method == http.MethodPost:
 			// PAKE 生成会话秘钥
-			return servePake(w, h.Session, code, h.Curve)
+			setEndpoint(r, "pake")
+			return servePake(w, r, h.Session, code, h.Curve)
+		case h.Session != "" && h.Size != "" && r.Method == http.MethodPost:
+			// 流式上传结束，按最终大小截断文件
+			setEndpoint(r, "stream_finish")
+			return serveStreamFinish(w, r, h.Session, h.Size, opt)
+		case h.Rename != "" && r.URL.Path != "/" && r.Method == http.MethodPost:
+			// 重命名/移动文件
+			setEndpoint(r, "rename")
+			return serveRename(w, r, opt, h.Rename)
 		case h.Session != "" && r.URL.Path == "/" && h.Range != "" && ss.AnyOf(r.Method, http.MethodPost, http.MethodGet):
 			// 校验分块 checksum，返回 304 或 其它
 			// 分块加密上传（加密分块作为 Body)
-			return serveUpload(w, r, h.Range, h.Session, cipher, h.Checksum, h.Salt)
+			setEndpoint(r, "upload")
+			return serveUpload(w, r, h.Range, h.Session, cipher, h.Checksum, h.Salt, opt)
 		case r.URL.Path == "/" && r.Method == http.MethodGet:
 			// HTML JS 上传页面 / 服务端文件列表（Accept: application/json 时）
 			if r.Header.Get("Accept") == "application/json" {
-				return servList(w)
+				setEndpoint(r, "list")
+				return servList(w, r, opt)
 			}
+			setEndpoint(r, "page")
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			_, err := w.Write(indexPage)
 			return err
+		case r.URL.Path != "/" && r.Method == http.MethodGet && r.Header.Get("Accept") == "application/json":
+			// 文件元信息（大小、修改时间、SHA-256）
+			setEndpoint(r, "stat")
+			return serveStat(w, r, opt)
+		case r.URL.Path != "/" && r.Method == http.MethodDelete:
+			// 删除文件或空目录
+			setEndpoint(r, "delete")
+			return serveDelete(w, r, opt)
 		case r.URL.Path != "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead): // may be downloads
 			// 明文下载
-			if status := serveDownload(w, r, h.Session, cipher, h.Range, h.Checksum, chunkSize, paths); status > 0 {
+			setEndpoint(r, "download")
+			if status := serveDownload(w, r, opt, h.Session, cipher, h.Range, h.Checksum, chunkSize); status > 0 {
 				w.WriteHeader(status)
 			}
 		case r.Method == http.MethodPost:
 			// 明文上传（multipart-form)
-			return NetHTTPUpload(w, r, RootDir, chunkSize)
+			setEndpoint(r, "multipart")
+			return netHTTPUpload(w, r, opt)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
 		return nil
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return &Server{opt: opt, handle: func(w http.ResponseWriter, r *http.Request) {
 		w1 := newStatWriter(w)
 		start := time.Now()
+		body := &countReadCloser{ReadCloser: r.Body}
+		r = withEndpoint(r, "other")
+		r.Body = body
 
 		if err := f(w1, r); err != nil {
 			log.Printf("E! failed: %v", err)
-			http.Error(w1, err.Error(), http.StatusInternalServerError)
+			code := http.StatusInternalServerError
+			var se *statusError
+			if errors.As(err, &se) {
+				code = se.Code
+			}
+			http.Error(w1, err.Error(), code)
 		}
 		log.Printf("%s %s %s [%d] %d %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, w1.StatusCode,
 			w1.Count, r.Header["Referer"], r.Header["User-Agent"], time.Since(start))
-	}
+		DefaultMetrics.AddBytes("in", int64(body.n))
+		DefaultMetrics.AddBytes("out", int64(w1.Count))
+		DefaultMetrics.ObserveRequest(endpointOf(r), w1.StatusCode, time.Since(start))
+	}}
 }
 
 func newStatWriter(w http.ResponseWriter) *statWriter {
@@ -156,7 +318,7 @@ func getSessionKey(sessionID string) []byte {
 	return nil
 }
 
-func servePake(w http.ResponseWriter, sessionID, code, contentCurve string) error {
+func servePake(w http.ResponseWriter, r *http.Request, sessionID, code, contentCurve string) error {
 	a, err := b64.DecodeString(contentCurve)
 	if err != nil {
 		return fmt.Errorf("base64 decode error: %w", err)
@@ -178,76 +340,65 @@ func servePake(w http.ResponseWriter, sessionID, code, contentCurve string) erro
 	}
 
 	setSessionKey(sessionID, bk)
+	newSessionInfo(r, sessionID)
 	w.Header().Set("Content-Gulp", "Curve="+b64.EncodeBytes2String(bb, b64.Raw, b64.URL))
 	return nil
 }
 
-// Entry is the file item for list.
-type Entry struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-}
-
-func servList(w http.ResponseWriter) error {
-	var entries []Entry
-	if err := filepath.WalkDir(RootDir, func(p string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
-			return err
-		}
-
-		stat, err := d.Info()
-		if err != nil {
-			return err
-		}
-		entries = append(entries, Entry{
-			Name: d.Name(),
-			Size: stat.Size(),
-		})
-		return nil
-	}); err != nil {
-		return fmt.Errorf("walk dir %s: %w", RootDir, err)
-	}
-	return jsoni.NewEncoder(w).Encode(context.Background(), entries)
-}
-
-func serveDownload(w http.ResponseWriter, r *http.Request, sessionID, cipher, contentRange, checksum string, chunkSize uint64, paths []string) int {
-	urlPath := r.URL.Path
-	for _, p := range paths {
-		if strings.HasPrefix(p, urlPath) {
-			p = p[len(urlPath):]
-			switch p[0] {
-			case ':', '=':
-				urlPath = p[1:]
-			}
-		}
+func serveDownload(w http.ResponseWriter, r *http.Request, opt *ServerOpt, sessionID, cipher, contentRange, checksum string, chunkSize uint64) int {
+	name := opt.Mounts.resolve(storageName(r.URL.Path))
+	if err := opt.Mounts.allow(name, false); err != nil {
+		log.Printf("E! %v", err)
+		return http.StatusForbidden
 	}
-	fullPath := filepath.Join(RootDir, "."+urlPath)
-	stat, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
+	st := opt.Storage
+	stat, err := st.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && stat.IsDir || isMetaName(name) {
 		return http.StatusNotFound
+	} else if err != nil {
+		log.Printf("E! stat %s failed: %v", name, err)
+		return http.StatusInternalServerError
 	}
 
-	filename := filepath.Base(fullPath)
+	filename := path.Base(name)
+	if r.Method == http.MethodGet {
+		opt.janitor.accessed(name)
+	}
 
 	if r.Method == http.MethodHead {
 		w.Header().Set(ContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		setMetaHeader(w, st, name)
+		if contentRange != "" && checksum != "" {
+			// 校验文件范围的 checksum，用于多源下载后的一致性检查
+			return checkRange(st, name, contentRange, checksum)
+		}
 		return 0
 	}
 
+	if sessionID == "" || contentRange != "" {
+		var end func()
+		if w, r, end, err = transfers.begin(w, r, "download", sessionID, name); err != nil {
+			log.Printf("E! %v", err)
+			return http.StatusGone
+		}
+		defer end()
+	}
+
 	if sessionID == "" {
-		if err := serveMultipartDownload(w, r, fullPath, filename); err != nil {
+		if err := serveMultipartDownload(w, r, opt, name, uint64(stat.Size)); err != nil {
 			log.Printf("E! serveMultipartDownload failed: %v", err)
 		}
 		return 0
 	}
 
 	if contentRange == "" {
-		totalSize := uint64(stat.Size())
+		totalSize := uint64(stat.Size)
 		partSize := GetPartSize(totalSize, chunkSize, 0)
 		cr := newChunkRange(0, chunkSize, partSize, totalSize)
 		w.Header().Set("Content-Gulp", "Range="+cr.createContentRange())
 		w.Header().Set(ContentType, "application/octet-stream")
 		w.Header().Set(ContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		setMetaHeader(w, st, name)
 		return 0
 	}
 
@@ -258,21 +409,30 @@ func serveDownload(w http.ResponseWriter, r *http.Request, sessionID, cipher, co
 	}
 
 	if checksum != "" {
-		if old, _ := readChunkChecksum(fullPath, cr.From, cr.To); old == checksum {
+		if storageChecksum(st, name, cr.From, cr.To) == checksum {
 			log.Printf("304 file %s with session %s, range %s", filename, sessionID, contentRange)
+			DefaultMetrics.IncChunk(ChunkSkipped)
+			opt.downloaded(r, sessionID, name, cr)
 			return http.StatusNotModified
 		}
 	}
 
-	chunkReader, err := CreateChunkReader(fullPath, cr.From, cr.To, 0)
+	sessionKey := getSessionKey(sessionID)
+	if sessionKey == nil {
+		log.Printf("E! unknown session %s", sessionID)
+		http.Error(w, "unknown session "+sessionID, http.StatusForbidden)
+		return 0
+	}
+
+	chunkReader, err := st.ReadRange(name, cr.From, cr.To)
 	if err != nil {
-		log.Printf("E! CreateChunkReader %s failed: %v", fullPath, err)
+		log.Printf("E! read %s failed: %v", name, err)
 		return http.StatusInternalServerError
 	}
 	defer Close(chunkReader)
 
 	salt := codec.GenSalt(8)
-	key, _, err := codec.Scrypt(getSessionKey(sessionID), salt)
+	key, _, err := codec.Scrypt(sessionKey, salt)
 	if err != nil {
 		log.Printf("E! new key failed: %v", err)
 		return http.StatusInternalServerError
@@ -285,28 +445,44 @@ func serveDownload(w http.ResponseWriter, r *http.Request, sessionID, cipher, co
 	_, cipherSuites := parseCipherSuites(cipher)
 	cfg := sio.Config{Key: key, CipherSuites: cipherSuites}
 	if n, err := sio.Encrypt(w, chunkReader, cfg); err != nil {
-		log.Printf("E! encrypt %s bytes: %d, failed: %v", fullPath, n, err)
+		log.Printf("E! encrypt %s bytes: %d, failed: %v", name, n, err)
 		return http.StatusInternalServerError
 	}
 
 	log.Printf("send file %s with session %s, range %s", filename, sessionID, contentRange)
+	DefaultMetrics.IncChunk(ChunkWritten)
+	opt.downloaded(r, sessionID, name, cr)
 	return 0
 }
 
-func serveMultipartDownload(w http.ResponseWriter, r *http.Request, fullPath, filename string) error {
-	partFrom, partTo := uint64(0), uint64(0)
+// downloaded emits the download event when all the chunks of the file are sent in the session.
+func (o *ServerOpt) downloaded(r *http.Request, sessionID, name string, cr *chunkRange) {
+	downloads.prune(time.Now().Add(-time.Hour)) // forgets the aborted ones
+	if downloads.mark(sessionID+":"+name, sessionID, Identity(r), cr) && o.webhooks != nil {
+		o.webhooks.emit(o.fileEvent(EventDownload, name, Identity(r)))
+	}
+}
+
+func serveMultipartDownload(w http.ResponseWriter, r *http.Request, opt *ServerOpt, name string, size uint64) error {
+	partFrom, partTo := uint64(0), size
 	if v := r.Header.Get("Range"); v != "" {
 		if cr, _ := parseRange(v); cr != nil {
 			partFrom = cr.startByte
-			partTo = cr.endByte
+			if cr.endByte > 0 && cr.endByte < size {
+				partTo = cr.endByte + 1 // the end of http Range is inclusive
+			}
 		}
 	}
-	chunkReader, err := CreateChunkReader(fullPath, partFrom, partTo, 0)
+	if partFrom > partTo {
+		partFrom = partTo
+	}
+	chunkReader, err := opt.Storage.ReadRange(name, partFrom, partTo)
 	if err != nil {
 		return err
 	}
 	defer Close(chunkReader)
 
+	filename := path.Base(name)
 	var dst io.Writer = w
 	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && !ss.HasSuffix(filename, ".gz", ".zip") {
 		w.Header().Set("Content-Encoding", "gzip")
@@ -314,30 +490,55 @@ func serveMultipartDownload(w http.ResponseWriter, r *http.Request, fullPath, fi
 		defer iox.Close(gz)
 		dst = gz
 	} else {
-		w.Header().Set(ContentLength, fmt.Sprintf("%d", chunkReader.(PayloadFileReader).FileSize()))
+		w.Header().Set(ContentLength, fmt.Sprintf("%d", partTo-partFrom))
 	}
 	w.Header().Set(ContentType, "application/octet-stream")
 	w.Header().Set(ContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	setMetaHeader(w, opt.Storage, name)
 
-	n, err := io.Copy(dst, chunkReader)
-	log.Printf("E! send file %s bytes: %d, failed: %v", fullPath, n, err)
+	if n, err := io.Copy(dst, chunkReader); err != nil {
+		log.Printf("E! send file %s bytes: %d, failed: %v", name, n, err)
+	} else if partTo == size && opt.webhooks != nil {
+		opt.webhooks.emit(opt.fileEvent(EventDownload, name, Identity(r)))
+	}
 	return nil
 }
 
-func serveBodyAsFile(src io.Reader, contentFilename string) error {
-	fullPath := filepath.Join(RootDir, contentFilename)
-	f, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0o755)
+func serveBodyAsFile(r *http.Request, contentFilename string, opt *ServerOpt) error {
+	name, err := uploadName(contentFilename)
 	if err != nil {
-		return fmt.Errorf("open file %s error: %w", fullPath, err)
+		return err
+	}
+	if err := opt.Mounts.allow(name, true); err != nil {
+		return err
+	}
+	identity := Identity(r)
+	body := io.Reader(r.Body)
+	if r.ContentLength >= 0 {
+		if err := opt.checkQuota(name, identity, r.ContentLength); err != nil {
+			return err
+		}
+	} else { // unknown length, checked as the bytes arrive
+		body = &quotaReader{Reader: body, max: opt.quota().MaxFileSize,
+			check: func(size int64) error { return opt.checkQuota(name, identity, size) }}
 	}
-	defer Close(f)
 
-	if _, err := io.Copy(f, src); err != nil {
-		return fmt.Errorf("write file %s error: %w", fullPath, err)
+	// the body is staged, so that a rejected or broken upload leaves the existing file intact
+	staging := fmt.Sprintf("%s.goup-body-%d", name, time.Now().UnixNano())
+	_, err = writeStorage(opt.Storage, staging, body, nil)
+	if err == nil {
+		err = opt.Storage.Rename(staging, name)
+	}
+	if err != nil {
+		if de := opt.Storage.Delete(staging); de != nil && !errors.Is(de, fs.ErrNotExist) {
+			log.Printf("E! remove %s failed: %v", staging, de)
+		}
+		opt.used.update(name)
+		return err
 	}
 
-	log.Printf("file pushed %s", fullPath)
-	return nil
+	log.Printf("file pushed %s", name)
+	return opt.complete(r, name)
 }
 
 type countReadCloser struct {
@@ -353,7 +554,7 @@ func (c *countReadCloser) Read(p []byte) (n int, err error) {
 	return
 }
 
-func serveUpload(w http.ResponseWriter, r *http.Request, contentRange, sessionID, cipher, contentChecksum, headerSalt string) error {
+func serveUpload(w http.ResponseWriter, r *http.Request, contentRange, sessionID, cipher, contentChecksum, headerSalt string, opt *ServerOpt) error {
 	cr, err := parseContentRange(contentRange)
 	if err != nil {
 		return fmt.Errorf("parse contentRange %s error: %w", contentRange, err)
@@ -363,12 +564,44 @@ func serveUpload(w http.ResponseWriter, r *http.Request, contentRange, sessionID
 		return fmt.Errorf("parse Content-Disposition error: %w", err)
 	}
 
-	filename := params["filename"]
-	fullPath := filepath.Join(RootDir, filename)
+	name, err := uploadName(params["filename"])
+	if err != nil {
+		return err
+	}
+	if err := opt.Mounts.allow(name, true); err != nil {
+		return err
+	}
+	w, r, end, err := transfers.begin(w, r, "upload", sessionID, name)
+	defer end()
+	if err != nil {
+		return err
+	}
+
+	// the retried chunk of a completed upload gets its result, instead of starting the upload over
+	if c := uploads.completion(name, sessionID, cr.TotalSize); c != nil && !cr.Streaming {
+		if err := c.wait(r.Context()); err != nil {
+			return err
+		}
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		_, err := w.Write([]byte(contentRange))
+		return err
+	}
 
 	if r.Method == http.MethodGet {
 		if contentChecksum != "" {
-			if old, _ := readChunkChecksum(fullPath, cr.From, cr.To); old == contentChecksum {
+			if storageChecksum(opt.Storage, name, cr.From, cr.To) == contentChecksum {
+				if cr.Streaming && getSessionKey(sessionID) != nil {
+					streams.mark(sessionID, name)
+				}
+				if !cr.Streaming && uploads.mark(name, sessionID, Identity(r), cr) {
+					if err := opt.completeUpload(r, name, sessionID); err != nil {
+						return err
+					}
+				}
+				DefaultMetrics.IncChunk(ChunkSkipped)
 				w.WriteHeader(http.StatusNotModified)
 			}
 		}
@@ -376,37 +609,142 @@ func serveUpload(w http.ResponseWriter, r *http.Request, contentRange, sessionID
 		return nil
 	}
 
+	sessionKey := getSessionKey(sessionID)
+	if sessionKey == nil {
+		return &statusError{Code: http.StatusForbidden, Err: fmt.Errorf("unknown session %s", sessionID)}
+	}
 	salt, err := b64.DecodeString(headerSalt)
 	if err != nil {
 		return err
 	}
-	key, _, err := codec.Scrypt(getSessionKey(sessionID), []byte(salt))
+	key, _, err := codec.Scrypt(sessionKey, []byte(salt))
 	if err != nil {
 		return err
 	}
 
-	f, err := openChunk(fullPath, cr)
+	// checks the quota when the upload starts, or on every chunk of a streaming upload whose total size is unknown
+	started := uploads.started(name, cr.TotalSize)
+	if cr.Streaming || !started {
+		size := int64(cr.TotalSize)
+		if cr.Streaming {
+			size = int64(cr.To)
+		}
+		if err := opt.checkQuota(name, Identity(r), size); err != nil {
+			return err
+		}
+	}
+	// marks the file partial in the storage, until the upload completes
+	if cr.Streaming && !streams.streamed(sessionID, name) || !cr.Streaming && !started {
+		markPartial(opt.Storage, name)
+	}
+
+	f, err := openStorageChunk(opt.Storage, name, cr)
 	if err != nil {
 		return err
 	}
-	defer Close(f)
 
 	_, cipherSuites := parseCipherSuites(cipher)
 
 	body := &countReadCloser{ReadCloser: r.Body}
-	n, err := sio.Decrypt(f, body, sio.Config{Key: key, CipherSuites: cipherSuites})
+	n, err := sio.Decrypt(&offsetWriter{WriterAt: f, Offset: int64(cr.From)}, body, sio.Config{Key: key, CipherSuites: cipherSuites})
+	if ce := f.Close(); err == nil {
+		err = ce
+	}
 	if err != nil {
-		return fmt.Errorf("decrypt %s bytes: %d, error: %w", fullPath, n, err)
+		if isDecryptError(err) {
+			DefaultMetrics.IncChunk(ChunkDecryptFailed)
+		}
+		if errors.Is(err, errTransferClosed) {
+			return &statusError{Code: http.StatusGone, Err: err}
+		}
+		return fmt.Errorf("decrypt %s bytes: %d, error: %w", name, n, err)
+	}
+	DefaultMetrics.IncChunk(ChunkWritten)
+	if cr.Streaming {
+		streams.mark(sessionID, name)
+	}
+	if !cr.Streaming {
+		if uploads.mark(name, sessionID, Identity(r), cr) {
+			if err := opt.completeUpload(r, name, sessionID); err != nil {
+				return err
+			}
+		} else if c := uploads.completion(name, sessionID, cr.TotalSize); c != nil {
+			// the chunk is retried while its first attempt completes the upload
+			if err := c.wait(r.Context()); err != nil {
+				return err
+			}
+		}
 	}
 	if _, err := w.Write([]byte(contentRange)); err != nil {
-		return fmt.Errorf("write file %s error: %w", fullPath, err)
+		return fmt.Errorf("write file %s error: %w", name, err)
 	}
 
 	log.Printf("recv file %s with session %s, range %s, bytes: %d, original bytes: %d",
-		filename, sessionID, contentRange, n, body.n)
+		name, sessionID, contentRange, n, body.n)
 	return nil
 }
 
+// completeUpload completes the chunked upload of the session, and records the result for its retried chunks.
+func (o *ServerOpt) completeUpload(r *http.Request, name, sessionID string) error {
+	err := o.complete(r, name)
+	uploads.finish(name, sessionID, err)
+	return err
+}
+
+// serveStreamFinish handles the closing request of a streaming upload, which sends the final size.
+func serveStreamFinish(w http.ResponseWriter, r *http.Request, sessionID, size string, opt *ServerOpt) error {
+	totalSize, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return &statusError{Code: http.StatusBadRequest, Err: fmt.Errorf("parse size %s error: %w", size, err)}
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get(ContentDisposition))
+	if err != nil {
+		return fmt.Errorf("parse Content-Disposition error: %w", err)
+	}
+
+	name, err := uploadName(params["filename"])
+	if err != nil {
+		return err
+	}
+	if getSessionKey(sessionID) == nil {
+		return &statusError{Code: http.StatusForbidden, Err: fmt.Errorf("unknown session %s", sessionID)}
+	}
+	if !streams.streamed(sessionID, name) {
+		return &statusError{Code: http.StatusForbidden, Err: fmt.Errorf("session %s did not stream into %s", sessionID, name)}
+	}
+	if err := opt.Mounts.allow(name, true); err != nil {
+		return err
+	}
+	if err := opt.checkQuota(name, Identity(r), int64(totalSize)); err != nil {
+		return err
+	}
+	f, err := openStorageChunk(opt.Storage, name, &chunkRange{TotalSize: totalSize})
+	if err != nil {
+		return err
+	}
+	Close(f)
+
+	log.Printf("stream file %s with session %s finished, size: %d", name, sessionID, totalSize)
+	if err := opt.complete(r, name); err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte(fmt.Sprintf("bytes */%d", totalSize)))
+	return err
+}
+
+// checkRange returns 304 when the checksum of the range of the file matches, or else 412.
+func checkRange(st Storage, name, contentRange, checksum string) int {
+	cr, err := parseContentRange(contentRange)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	if storageChecksum(st, name, cr.From, cr.To) != checksum {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusNotModified
+}
+
 func parseCipherSuites(cipher string) (string, []byte) {
 	switch cipher {
 	case "AES256":
@@ -18,6 +18,34 @@ type RateLimiterSetter interface {
 type RateLimiter struct {
 	*rate.Limiter
 	context.Context
+	// OnWait is called with the duration blocked by the rate limit.
+	OnWait func(time.Duration)
+}
+
+func (s *RateLimiter) SetOnWait(f func(time.Duration)) {
+	s.OnWait = f
+}
+
+// WaitBytes waits the rate limit of n bytes, by the pieces up to the burst of the limiter,
+// and reports the blocked duration to OnWait.
+func (s *RateLimiter) WaitBytes(n int) (err error) {
+	start, waited := time.Now(), false
+	for n > 0 && err == nil {
+		m := n
+		if b := s.Burst(); b > 0 && m > b {
+			m = b
+		}
+		n -= m
+		if s.OnWait != nil && s.AllowN(time.Now(), m) {
+			continue
+		}
+		waited = true
+		err = s.WaitN(s.Context, m)
+	}
+	if waited && s.OnWait != nil {
+		s.OnWait(time.Since(start))
+	}
+	return err
 }
 
 func (s *RateLimiter) SetContext(ctx context.Context) {
@@ -43,6 +71,7 @@ type Writer struct {
 type LimitConfig struct {
 	context.Context
 	RateLimit float64
+	OnWait    func(time.Duration)
 }
 
 type LimitConfigFn func(*LimitConfig)
@@ -59,6 +88,13 @@ func WithRateLimit(rateLimit float64) LimitConfigFn {
 	}
 }
 
+// WithOnWait sets the func called with the duration blocked by the rate limit, like the metrics.
+func WithOnWait(f func(time.Duration)) LimitConfigFn {
+	return func(c *LimitConfig) {
+		c.OnWait = f
+	}
+}
+
 // NewReader returns a reader that implements io.Reader with rate limiting.
 func NewReader(r io.Reader, fns ...LimitConfigFn) *Reader {
 	s := &Reader{ReadCloser: WrapReadCloser(r)}
@@ -93,6 +129,9 @@ func NewRateLimiterSetter(w RateLimiterSetter, fns ...LimitConfigFn) {
 	if c.RateLimit > 0 {
 		w.SetRateLimit(c.RateLimit)
 	}
+	if o, ok := w.(interface{ SetOnWait(func(time.Duration)) }); ok && c.OnWait != nil {
+		o.SetOnWait(c.OnWait)
+	}
 }
 
 // Read reads bytes into p.
@@ -102,7 +141,7 @@ func (s *Reader) Read(p []byte) (int, error) {
 		return n, err
 	}
 
-	err = s.WaitN(s.Context, n)
+	err = s.WaitBytes(n)
 	return n, err
 }
 
@@ -113,7 +152,7 @@ func (s *Writer) Write(p []byte) (int, error) {
 		return n, err
 	}
 
-	err = s.WaitN(s.Context, n)
+	err = s.WaitBytes(n)
 	return n, err
 }
 
@@ -0,0 +1,109 @@
+package goup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// WithStateFile set StateFile.
+func WithStateFile(v string) ServerOptFn { return func(o *ServerOpt) { o.StateFile = v } }
+
+// Server is the goup server, which drains the in-flight requests on Shutdown.
+type Server struct {
+	opt      *ServerOpt
+	handle   http.HandlerFunc
+	draining int32
+	inflight int64
+}
+
+// ServeHTTP serves the request, or refuses it with 503 when the server is shutting down.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 && !isAdminRequest(r, s.opt.AdminToken) {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	s.handle(w, r)
+}
+
+// Shutdown refuses the new requests, waits the in-flight ones to finish until ctx is done,
+// then stops the background jobs, and saves the uploads in progress for the clients to resume after the restart,
+// the session keys are not saved, the clients negotiate them again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return nil
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+	for atomic.LoadInt64(&s.inflight) > 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			log.Printf("W! shutdown with %d requests in flight: %v", atomic.LoadInt64(&s.inflight), err)
+		}
+	}
+
+	close(s.opt.done)
+	s.opt.janitor.flush()
+	if se := s.opt.saveState(); se != nil {
+		log.Printf("E! save state %s failed: %v", s.opt.StateFile, se)
+	}
+	return err
+}
+
+// serverState is the state saved on shutdown.
+type serverState struct {
+	Uploads []savedUpload `json:"uploads"`
+	// Killed is the sessions killed by the admin, which stay refused after the restart.
+	Killed map[string]time.Time `json:"killed,omitempty"`
+}
+
+func (o *ServerOpt) saveState() error {
+	state := serverState{Uploads: uploads.states(), Killed: transfers.killedSessions()}
+
+	data, _ := json.Marshal(state)
+	if err := ensureDir(filepath.Dir(o.StateFile)); err != nil {
+		return err
+	}
+	return os.WriteFile(o.StateFile, data, 0o600)
+}
+
+// restoreState restores the state saved by the last shutdown, the file is removed after restored.
+func (o *ServerOpt) restoreState() {
+	data, err := os.ReadFile(o.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	var state serverState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		log.Printf("E! restore state %s failed: %v", o.StateFile, err)
+		return
+	}
+
+	uploads.restore(state.Uploads)
+	transfers.restoreKilled(state.Killed)
+	if err := os.Remove(o.StateFile); err != nil {
+		log.Printf("E! remove state %s failed: %v", o.StateFile, err)
+	}
+	log.Printf("restored %d uploads in progress from %s", len(state.Uploads), o.StateFile)
+}
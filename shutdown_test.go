@@ -0,0 +1,122 @@
+package goup
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	setupTestRoot(t)
+	stateFile := t.TempDir() + "/state.json"
+	release := make(chan struct{})
+	hook := Hook{Name: "slow", Func: func(ctx context.Context, e HookEvent) error {
+		<-release
+		return nil
+	}}
+	s := NewServer("", "", 0, 0, nil, WithHooks(hook), WithStateFile(stateFile))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	uploads.mark("partial.bin", "s1", "", &chunkRange{From: 0, To: 5, PartSize: 5, TotalSize: 10})
+	setSessionKey("s1", []byte("key"))
+	defer pakeCache.Delete("s1")
+	transfers.kill("killed")
+
+	done := make(chan int)
+	go func() {
+		r, _ := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader([]byte("hello")))
+		r.Header.Set("Content-Gulp", "Filename=slow.txt")
+		rsp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			done <- 0
+			return
+		}
+		rsp.Body.Close()
+		done <- rsp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond) // the upload is in the hook
+
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+	if rsp, err := http.Get(ts.URL + "/slow.txt"); err != nil || rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while draining, got %v", err)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown before the in-flight upload finished")
+	default:
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("in-flight upload failed with %d", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(stateFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected state file %v, %v", info, err)
+	}
+
+	// restarts
+	uploads.expire("partial.bin", time.Now())
+	pakeCache.Delete("s1")
+	transfers.Lock()
+	delete(transfers.killed, "killed")
+	transfers.Unlock()
+	s2 := NewServer("", "", 0, 0, nil, WithStateFile(stateFile))
+	defer s2.Shutdown(context.Background())
+	defer uploads.expire("partial.bin", time.Now())
+	if !uploads.started("partial.bin", 10) {
+		t.Fatal("state not restored")
+	}
+	if getSessionKey("s1") != nil {
+		t.Fatal("session key restored from the state file")
+	}
+	if !transfers.isKilled("killed") {
+		t.Fatal("killed session not restored")
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatal("state file not removed after restored")
+	}
+}
+
+func TestUnknownSessionRenewed(t *testing.T) {
+	root := setupTestRoot(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8*1024)
+	_ = os.WriteFile(root+"/a.bin", data, 0o644)
+
+	h := ServerHandle("code", "", 64*1024, 0, nil)
+	forgotten := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gulp := ParseHeader(r.Header.Get("Content-Gulp"))
+		if gulp.Range != "" && (gulp.Salt != "" || r.URL.Path != "/") && !forgotten[gulp.Session] {
+			forgotten[gulp.Session] = true
+			pakeCache.Delete(gulp.Session) // like restarted
+		}
+		h(w, r)
+	}))
+	defer ts.Close()
+
+	src := writeTestFile(t, 128*1024)
+	up, _ := New(ts.URL, WithFullPath(src), WithRename("b.bin"), WithChunkSize(64*1024), WithCode("code"),
+		WithRetryPolicy(RetryPolicy{MinWait: time.Millisecond}))
+	if err := up.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	down, _ := New(ts.URL+"/a.bin", WithWriter(&buf), WithChunkSize(64*1024), WithCode("code"),
+		WithRetryPolicy(RetryPolicy{MinWait: time.Millisecond}))
+	if err := down.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !forgotten[up.ID] || !forgotten[down.ID] || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("unexpected forgotten %v, downloaded %d bytes", forgotten, buf.Len())
+	}
+}
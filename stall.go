@@ -0,0 +1,149 @@
+package goup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStallTimeout is the default idle period to abort a chunk attempt.
+const DefaultStallTimeout = time.Minute
+
+// DefaultResponseTimeout is the default time limit of waiting the response after a chunk is sent,
+// it is longer than DefaultStallTimeout because the server may run the post-upload hooks before responding.
+const DefaultResponseTimeout = 10 * time.Minute
+
+// ErrStalled is the error of a chunk attempt aborted because no bytes moved for the stall timeout.
+var ErrStalled = errors.New("chunk transfer stalled")
+
+// WithStallTimeout set StallTimeout, negative to disable the stall detection.
+func WithStallTimeout(v time.Duration) OptFn { return func(c *Opt) { c.StallTimeout = v } }
+
+// WithResponseTimeout set ResponseTimeout, negative to wait the responses without limit.
+func WithResponseTimeout(v time.Duration) OptFn { return func(c *Opt) { c.ResponseTimeout = v } }
+
+// WithTransferTimeout set TransferTimeout.
+func WithTransferTimeout(v time.Duration) OptFn { return func(c *Opt) { c.TransferTimeout = v } }
+
+// stallWatch records the last time that bytes moved in a chunk attempt.
+type stallWatch struct {
+	last    int64 // unix nano
+	waiting int32 // 1 when the upload body is sent and the response is awaited, or before the request starts
+	stalled int32
+}
+
+type stallWatchKey struct{}
+
+func (w *stallWatch) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+	atomic.StoreInt32(&w.waiting, 0)
+}
+
+// sent switches the watch to wait the other side, until the bytes move again.
+func (w *stallWatch) sent() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+	atomic.StoreInt32(&w.waiting, 1)
+}
+
+// wrote keeps waiting the response of an upload after its body is sent,
+// or else bounds the response of the request without body by the stall timeout.
+func (w *stallWatch) wrote() {
+	if atomic.LoadInt32(&w.waiting) == 1 {
+		w.sent()
+	} else {
+		w.touch()
+	}
+}
+
+func (w *stallWatch) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+}
+
+type stallReader struct {
+	io.Reader
+	w *stallWatch
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.w.touch()
+	}
+	if err == io.EOF {
+		r.w.sent()
+	}
+	return n, err
+}
+
+// watchReader touches the stall watch of the chunk attempt on every read,
+// so that a large chunk is not aborted as long as its bytes keep moving,
+// and the wait after the request body is sent is limited by ResponseTimeout instead.
+func watchReader(ctx context.Context, r io.Reader) io.Reader {
+	if w, ok := ctx.Value(stallWatchKey{}).(*stallWatch); ok {
+		return &stallReader{Reader: r, w: w}
+	}
+	return r
+}
+
+// watchStall wraps the chunk job with a watchdog, which aborts the attempt
+// when the bytes stop moving for StallTimeout, like on a half-open connection, from connecting until the response is read,
+// or no response arrives for ResponseTimeout, before the request starts or after the upload body is sent.
+func (c *Client) watchStall(job func(ctx context.Context, i uint64) error) func(ctx context.Context, i uint64) error {
+	timeout, responseTimeout := c.StallTimeout, c.ResponseTimeout
+	if timeout == 0 {
+		timeout = DefaultStallTimeout
+	}
+	if responseTimeout == 0 {
+		responseTimeout = DefaultResponseTimeout
+	}
+	if timeout < 0 {
+		return job
+	}
+
+	return func(ctx context.Context, i uint64) error {
+		w := &stallWatch{}
+		w.sent() // nothing moves before the request is sent, like deriving the key
+		ctx, cancel := context.WithCancel(context.WithValue(ctx, stallWatchKey{}, w))
+		defer cancel()
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GetConn:      func(string) { w.touch() },
+			WroteRequest: func(httptrace.WroteRequestInfo) { w.wrote() },
+		})
+
+		done := make(chan struct{})
+		defer close(done)
+		var stallErr error
+		go func() {
+			ticker := time.NewTicker(timeout / 4)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					limit, reason := timeout, "no bytes moved"
+					if atomic.LoadInt32(&w.waiting) == 1 {
+						limit, reason = responseTimeout, "no response"
+					}
+					if limit > 0 && w.idle() >= limit {
+						stallErr = fmt.Errorf("%w: %s for %s", ErrStalled, reason, limit)
+						atomic.StoreInt32(&w.stalled, 1)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+
+		err := job(ctx, i)
+		if err != nil && atomic.LoadInt32(&w.stalled) == 1 {
+			return stallErr
+		}
+		return err
+	}
+}
@@ -0,0 +1,508 @@
+package goup
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is the backend of the server files, the names are slash separated paths relative to its root.
+type Storage interface {
+	// OpenWrite opens the file to write at offsets, the file is created if not exists.
+	OpenWrite(name string) (StorageFile, error)
+	// ReadRange opens the bytes [from, to) of the file, to 0 means to the end.
+	ReadRange(name string, from, to uint64) (io.ReadCloser, error)
+	// Stat returns the info of the file or the directory, an error of fs.ErrNotExist if not exists.
+	Stat(name string) (StorageInfo, error)
+	// List lists the files recursively whose names have the prefix.
+	List(prefix string) ([]StorageInfo, error)
+	// Delete deletes the file or the empty directory.
+	Delete(name string) error
+	// Rename renames the file.
+	Rename(name, newName string) error
+}
+
+// StorageFile is a file opened by Storage.OpenWrite.
+type StorageFile interface {
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+}
+
+// StorageInfo is the info of a file in Storage.
+type StorageInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// StorageCommitter is implemented by the storages which stage the uploading files,
+// Commit is called when the file is completely uploaded.
+type StorageCommitter interface {
+	Commit(name string) error
+}
+
+// LocalPather is implemented by the storages which keep the files (or the staged files) on the local disk,
+// the hooks run on the local path.
+type LocalPather interface {
+	LocalPath(name string) (string, bool)
+}
+
+// WithStorage set Storage, default the local storage of RootDir.
+func WithStorage(v Storage) ServerOptFn { return func(o *ServerOpt) { o.Storage = v } }
+
+// ParseStorage parses the storage spec, like local:/data, mem: or
+// s3://accessKey:secretKey@127.0.0.1:9000/bucket?region=us-east-1&tls=false&staging=/tmp/goup.
+func ParseStorage(spec string) (Storage, error) {
+	switch {
+	case spec == "", spec == "local":
+		return NewLocalStorage(RootDir), nil
+	case strings.HasPrefix(spec, "local:"):
+		return NewLocalStorage(strings.TrimPrefix(spec, "local:")), nil
+	case spec == "mem", spec == "mem:":
+		return NewMemStorage(), nil
+	case strings.HasPrefix(spec, "s3://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("parse storage %s: %w", spec, err)
+		}
+		q := u.Query()
+		scheme := "https"
+		if q.Get("tls") == "false" {
+			scheme = "http"
+		}
+		secretKey, _ := u.User.Password()
+		s := NewS3Storage(scheme+"://"+u.Host, strings.Trim(u.Path, "/"), u.User.Username(), secretKey, q.Get("staging"))
+		if v := q.Get("region"); v != "" {
+			s.Region = v
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown storage %s", spec)
+	}
+}
+
+// storageName cleans the slash separated name so that it never escapes the root, "" for the root.
+func storageName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// storageChecksum returns the checksum of the range of the file, "" if the file not exists.
+func storageChecksum(st Storage, name string, from, to uint64) string {
+	r, err := st.ReadRange(name, from, to)
+	if err != nil {
+		return ""
+	}
+	defer Close(r)
+
+	return checksumReader(r)
+}
+
+// storageHash returns the hex encoded SHA-256 and the size of the file.
+func storageHash(st Storage, name string) (string, int64, error) {
+	r, err := st.ReadRange(name, 0, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	defer Close(r)
+
+	return hashReaderN(r)
+}
+
+// writeStorage writes the chunk to the file, the whole file is replaced when cr is nil.
+func writeStorage(st Storage, name string, r io.Reader, cr *chunkRange) (int64, error) {
+	f, err := openStorageChunk(st, name, cr)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &offsetWriter{WriterAt: f}
+	if cr != nil {
+		w.Offset = int64(cr.From)
+	}
+	n, err := io.Copy(w, r)
+	if ce := f.Close(); err == nil {
+		err = ce
+	}
+	if err != nil {
+		return n, fmt.Errorf("write file %s error: %w", name, err)
+	}
+	return n, nil
+}
+
+// openStorageChunk opens the file to write the chunk, the file is truncated to its total size.
+func openStorageChunk(st Storage, name string, cr *chunkRange) (StorageFile, error) {
+	f, err := st.OpenWrite(name)
+	if err != nil {
+		return nil, fmt.Errorf("open file %s error: %w", name, err)
+	}
+
+	var size int64
+	switch {
+	case cr == nil:
+	case cr.Streaming:
+		return f, nil
+	default:
+		size = int64(cr.TotalSize)
+	}
+	if err := f.Truncate(size); err != nil {
+		Close(f)
+		return nil, fmt.Errorf("truncate file %s to size %d error: %w", name, size, err)
+	}
+	return f, nil
+}
+
+// LocalStorage is the storage of the local directory.
+type LocalStorage struct {
+	Root string
+}
+
+// NewLocalStorage creates a LocalStorage of the root directory.
+func NewLocalStorage(root string) *LocalStorage { return &LocalStorage{Root: root} }
+
+// LocalPath returns the local path of the file.
+func (s *LocalStorage) LocalPath(name string) (string, bool) { return joinRoot(s.Root, name), true }
+
+func (s *LocalStorage) path(name string) string { return joinRoot(s.Root, name) }
+
+// OpenWrite opens the file to write, the parent directories are created if not exist.
+func (s *LocalStorage) OpenWrite(name string) (StorageFile, error) {
+	p := s.path(name)
+	if err := ensureDir(filepath.Dir(p)); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0o755)
+}
+
+// ReadRange opens the bytes [from, to) of the file.
+func (s *LocalStorage) ReadRange(name string, from, to uint64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if to == 0 {
+		stat, err := f.Stat()
+		if err != nil {
+			Close(f)
+			return nil, err
+		}
+		to = uint64(stat.Size())
+	}
+	if to < from {
+		to = from
+	}
+	return Wrap(io.NewSectionReader(f, int64(from), int64(to-from)), f), nil
+}
+
+// Stat returns the info of the file or the directory.
+func (s *LocalStorage) Stat(name string) (StorageInfo, error) {
+	stat, err := os.Stat(s.path(name))
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: storageName(name), Size: stat.Size(), ModTime: stat.ModTime(), IsDir: stat.IsDir()}, nil
+}
+
+// List lists the files recursively whose names have the prefix.
+func (s *LocalStorage) List(prefix string) ([]StorageInfo, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	var infos []StorageInfo
+	err := filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == s.Root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			// skip the directories out of the prefix
+			if dir := rel + "/"; rel != "." && !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(rel, prefix) {
+			return nil
+		}
+
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, StorageInfo{Name: rel, Size: stat.Size(), ModTime: stat.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk dir %s: %w", s.Root, err)
+	}
+	return infos, nil
+}
+
+// Delete deletes the file or the empty directory.
+func (s *LocalStorage) Delete(name string) error { return os.Remove(s.path(name)) }
+
+// Rename renames the file, the parent directories of newName are created if not exist.
+func (s *LocalStorage) Rename(name, newName string) error {
+	p := s.path(newName)
+	if err := ensureDir(filepath.Dir(p)); err != nil {
+		return err
+	}
+	return os.Rename(s.path(name), p)
+}
+
+// MemStorage is the in-memory storage, the directories are implied by the file names.
+type MemStorage struct {
+	sync.RWMutex
+	files map[string]*memFile
+}
+
+// memPageSize is the page size of the in-memory files, the pages never written are the holes of zeros,
+// so that truncating to a large size allocates nothing.
+const memPageSize = 64 << 10
+
+type memFile struct {
+	size    int64
+	pages   map[int64][]byte // by the page index
+	modTime time.Time
+}
+
+// readAt reads the bytes at off, the holes are zeros.
+func (f *memFile) readAt(b []byte, off int64) int {
+	if off >= f.size {
+		return 0
+	}
+	if max := f.size - off; int64(len(b)) > max {
+		b = b[:max]
+	}
+	for n := 0; n < len(b); {
+		i, pos := (off+int64(n))/memPageSize, (off+int64(n))%memPageSize
+		m := len(b) - n
+		if m > int(memPageSize-pos) {
+			m = int(memPageSize - pos)
+		}
+		if page, ok := f.pages[i]; ok {
+			copy(b[n:n+m], page[pos:])
+		} else {
+			for j := n; j < n+m; j++ {
+				b[j] = 0
+			}
+		}
+		n += m
+	}
+	return len(b)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > f.size {
+		f.size = end
+	}
+	for len(p) > 0 {
+		i, pos := off/memPageSize, off%memPageSize
+		page, ok := f.pages[i]
+		if !ok {
+			page = make([]byte, memPageSize)
+			f.pages[i] = page
+		}
+		n := copy(page[pos:], p)
+		p, off = p[n:], off+int64(n)
+	}
+}
+
+func (f *memFile) truncate(size int64) {
+	for i := range f.pages {
+		if i*memPageSize >= size {
+			delete(f.pages, i)
+		}
+	}
+	if page, ok := f.pages[size/memPageSize]; ok {
+		for j := size % memPageSize; j < memPageSize; j++ {
+			page[j] = 0
+		}
+	}
+	f.size = size
+}
+
+// NewMemStorage creates a MemStorage.
+func NewMemStorage() *MemStorage { return &MemStorage{files: map[string]*memFile{}} }
+
+// OpenWrite opens the file to write, the file is created if not exists.
+func (s *MemStorage) OpenWrite(name string) (StorageFile, error) {
+	name = storageName(name)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		s.files[name] = &memFile{pages: map[int64][]byte{}, modTime: time.Now()}
+	}
+	return &memWriter{s: s, name: name}, nil
+}
+
+// ReadRange opens the bytes [from, to) of the file.
+func (s *MemStorage) ReadRange(name string, from, to uint64) (io.ReadCloser, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	f, ok := s.files[storageName(name)]
+	if !ok {
+		return nil, notExist("read", name)
+	}
+	size := uint64(f.size)
+	if to == 0 || to > size {
+		to = size
+	}
+	if from > to {
+		from = to
+	}
+	return &memReader{s: s, f: f, off: int64(from), to: int64(to)}, nil
+}
+
+// memReader reads the range of the file page by page.
+type memReader struct {
+	s       *MemStorage
+	f       *memFile
+	off, to int64
+}
+
+func (r *memReader) Read(p []byte) (int, error) {
+	if r.off >= r.to {
+		return 0, io.EOF
+	}
+	if max := r.to - r.off; int64(len(p)) > max {
+		p = p[:max]
+	}
+	r.s.RLock()
+	n := r.f.readAt(p, r.off)
+	r.s.RUnlock()
+	if n == 0 { // truncated after opened
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *memReader) Close() error { return nil }
+
+// Stat returns the info of the file or the directory.
+func (s *MemStorage) Stat(name string) (StorageInfo, error) {
+	name = storageName(name)
+	s.RLock()
+	defer s.RUnlock()
+
+	if f, ok := s.files[name]; ok {
+		return StorageInfo{Name: name, Size: f.size, ModTime: f.modTime}, nil
+	}
+	for k := range s.files {
+		if name == "" || strings.HasPrefix(k, name+"/") {
+			return StorageInfo{Name: name, IsDir: true}, nil
+		}
+	}
+	return StorageInfo{}, notExist("stat", name)
+}
+
+// List lists the files whose names have the prefix.
+func (s *MemStorage) List(prefix string) ([]StorageInfo, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	s.RLock()
+	defer s.RUnlock()
+
+	var infos []StorageInfo
+	for k, f := range s.files {
+		if strings.HasPrefix(k, prefix) {
+			infos = append(infos, StorageInfo{Name: k, Size: f.size, ModTime: f.modTime})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Delete deletes the file.
+func (s *MemStorage) Delete(name string) error {
+	name = storageName(name)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		for k := range s.files {
+			if strings.HasPrefix(k, name+"/") {
+				return fmt.Errorf("delete %s: directory not empty", name)
+			}
+		}
+		return notExist("delete", name)
+	}
+	delete(s.files, name)
+	return nil
+}
+
+// Rename renames the file.
+func (s *MemStorage) Rename(name, newName string) error {
+	name, newName = storageName(name), storageName(newName)
+	s.Lock()
+	defer s.Unlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return notExist("rename", name)
+	}
+	delete(s.files, name)
+	s.files[newName] = f
+	return nil
+}
+
+type memWriter struct {
+	s    *MemStorage
+	name string
+}
+
+func (w *memWriter) file() (*memFile, error) {
+	f, ok := w.s.files[w.name]
+	if !ok { // deleted or renamed after opened
+		return nil, notExist("write", w.name)
+	}
+	return f, nil
+}
+
+func (w *memWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.s.Lock()
+	defer w.s.Unlock()
+
+	f, err := w.file()
+	if err != nil {
+		return 0, err
+	}
+	f.writeAt(p, off)
+	f.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Truncate(size int64) error {
+	w.s.Lock()
+	defer w.s.Unlock()
+
+	f, err := w.file()
+	if err != nil {
+		return err
+	}
+	f.truncate(size)
+	f.modTime = time.Now()
+	return nil
+}
+
+func (w *memWriter) Close() error { return nil }
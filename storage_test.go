@@ -0,0 +1,340 @@
+package goup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory S3 of a single bucket for the tests.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifySigV4(r, "ak", "sk"); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			data, ok := f.objects[strings.TrimPrefix(src, "/bucket/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.objects[key] = data
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	}
+}
+
+// verifySigV4 verifies the AWS Signature Version 4 of the request by the spec, independently of S3Storage.sign.
+func verifySigV4(r *http.Request, accessKey, secretKey string) error {
+	auth := r.Header.Get(Authorization)
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return fmt.Errorf("bad authorization %q", auth)
+	}
+	fields := map[string]string{}
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		fields[k] = v
+	}
+	scope := strings.SplitN(fields["Credential"], "/", 2)
+	if len(scope) != 2 || scope[0] != accessKey {
+		return fmt.Errorf("bad credential %q", fields["Credential"])
+	}
+
+	uriEncode := func(s string) string {
+		var b strings.Builder
+		for _, c := range []byte(s) {
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		return b.String()
+	}
+	var params []string
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			params = append(params, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	sort.Strings(params)
+
+	var headers strings.Builder
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, k := range signed {
+		v := r.Header.Get(k)
+		if k == "host" {
+			v = r.Host
+		}
+		headers.WriteString(k + ":" + strings.TrimSpace(v) + "\n")
+	}
+	if !strings.Contains(fields["SignedHeaders"], "x-amz-date") {
+		return fmt.Errorf("x-amz-date not signed")
+	}
+
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(params, "&"),
+		headers.String(), fields["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope[1] + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, v := range strings.Split(scope[1], "/") {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(v))
+		key = m.Sum(nil)
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(toSign))
+	if want := hex.EncodeToString(m.Sum(nil)); fields["Signature"] != want {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var result s3ListResult
+	for _, k := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{Key: k, Size: int64(len(f.objects[k])), LastModified: time.Now().UTC()})
+	}
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		s3ListResult
+	}{s3ListResult: result})
+}
+
+func TestStorage(t *testing.T) {
+	fake := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer fake.Close()
+
+	storages := map[string]Storage{
+		"local": NewLocalStorage(t.TempDir()),
+		"mem":   NewMemStorage(),
+		"s3":    NewS3Storage(fake.URL, "bucket", "ak", "sk", t.TempDir()),
+	}
+	for name, st := range storages {
+		t.Run(name, func(t *testing.T) { testStorage(t, st) })
+	}
+}
+
+func testStorage(t *testing.T, st Storage) {
+	commit := func(name string) {
+		if c, ok := st.(StorageCommitter); ok {
+			if err := c.Commit(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := st.Stat("x/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+
+	// chunks written out of order
+	for _, cr := range []*chunkRange{{From: 5, To: 10, TotalSize: 10}, {From: 0, To: 5, TotalSize: 10}} {
+		if _, err := writeStorage(st, "x/a.txt", strings.NewReader("helloworld"[cr.From:cr.To]), cr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("x/a.txt")
+	if _, err := writeStorage(st, "b.txt", strings.NewReader("abc"), nil); err != nil {
+		t.Fatal(err)
+	}
+	commit("b.txt")
+
+	if info, err := st.Stat("x/a.txt"); err != nil || info.Size != 10 || info.IsDir {
+		t.Fatalf("unexpected stat %+v, %v", info, err)
+	}
+	if info, err := st.Stat("x"); err != nil || !info.IsDir {
+		t.Fatalf("unexpected stat %+v, %v", info, err)
+	}
+	r, err := st.ReadRange("x/a.txt", 3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "lowo" {
+		t.Fatalf("unexpected range %q", data)
+	}
+	_ = r.Close()
+	if storageChecksum(st, "x/a.txt", 0, 10) != checksumReader(strings.NewReader("helloworld")) {
+		t.Fatal("unexpected checksum")
+	}
+
+	// rewrites the first chunk of an existing file
+	if _, err := writeStorage(st, "x/a.txt", strings.NewReader("HELLO"), &chunkRange{From: 0, To: 5, TotalSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+	commit("x/a.txt")
+	if hash, size, _ := storageHash(st, "x/a.txt"); size != 10 || hash != hashReader(strings.NewReader("HELLOworld")) {
+		t.Fatalf("unexpected hash %s, size %d", hash, size)
+	}
+
+	if err := st.Rename("x/a.txt", "y/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := st.List(""); err != nil || fmt.Sprint(fileNames(list)) != "[b.txt y/a.txt]" {
+		t.Fatalf("unexpected list %v, %v", list, err)
+	}
+	if list, err := st.List("y/"); err != nil || fmt.Sprint(fileNames(list)) != "[y/a.txt]" {
+		t.Fatalf("unexpected list %v, %v", list, err)
+	}
+
+	if err := st.Delete("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Stat("b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+}
+
+// fileNames returns the names of the files, the directories are skipped.
+func fileNames(list []StorageInfo) []string {
+	var names []string
+	for _, info := range list {
+		if !info.IsDir {
+			names = append(names, info.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestServerMemStorage(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 3*64*1024+100)
+	want, _ := os.ReadFile(src)
+
+	st := NewMemStorage()
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil, WithStorage(st)))
+	defer ts.Close()
+
+	c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _, _ := storageHash(st, "src.bin"); hash != hashReader(bytes.NewReader(want)) {
+		t.Fatal("uploaded file differs")
+	}
+
+	var buf bytes.Buffer
+	c, _ = New(ts.URL+"/src.bin", WithWriter(&buf), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, buf.Bytes()) {
+		t.Fatal("downloaded file differs")
+	}
+}
+
+func TestS3StagingConcurrent(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"a.bin": []byte("0123456789")}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	st := NewS3Storage(ts.URL, "bucket", "ak", "sk", t.TempDir())
+	if _, err := NewS3Storage(ts.URL, "bucket", "ak", "bad", t.TempDir()).Stat("a.bin"); err == nil {
+		t.Fatal("bad signature accepted")
+	}
+
+	// the concurrent first chunks of the existing object, none is overwritten by the staging of another
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cr := &chunkRange{From: uint64(i * 2), To: uint64(i*2 + 2), TotalSize: 10}
+			if _, err := writeStorage(st, "a.bin", strings.NewReader("abcdefghij"[cr.From:cr.To]), cr); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := st.Commit("a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.objects["a.bin"]); got != "abcdefghij" {
+		t.Fatalf("unexpected object %q", got)
+	}
+}
+
+func TestMemStorageSparse(t *testing.T) {
+	st := NewMemStorage()
+	f, err := openStorageChunk(st, "huge.bin", &chunkRange{From: 0, To: 5, TotalSize: 1 << 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte("hello"), 1<<40-5)
+	_ = f.Close()
+	if info, _ := st.Stat("huge.bin"); info.Size != 1<<40 || len(st.files["huge.bin"].pages) != 1 {
+		t.Fatalf("unexpected size %d, pages %d", info.Size, len(st.files["huge.bin"].pages))
+	}
+	r, _ := st.ReadRange("huge.bin", 1<<40-8, 0)
+	if data, _ := io.ReadAll(r); string(data) != "\x00\x00\x00hello" {
+		t.Fatalf("unexpected tail %q", data)
+	}
+
+	// the truncated bytes are zeros when the file grows again
+	_, _ = writeStorage(st, "a.txt", strings.NewReader("helloworld"), nil)
+	f, _ = st.OpenWrite("a.txt")
+	_ = f.Truncate(3)
+	_ = f.Truncate(5)
+	r, _ = st.ReadRange("a.txt", 0, 0)
+	if data, _ := io.ReadAll(r); string(data) != "hel\x00\x00" {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
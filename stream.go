@@ -0,0 +1,183 @@
+package goup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/iox"
+	"github.com/bingoohuang/goup/shapeio"
+)
+
+// maxMemoryChunk is the max chunk size buffered in memory for streaming upload,
+// the larger chunks are spilled to temporary files.
+const maxMemoryChunk = 32 << 20 // 32 MiB
+
+// streamChunk is a buffered chunk of the streaming reader, it can be reread for retrying.
+type streamChunk struct {
+	io.ReadSeeker
+	Size    uint64
+	cleanup func()
+}
+
+// readStreamChunk reads a chunk up to size bytes from r, eof is true when r is exhausted.
+func readStreamChunk(r io.Reader, size uint64) (chunk *streamChunk, eof bool, err error) {
+	if size <= maxMemoryChunk {
+		buf := make([]byte, size)
+		n, err := io.ReadFull(r, buf)
+		eof = errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !eof {
+			return nil, false, err
+		}
+		return &streamChunk{ReadSeeker: bytes.NewReader(buf[:n]), Size: uint64(n), cleanup: func() {}}, eof, nil
+	}
+
+	f, err := os.CreateTemp("", "goup-stream-")
+	if err != nil {
+		return nil, false, err
+	}
+	cleanup := func() {
+		Close(f)
+		_ = os.Remove(f.Name())
+	}
+	n, err := io.CopyN(f, r, int64(size))
+	eof = errors.Is(err, io.EOF)
+	if err != nil && !eof {
+		cleanup()
+		return nil, false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, false, err
+	}
+	return &streamChunk{ReadSeeker: f, Size: uint64(n), cleanup: cleanup}, eof, nil
+}
+
+// initUploadStream uploads the Reader of unknown length by sequential chunks,
+// and sends the final size by a closing request.
+func (c *Client) initUploadStream() error {
+	log.Printf("Upload %s started: %v", c.ID, c.Rename)
+	defer log.Printf("Upload %s complete: %v", c.ID, c.Rename)
+
+	c.Progress.Start(0)
+	defer c.Progress.Finish()
+
+	c.hasher = sha256.New()
+	reader := io.TeeReader(c.Reader, c.hasher)
+	if c.LimitRate > 0 {
+		reader = shapeio.NewReader(io.NopCloser(reader), shapeio.WithRateLimit(float64(c.LimitRate)), c.onWait())
+	}
+	if c.ChunkSize == 0 {
+		return c.uploadBody(reader)
+	}
+
+	c.TotalSize = 0
+	for i := uint64(0); ; i++ {
+		chunk, eof, err := readStreamChunk(reader, c.ChunkSize)
+		if err != nil {
+			return fmt.Errorf("read stream: %w", err)
+		}
+
+		if chunk.Size > 0 || i == 0 { // the empty stream still sends a chunk, for the server to know the session streamed
+			cr := &chunkRange{From: c.TotalSize, To: c.TotalSize + chunk.Size, PartSize: chunk.Size, Streaming: true}
+			err = c.uploadStreamChunk(i, chunk, cr)
+		}
+		chunk.cleanup()
+		if err != nil {
+			return err
+		}
+
+		c.TotalSize += chunk.Size
+		if eof {
+			break
+		}
+	}
+
+	return c.finishStream()
+}
+
+func (c *Client) uploadStreamChunk(i uint64, chunk *streamChunk, cr *chunkRange) error {
+	chunkChecksum := checksumReader(chunk)
+	job := func(ctx context.Context, _ uint64) error {
+		if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := c.chunkUpload(ctx, io.NopCloser(chunk), cr, chunkChecksum)
+		return err
+	}
+
+	c.emit(EventChunkQueued, i, cr, 0, nil)
+	if err := c.transferChunk(i, cr, job); err != nil {
+		if c.ctx.Err() != nil {
+			return c.ctx.Err()
+		}
+		return &TransferError{Operation: "upload", FullPath: c.Rename,
+			Chunks: []ChunkError{{Index: i, From: cr.From, To: cr.To, Err: err}}}
+	}
+	return nil
+}
+
+// streamTracker records the sessions which streamed into the files, keyed by session:name,
+// so that only they can finish the streams, the retried finishing included.
+type streamTracker struct {
+	sync.Mutex
+	files map[string]time.Time // by session:name, the last chunk time
+}
+
+var streams = &streamTracker{files: map[string]time.Time{}}
+
+// mark records the streaming chunk of the session into the file, and forgets the streams idle for a day.
+func (t *streamTracker) mark(sessionID, name string) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	for k, v := range t.files {
+		if now.Sub(v) > 24*time.Hour {
+			delete(t.files, k)
+		}
+	}
+	t.files[sessionID+":"+name] = now
+}
+
+// streamed tells whether the session streamed into the file.
+func (t *streamTracker) streamed(sessionID, name string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	_, ok := t.files[sessionID+":"+name]
+	return ok
+}
+
+// finishStream sends the closing request with the final size.
+func (c *Client) finishStream() error {
+	return retryJob(c.ctx, c.RetryPolicy, func() error {
+		r, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, nil)
+		if err != nil {
+			return err
+		}
+		r = withEndpoint(r, "stream_finish")
+		r.Header.Set(Authorization, c.Bearer)
+		r.Header.Set(ContentDisposition, c.contentDisposition)
+		c.setMeta(r)
+		r.Header.Set("Content-Gulp", "Session="+c.ID+"; Size="+strconv.FormatUint(c.TotalSize, 10))
+		q, err := c.Client.Do(r)
+		if err != nil {
+			return err
+		}
+		defer iox.DiscardClose(q.Body)
+		if q.StatusCode != http.StatusOK {
+			return newStatusCodeError(q)
+		}
+		return nil
+	})
+}
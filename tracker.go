@@ -0,0 +1,207 @@
+package goup
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// uploadState is the receiving state of a chunked upload.
+type uploadState struct {
+	Name      string
+	Session   string
+	Identity  string
+	TotalSize uint64
+	Received  uint64
+	Started   time.Time
+	Updated   time.Time
+
+	ranges map[uint64]uint64 // from -> to
+}
+
+// completion is the result of the post-upload processing of a completed upload, kept for an hour,
+// so that the retried chunks of the upload get it, instead of starting the upload over.
+type completion struct {
+	session   string
+	totalSize uint64
+	at        time.Time
+	done      chan struct{}
+	err       error
+}
+
+// wait waits the processing and returns its error.
+func (c *completion) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// uploadTracker records which chunks of the chunked uploads have arrived,
+// so that the server knows when a file is complete.
+type uploadTracker struct {
+	sync.Mutex
+	files     map[string]*uploadState // by the storage name
+	completed map[string]*completion  // by the storage name
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{files: map[string]*uploadState{}, completed: map[string]*completion{}}
+}
+
+var uploads = newUploadTracker()
+
+// downloads tracks the chunks sent by the download sessions for the webhooks, keyed by session:name.
+var downloads = newUploadTracker()
+
+// mark marks the chunk range of the file as received,
+// and returns true when all the chunks of the file are received.
+func (t *uploadTracker) mark(name, sessionID, identity string, cr *chunkRange) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if c, ok := t.completed[name]; ok && c.session == sessionID && c.totalSize == cr.TotalSize {
+		return false // a retried chunk of the completed upload
+	}
+
+	now := time.Now()
+	s, ok := t.files[name]
+	if !ok || s.TotalSize != cr.TotalSize {
+		s = &uploadState{
+			Name:      name,
+			TotalSize: cr.TotalSize,
+			Started:   now,
+			ranges:    map[uint64]uint64{},
+		}
+		t.files[name] = s
+	}
+
+	s.Session, s.Identity, s.Updated = sessionID, identity, now
+	if _, ok := s.ranges[cr.From]; !ok {
+		s.ranges[cr.From] = cr.To
+		s.Received += cr.PartSize
+	}
+
+	if s.Received < s.TotalSize {
+		return false
+	}
+
+	delete(t.files, name)
+	for k, c := range t.completed {
+		if now.Sub(c.at) > time.Hour {
+			delete(t.completed, k)
+		}
+	}
+	t.completed[name] = &completion{session: sessionID, totalSize: s.TotalSize, at: now, done: make(chan struct{})}
+	return true
+}
+
+// completion returns the completion of the upload of the session, nil if it is not completed.
+func (t *uploadTracker) completion(name, sessionID string, totalSize uint64) *completion {
+	t.Lock()
+	defer t.Unlock()
+
+	if c, ok := t.completed[name]; ok && c.session == sessionID && c.totalSize == totalSize {
+		return c
+	}
+	return nil
+}
+
+// finish records the result of the post-upload processing of the completed upload.
+func (t *uploadTracker) finish(name, sessionID string, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if c, ok := t.completed[name]; ok && c.session == sessionID {
+		c.err = err
+		close(c.done)
+	}
+}
+
+// started tells whether the chunked upload of the file with the total size has started.
+func (t *uploadTracker) started(name string, totalSize uint64) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	s, ok := t.files[name]
+	return ok && s.TotalSize == totalSize
+}
+
+// expire forgets the upload of the file if it is not updated after the time, and returns true,
+// or returns false if the upload is still active.
+func (t *uploadTracker) expire(name string, before time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if s, ok := t.files[name]; ok && s.Updated.After(before) {
+		return false
+	}
+	delete(t.files, name)
+	return true
+}
+
+// prune forgets the transfers not updated after the time.
+func (t *uploadTracker) prune(before time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	for name, s := range t.files {
+		if s.Updated.Before(before) {
+			delete(t.files, name)
+		}
+	}
+}
+
+// inProgress returns the states of the uploads in progress by the storage names.
+func (t *uploadTracker) inProgress() map[string]uploadState {
+	t.Lock()
+	defer t.Unlock()
+
+	states := make(map[string]uploadState, len(t.files))
+	for name, s := range t.files {
+		states[name] = *s
+	}
+	return states
+}
+
+// savedUpload is the state of an upload in progress persisted across the restarts.
+type savedUpload struct {
+	uploadState
+	Ranges map[uint64]uint64 `json:"ranges"`
+}
+
+// states returns the states of the uploads in progress, with their received chunks.
+func (t *uploadTracker) states() []savedUpload {
+	t.Lock()
+	defer t.Unlock()
+
+	states := make([]savedUpload, 0, len(t.files))
+	for _, s := range t.files {
+		ranges := make(map[uint64]uint64, len(s.ranges))
+		for from, to := range s.ranges {
+			ranges[from] = to
+		}
+		states = append(states, savedUpload{uploadState: *s, Ranges: ranges})
+	}
+	return states
+}
+
+// restore restores the states of the uploads not tracked yet.
+func (t *uploadTracker) restore(states []savedUpload) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, v := range states {
+		if _, ok := t.files[v.Name]; ok {
+			continue
+		}
+		s := v.uploadState
+		s.ranges = v.Ranges
+		if s.ranges == nil {
+			s.ranges = map[uint64]uint64{}
+		}
+		t.files[s.Name] = &s
+	}
+}
@@ -41,8 +41,17 @@ type UploadResult struct {
 	LimitSize     string
 }
 
-// NetHTTPUpload upload
-func NetHTTPUpload(w http.ResponseWriter, r *http.Request, rootDir string, limitSize uint64) error {
+// NetHTTPUpload upload, the files are saved to rootDir unless WithStorage is specified,
+// and the size of each file is limited to limitSize (0 for no limit) unless WithQuota is specified.
+func NetHTTPUpload(w http.ResponseWriter, r *http.Request, rootDir string, limitSize uint64, fns ...ServerOptFn) error {
+	fns = append([]ServerOptFn{
+		WithStorage(NewLocalStorage(rootDir)),
+		func(o *ServerOpt) { o.Quota.MaxFileSize = int64(limitSize) },
+	}, fns...)
+	return netHTTPUpload(w, r, newServerOpt(fns...))
+}
+
+func netHTTPUpload(w http.ResponseWriter, r *http.Request, opt *ServerOpt) error {
 	start := time.Now()
 	maxMemory := 16 /*16 MiB */ << 20
 	if err := r.ParseMultipartForm(int64(maxMemory)); err != nil {
@@ -56,14 +65,27 @@ func NetHTTPUpload(w http.ResponseWriter, r *http.Request, rootDir string, limit
 	var fileSizes []string
 	for k, v := range r.MultipartForm.File {
 		index++
-		file, n, err := saveFormFile(v[0], rootDir, r.URL.Path, index, fileCount)
+		file, err := uploadName(formFilename(v[0], r.URL.Path, index, fileCount))
+		if err != nil {
+			return err
+		}
+		if err := opt.Mounts.allow(file, true); err != nil {
+			return err
+		}
+		if err := opt.checkQuota(file, Identity(r), v[0].Size); err != nil {
+			return err
+		}
+		n, err := saveFormFile(v[0], opt.Storage, file)
 		if err != nil {
 			return err
 		}
+		log.Printf("recieved file %s: %s", k, file)
+		if err := opt.complete(r, file); err != nil {
+			return err
+		}
 		totalSize += n
 		files = append(files, file)
 		fileSizes = append(fileSizes, man.Bytes(uint64(n)))
-		log.Printf("recieved file %s: %s", k, file)
 	}
 
 	end := time.Now()
@@ -73,7 +95,7 @@ func NetHTTPUpload(w http.ResponseWriter, r *http.Request, rootDir string, limit
 		Files:         files,
 		FileSizes:     fileSizes,
 		MaxTempMemory: man.Bytes(uint64(maxMemory)),
-		LimitSize:     man.Bytes(limitSize),
+		LimitSize:     man.Bytes(uint64(opt.quota().MaxFileSize)),
 		TotalSize:     man.Bytes(uint64(totalSize)),
 		Cost:          end.Sub(start).String(),
 	})
@@ -103,12 +125,8 @@ func TrimExt(filepath, ext string) string {
 	return filepath[:len(filepath)-len(ext)]
 }
 
-func saveFormFile(fh *multipart.FileHeader, rootDir, urlPath string, fileIndex, fileCount int) (string, int64, error) {
-	file, err := fh.Open()
-	if err != nil {
-		return "", 0, err
-	}
-
+// formFilename returns the storage name to save the form file.
+func formFilename(fh *multipart.FileHeader, urlPath string, fileIndex, fileCount int) string {
 	base := filepath.Base(urlPath)
 	if base != "/" {
 		if fileCount > 1 {
@@ -116,29 +134,50 @@ func saveFormFile(fh *multipart.FileHeader, rootDir, urlPath string, fileIndex,
 			base = fmt.Sprintf("%s.%d%s", TrimExt(base, ext), fileIndex, ext)
 		}
 	}
-	filename := firstFilename(base, filepath.Base(fh.Filename), ksuid.New().String())
-	fullPath := filepath.Join(rootDir, filename)
+	return firstFilename(base, filepath.Base(fh.Filename), ksuid.New().String())
+}
+
+func saveFormFile(fh *multipart.FileHeader, st Storage, filename string) (int64, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return 0, err
+	}
 
-	// use temporary file directly
+	// use temporary file directly for the local storage
 	if f, ok := file.(*os.File); ok {
-		n, err := file.Seek(0, io.SeekEnd)
-		if err != nil {
-			return "", n, err
-		}
-		if err := file.Close(); err != nil {
-			return "", 0, err
-		}
-		if err := os.Rename(f.Name(), fullPath); err != nil {
-			return "", 0, err
+		if fullPath, ok := localPath(st, filename); ok {
+			n, err := file.Seek(0, io.SeekEnd)
+			if err != nil {
+				return n, err
+			}
+			if err := file.Close(); err != nil {
+				return 0, err
+			}
+			if err := os.Rename(f.Name(), fullPath); err != nil {
+				return 0, err
+			}
+			return n, nil
 		}
-		return fullPath, n, nil
 	}
 
-	n, err := writeChunk(fullPath, nil, file, nil)
+	n, err := writeStorage(st, filename, file, nil)
 	if err := file.Close(); err != nil {
-		return "", 0, err
+		return 0, err
+	}
+	return n, err
+}
+
+// localPath returns the local path of the file if the storage is local.
+func localPath(st Storage, name string) (string, bool) {
+	switch s := st.(type) {
+	case *LocalStorage:
+		return s.LocalPath(name)
+	case *Mounts:
+		t, rel := s.lookup(name)
+		return localPath(s.storage(t), rel)
+	default:
+		return "", false
 	}
-	return fullPath, n, err
 }
 
 func firstFilename(s ...string) string {
@@ -10,6 +10,7 @@ import (
 	"net/textproto"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -44,6 +45,12 @@ type Header struct {
 	Salt     string
 	Range    string
 	Filename string
+	// Size is the final size sent by the closing request of a streaming upload.
+	Size string
+	// Rename is the new path of the renaming request.
+	Rename string
+	// Admin is the target of the admin request, like sessions, uploads, downloads, session, upload or download.
+	Admin string
 }
 
 // ParseHeader parse the Content-Gulp Header to structure.
@@ -75,6 +82,9 @@ func ParseHeader(header string) Header {
 		Salt:     m["Salt"],
 		Range:    m["Range"],
 		Filename: m["Filename"],
+		Size:     m["Size"],
+		Rename:   m["Rename"],
+		Admin:    m["Admin"],
 	}
 }
 
@@ -116,7 +126,7 @@ func openChunk(fullPath string, cr *chunkRange) (f *os.File, err error) {
 		}
 	}()
 
-	if cr != nil {
+	if cr != nil && !cr.Streaming {
 		stat, err := f.Stat()
 		if err != nil {
 			return nil, fmt.Errorf("stat file %s error: %w", fullPath, err)
@@ -126,6 +136,8 @@ func openChunk(fullPath string, cr *chunkRange) (f *os.File, err error) {
 				return nil, fmt.Errorf("truncate file %s to size %d error: %w", fullPath, cr.TotalSize, err)
 			}
 		}
+	}
+	if cr != nil {
 		if _, err := f.Seek(int64(cr.From), io.SeekStart); err != nil {
 			return nil, fmt.Errorf("seek file %s with pot %d error: %w", f.Name(), cr.From, err)
 		}
@@ -219,8 +231,8 @@ type readCloseRewindable struct {
 	Rewindable
 }
 
-// CreateChunkReader creates a chunk reader for the file.
-func CreateChunkReader(fullPath string, partFrom, partTo uint64, limitRate uint64) (r io.ReadCloser, err error) {
+// CreateChunkReader creates a chunk reader for the file, fns are the extra options of the rate limit.
+func CreateChunkReader(fullPath string, partFrom, partTo uint64, limitRate uint64, fns ...shapeio.LimitConfigFn) (r io.ReadCloser, err error) {
 	if fileNotExists(fullPath) {
 		return nil, fmt.Errorf("file %s not exists", fullPath)
 	}
@@ -247,20 +259,21 @@ func CreateChunkReader(fullPath string, partFrom, partTo uint64, limitRate uint6
 		if _, err := f.Seek(int64(partFrom), io.SeekStart); err != nil {
 			return nil, fmt.Errorf("seek file %s to %d error: %w", fullPath, partFrom, err)
 		}
+		size -= int64(partFrom)
+	}
 
-		if partTo > partFrom {
-			reader := io.LimitReader(f, int64(partTo-partFrom))
-			size -= int64(partFrom)
-			return Wrap(reader, f), nil
+	if partTo > partFrom {
+		var reader io.ReadCloser = Wrap(io.LimitReader(f, int64(partTo-partFrom)), f)
+		if limitRate > 0 {
+			reader = shapeio.NewReader(reader, append(fns, shapeio.WithRateLimit(float64(limitRate)))...)
 		}
-
-		size = int64(partTo - partFrom)
+		return reader, nil
 	}
 
 	pf := &PayloadFile{ReadCloser: f, Name: f.Name(), Size: size}
 
 	if limitRate > 0 {
-		pf.ReadCloser = shapeio.NewReader(pf.ReadCloser, shapeio.WithRateLimit(float64(limitRate)))
+		pf.ReadCloser = shapeio.NewReader(pf.ReadCloser, append(fns, shapeio.WithRateLimit(float64(limitRate)))...)
 	}
 
 	rcr := &readCloseRewindable{
@@ -291,6 +304,8 @@ type chunkRange struct {
 	To   uint64
 	PartSize,
 	TotalSize uint64
+	// Streaming means the total size is unknown yet, like `bytes 0-1024/*`.
+	Streaming bool
 }
 
 func newChunkRange(index, fileChunk, partSize, totalSize uint64) *chunkRange {
@@ -303,6 +318,9 @@ func newChunkRange(index, fileChunk, partSize, totalSize uint64) *chunkRange {
 }
 
 func (c chunkRange) createContentRange() string {
+	if c.Streaming {
+		return fmt.Sprintf("bytes %d-%d/*", c.From, c.To)
+	}
 	return fmt.Sprintf("bytes %d-%d/%d", c.From, c.To, c.TotalSize)
 }
 
@@ -345,29 +363,38 @@ func parseRange(rangeHead string) (*Range, error) {
 
 func parseContentRange(contentRange string) (c *chunkRange, err error) {
 	contentRange = strings.ReplaceAll(contentRange, "bytes ", "")
-	fromTo := strings.Split(contentRange, "/")[0]
-	totalSizeStr := strings.Split(contentRange, "/")[1]
-	totalSize, err := strconv.ParseUint(totalSizeStr, 10, 64)
-	if err != nil {
-		return nil, err
+	fromTo, totalSizeStr, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return nil, fmt.Errorf("bad content range %s", contentRange)
+	}
+	streaming := totalSizeStr == "*"
+	var totalSize uint64
+	if !streaming {
+		if totalSize, err = strconv.ParseUint(totalSizeStr, 10, 64); err != nil {
+			return nil, err
+		}
 	}
 
-	split := strings.Split(fromTo, "-")
-	partFrom, err := strconv.ParseUint(split[0], 10, 64)
+	from, to, _ := strings.Cut(fromTo, "-")
+	partFrom, err := strconv.ParseUint(from, 10, 64)
 	if err != nil {
 		return nil, err
 	}
 
-	partTo, err := strconv.ParseUint(split[1], 10, 64)
+	partTo, err := strconv.ParseUint(to, 10, 64)
 	if err != nil {
 		return nil, err
 	}
+	if partTo < partFrom || !streaming && partTo > totalSize {
+		return nil, fmt.Errorf("bad content range %s", contentRange)
+	}
 
 	return &chunkRange{
 		From:      partFrom,
 		To:        partTo,
 		PartSize:  partTo - partFrom,
 		TotalSize: totalSize,
+		Streaming: streaming,
 	}, nil
 }
 
@@ -379,6 +406,11 @@ func checksumReader(r io.Reader) string {
 	return b64.EncodeBytes2String(h.Sum(nil), b64.Raw, b64.URL)
 }
 
+// joinRoot joins the slash separated name to the root, the name is cleaned so that it never escapes the root.
+func joinRoot(root, name string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
 func fileNotExists(filePath string) bool {
 	_, err := os.Stat(filePath)
 	return os.IsNotExist(err)
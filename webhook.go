@@ -0,0 +1,276 @@
+package goup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/iox"
+	"github.com/segmentio/ksuid"
+)
+
+// The webhook event types.
+const (
+	EventUpload   = "upload"
+	EventDownload = "download"
+	EventDelete   = "delete"
+)
+
+// The webhook request headers.
+const (
+	WebhookEventHeader     = "X-Goup-Event"
+	WebhookDeliveryHeader  = "X-Goup-Delivery"
+	WebhookSignatureHeader = "X-Goup-Signature"
+)
+
+// Webhook is the url to POST the events to.
+type Webhook struct {
+	URL string
+	// Secret signs the body by HMAC-SHA256 in the X-Goup-Signature header as sha256=hex, empty for no signature.
+	Secret string
+	// Events are the event types to send, empty for all.
+	Events []string
+}
+
+// WebhookEvent is the JSON payload of the webhook.
+type WebhookEvent struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash,omitempty"`
+	Identity string    `json:"identity,omitempty"`
+	ModTime  time.Time `json:"modTime"`
+	Time     time.Time `json:"time"`
+	// Reason is the reason of the deletion by the janitor.
+	Reason string `json:"reason,omitempty"`
+}
+
+// WithWebhooks appends webhooks.
+func WithWebhooks(v ...Webhook) ServerOptFn {
+	return func(o *ServerOpt) { o.Webhooks = append(o.Webhooks, v...) }
+}
+
+// WithWebhookQueueDir set WebhookQueueDir.
+func WithWebhookQueueDir(v string) ServerOptFn { return func(o *ServerOpt) { o.WebhookQueueDir = v } }
+
+// ParseWebhook parses the webhook spec like [upload,download,delete:]url, the secret is set separately.
+func ParseWebhook(spec string) (Webhook, error) {
+	w := Webhook{URL: spec}
+	if prefix, u, ok := strings.Cut(spec, ":"); ok && !strings.HasPrefix(u, "//") {
+		for _, e := range strings.Split(prefix, ",") {
+			switch e {
+			case EventUpload, EventDownload, EventDelete:
+				w.Events = append(w.Events, e)
+			default:
+				return w, fmt.Errorf("unknown webhook event %s in %s", e, spec)
+			}
+		}
+		w.URL = u
+	}
+	if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+		return w, fmt.Errorf("bad webhook url %s", w.URL)
+	}
+	return w, nil
+}
+
+func (w Webhook) accepts(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	webhookMaxAttempts = 15
+	webhookMaxWait     = time.Hour
+)
+
+// webhookDelivery is a pending delivery in the queue directory, the secret is looked up by the url when sending.
+type webhookDelivery struct {
+	URL         string       `json:"url"`
+	Event       WebhookEvent `json:"event"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"nextAttempt"`
+}
+
+// webhookQueue persists the deliveries as the JSON files in the directory, and sends them with retries.
+type webhookQueue struct {
+	hooks   []Webhook
+	dir     string
+	client  *http.Client
+	minWait time.Duration
+	wake    chan struct{}
+}
+
+func newWebhookQueue(hooks []Webhook, dir string) *webhookQueue {
+	return &webhookQueue{
+		hooks:   hooks,
+		dir:     dir,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		minWait: time.Second,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// emit queues the event to the webhooks accepting it.
+func (q *webhookQueue) emit(e WebhookEvent) {
+	if q == nil {
+		return
+	}
+
+	e.ID, e.Time = ksuid.New().String(), time.Now()
+	for _, h := range q.hooks {
+		if !h.accepts(e.Type) {
+			continue
+		}
+		d := webhookDelivery{URL: h.URL, Event: e, NextAttempt: e.Time}
+		if err := q.save(fmt.Sprintf("%s-%s.json", e.ID, hashReader(strings.NewReader(h.URL))[:8]), d); err != nil {
+			log.Printf("E! queue webhook %s event %s failed: %v", h.URL, e.ID, err)
+		}
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *webhookQueue) save(file string, d webhookDelivery) error {
+	if err := ensureDir(q.dir); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(d)
+	tmp := filepath.Join(q.dir, file+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, file))
+}
+
+func (q *webhookQueue) start(done <-chan struct{}) {
+	go func() {
+		for {
+			q.deliverDue(time.Now())
+			select {
+			case <-q.wake:
+			case <-time.After(time.Second):
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// deliverDue sends the due deliveries in the order of the events.
+func (q *webhookQueue) deliverDue(now time.Time) {
+	files, _ := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	sort.Strings(files)
+	for _, file := range files {
+		var d webhookDelivery
+		data, err := os.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &d)
+		}
+		if err != nil {
+			log.Printf("E! read webhook delivery %s failed: %v", file, err)
+			continue
+		}
+		if d.NextAttempt.After(now) {
+			continue
+		}
+
+		if err = q.send(d); err == nil {
+			log.Printf("webhook %s event %s %s %s delivered", d.URL, d.Event.ID, d.Event.Type, d.Event.Path)
+			_ = os.Remove(file)
+			continue
+		}
+
+		if d.Attempts++; d.Attempts >= webhookMaxAttempts {
+			log.Printf("E! webhook %s event %s gave up after %d attempts: %v", d.URL, d.Event.ID, d.Attempts, err)
+			_ = os.Rename(file, file+".dead")
+			continue
+		}
+		wait := q.minWait << (d.Attempts - 1)
+		if wait > webhookMaxWait || wait <= 0 {
+			wait = webhookMaxWait
+		}
+		d.NextAttempt = now.Add(wait)
+		log.Printf("W! webhook %s event %s attempt %d failed, retry in %s: %v", d.URL, d.Event.ID, d.Attempts, wait, err)
+		if err := q.save(filepath.Base(file), d); err != nil {
+			log.Printf("E! save webhook delivery %s failed: %v", file, err)
+		}
+	}
+
+	// forgets the aborted chunked downloads
+	downloads.prune(now.Add(-time.Hour))
+}
+
+func (q *webhookQueue) send(d webhookDelivery) error {
+	var hook *Webhook
+	for i, h := range q.hooks {
+		if h.URL == d.URL {
+			hook = &q.hooks[i]
+		}
+	}
+	if hook == nil {
+		return fmt.Errorf("webhook %s is not configured anymore", d.URL)
+	}
+
+	body, _ := json.Marshal(d.Event)
+	r, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set(ContentType, "application/json")
+	r.Header.Set(WebhookEventHeader, d.Event.Type)
+	r.Header.Set(WebhookDeliveryHeader, d.Event.ID)
+	if hook.Secret != "" {
+		r.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(hook.Secret, body))
+	}
+	rsp, err := q.client.Do(r)
+	if err != nil {
+		return err
+	}
+	iox.DiscardClose(rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return &StatusCodeError{StatusCode: rsp.StatusCode}
+	}
+	return nil
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of the body, for the receivers to verify X-Goup-Signature.
+func SignWebhook(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// fileEvent returns the event of the file, with its size, modification time and hash.
+func (o *ServerOpt) fileEvent(eventType, name, identity string) WebhookEvent {
+	e := WebhookEvent{Type: eventType, Path: name, Identity: identity}
+	if info, err := o.Storage.Stat(name); err == nil {
+		e.Size, e.ModTime = info.Size, info.ModTime
+		if eventType == EventDelete {
+			e.Hash = hashes.get(info)
+		} else {
+			e.Hash, _, _ = cachedHash(o.Storage, name)
+		}
+	}
+	return e
+}
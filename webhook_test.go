@@ -0,0 +1,106 @@
+package goup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	setupTestRoot(t)
+	src := writeTestFile(t, 3*64*1024)
+
+	events := make(chan WebhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(WebhookSignatureHeader) != "sha256="+SignWebhook("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e WebhookEvent
+		_ = json.Unmarshal(body, &e)
+		events <- e
+	}))
+	defer receiver.Close()
+
+	ts := httptest.NewServer(ServerHandle("code", "", 64*1024, 0, nil,
+		WithWebhooks(Webhook{URL: receiver.URL, Secret: "secret"}),
+		WithWebhookQueueDir(filepath.Join(t.TempDir(), "webhooks"))))
+	defer ts.Close()
+
+	next := func(eventType string) WebhookEvent {
+		select {
+		case e := <-events:
+			if e.Type != eventType || e.Path != "src.bin" || e.Size != 3*64*1024 {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", eventType)
+		}
+		return WebhookEvent{}
+	}
+
+	c, _ := New(ts.URL, WithFullPath(src), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(EventUpload); e.Hash != c.Result().Hash || e.Identity != "127.0.0.1" {
+		t.Fatalf("unexpected upload event %+v", e)
+	}
+
+	c, _ = New(ts.URL+"/src.bin", WithOutput(t.TempDir()+"/"), WithChunkSize(64*1024), WithCode("code"), WithCoroutines(2))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	next(EventDownload)
+
+	if err := c.Delete(context.Background(), "src.bin"); err != nil {
+		t.Fatal(err)
+	}
+	next(EventDelete)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	fails := 1
+	var got WebhookEvent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer receiver.Close()
+
+	dir := t.TempDir()
+	q := newWebhookQueue([]Webhook{{URL: receiver.URL, Events: []string{EventUpload}}}, dir)
+	q.emit(WebhookEvent{Type: EventDelete, Path: "a.txt"}) // not accepted
+	q.emit(WebhookEvent{Type: EventUpload, Path: "a.txt"})
+
+	now := time.Now()
+	q.deliverDue(now)
+	if got.Path != "" {
+		t.Fatal("delivered despite the failure")
+	}
+
+	// the queue survives the restart
+	q = newWebhookQueue(q.hooks, dir)
+	q.deliverDue(now)
+	if got.Path != "" {
+		t.Fatal("retried before the backoff")
+	}
+	q.deliverDue(now.Add(2 * time.Second))
+	if got.Path != "a.txt" || got.Type != EventUpload {
+		t.Fatalf("unexpected delivered event %+v", got)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 0 {
+		t.Fatalf("unexpected pending deliveries %v", files)
+	}
+}